@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/a-tal/esi-isk/isk/db"
+	"github.com/a-tal/esi-isk/isk/migrations"
+)
+
+const usage = `usage: admin [options] <command> [arguments]
+
+commands:
+  migrate up              apply any pending schema migrations
+  migrate down [-steps n] roll back the latest schema migrations
+  migrate status          list schema migrations and when they were applied
+  reconcile [-fix]        compare character totals with their donations and contracts
+`
+
+func main() {
+	ctx := cx.NewOptions(context.Background())
+	ctx = context.WithValue(ctx, cx.DB, db.Connect(ctx))
+
+	args := flag.Args()
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	switch args[0] {
+	case "migrate":
+		migrate(ctx, args[1:])
+	case "reconcile":
+		reconcile(ctx, args[1:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
+
+// reconcile reports characters whose totals drifted, optionally fixing them
+func reconcile(ctx context.Context, args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	fix := flags.Bool("fix", false, "correct the drifted totals")
+	if err := flags.Parse(args); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := migrations.Check(ctx); err != nil {
+		log.Fatalf("unexpected schema: %v", err)
+	}
+	ctx = context.WithValue(ctx, cx.Statements, db.GetStatements(ctx))
+	ctx = context.WithValue(ctx, cx.SaveLock, db.NewSaveLock())
+
+	drifts, err := db.Reconcile(ctx, *fix)
+	if err != nil {
+		log.Fatalf("failed to reconcile: %+v", err)
+	}
+
+	for _, drift := range drifts {
+		fmt.Println(drift)
+	}
+
+	switch {
+	case len(drifts) < 1:
+		fmt.Println("no drift found")
+	case *fix:
+		fmt.Printf("fixed %d characters\n", len(drifts))
+	default:
+		fmt.Printf("%d characters drifted, run with -fix to correct them\n", len(drifts))
+		os.Exit(1)
+	}
+}
+
+// migrate applies, rolls back or lists the schema migrations
+func migrate(ctx context.Context, args []string) {
+	if len(args) < 1 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	flags := flag.NewFlagSet("migrate "+args[0], flag.ExitOnError)
+	steps := flags.Int("steps", 1, "number of migrations to roll back")
+	if err := flags.Parse(args[1:]); err != nil {
+		log.Fatal(err)
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrations.Up(ctx)
+		for _, migration := range applied {
+			fmt.Printf("applied %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) < 1 {
+			fmt.Println("schema is up to date")
+		}
+	case "down":
+		rolledBack, err := migrations.Down(ctx, *steps)
+		for _, migration := range rolledBack {
+			fmt.Printf("rolled back %04d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	case "status":
+		statuses, err := migrations.GetStatus(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, status := range statuses {
+			applied := "pending"
+			if status.Applied != nil {
+				applied = status.Applied.Format(time.RFC3339)
+			}
+			fmt.Printf("%04d_%s\t%s\n", status.Version, status.Name, applied)
+		}
+		if err := migrations.Check(ctx); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+}
@@ -4,10 +4,9 @@ import (
 	"context"
 
 	"github.com/a-tal/esi-isk/isk"
-	"github.com/a-tal/esi-isk/isk/api"
 	"github.com/a-tal/esi-isk/isk/cx"
 )
 
 func main() {
-	isk.RunServer(cx.NewOptions(api.NewProvider(context.Background())))
+	isk.RunServer(cx.NewOptions(context.Background()))
 }
@@ -2,7 +2,6 @@ package api
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"log"
@@ -12,8 +11,8 @@ import (
 	"sync"
 	"time"
 
-	oidc "github.com/coreos/go-oidc"
 	sessions "github.com/goincremental/negroni-sessions"
+	"github.com/lib/pq"
 	"github.com/twinj/uuid"
 	"golang.org/x/oauth2"
 
@@ -24,32 +23,28 @@ import (
 // StateStore stores state uuids we've given out
 type StateStore struct {
 	lock   *sync.Mutex
-	states map[string]time.Time
+	states map[string]*loginState
+}
+
+// loginState describes the login a state uuid was given out for
+type loginState struct {
+	// issued is when the state was given out
+	issued time.Time
+
+	// scopes are the scopes requested from SSO
+	scopes []string
 }
 
 // NewStateStore returns a new StateStore
 func NewStateStore() *StateStore {
 	ss := &StateStore{
 		lock:   &sync.Mutex{},
-		states: map[string]time.Time{},
+		states: map[string]*loginState{},
 	}
 	go ss.maintenance()
 	return ss
 }
 
-// NewProvider creates our oidc provider
-func NewProvider(ctx context.Context) context.Context {
-	return ctx // HACK: remove ones sso-issues#41 is done
-
-	provider, err := oidc.NewProvider(ctx, "http://login.eveonline.com")
-	if err != nil {
-		log.Fatalf("failed to create provider: %+v", err)
-	}
-
-	ctx = context.WithValue(ctx, cx.Provider, provider)
-	return ctx
-}
-
 // maintenance ensures we don't leak memory storing state uuids forever
 func (s *StateStore) maintenance() {
 	for {
@@ -65,47 +60,52 @@ func (s *StateStore) prune() {
 
 	cutoff := stateCutoff()
 	toPrune := []string{}
-	for state, ts := range s.states {
-		if ts.Before(cutoff) {
+	for state, ls := range s.states {
+		if ls.issued.Before(cutoff) {
 			toPrune = append(toPrune, state)
 		}
 	}
 
 	for _, p := range toPrune {
-		log.Printf("pruning old state: %s ts: %s", p, s.states[p])
+		log.Printf("pruning old state: %s ts: %s", p, s.states[p].issued)
 		delete(s.states, p)
 	}
 }
 
-func knownState(ctx context.Context, state string) bool {
+func knownState(ctx context.Context, state string) (*loginState, bool) {
 	ss := ctx.Value(cx.StateStore).(*StateStore)
 	ss.lock.Lock()
 	defer ss.lock.Unlock()
 
-	ts, found := ss.states[state]
+	ls, found := ss.states[state]
 	if !found {
-		return false
+		return nil, false
 	}
 
 	delete(ss.states, state)
 
-	return ts.After(stateCutoff())
+	return ls, ls.issued.After(stateCutoff())
 }
 
 func stateCutoff() time.Time {
 	return time.Now().UTC().Add(-time.Duration(300) * time.Second)
 }
 
-func newState(ctx context.Context) string {
+func newState(ctx context.Context, scopes []string) string {
 	state := uuid.NewV4().String()
 	ss := ctx.Value(cx.StateStore).(*StateStore)
 	ss.lock.Lock()
-	ss.states[state] = time.Now().UTC()
+	ss.states[state] = &loginState{
+		issued: time.Now().UTC(),
+		scopes: scopes,
+	}
 	ss.lock.Unlock()
 	return state
 }
 
-// NewLogin creates a new state and throws the user into the oauth flow
+// NewLogin creates a new state and throws the user into the oauth flow.
+// The track query arg picks what to track, e.g. track=wallet,contracts,corp.
+// Passing corp=1 adds the corporation wallet to the default trackers
 func NewLogin(ctx context.Context) http.HandlerFunc {
 	opts := ctx.Value(cx.Opts).(*cx.Options)
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -114,7 +114,22 @@ func NewLogin(ctx context.Context) http.HandlerFunc {
 			return
 		}
 
-		url := opts.Auth.AuthCodeURL(newState(ctx), oauth2.AccessTypeOffline)
+		track := r.URL.Query().Get("track")
+		if track == "" && r.URL.Query().Get("corp") == "1" {
+			track = strings.Join(append(defaultTrackers, "corp"), ",")
+		}
+
+		scopes, err := requestedScopes(track)
+		if err != nil {
+			write400(w)
+			return
+		}
+
+		url := opts.Auth.AuthCodeURL(
+			newState(ctx, scopes),
+			oauth2.AccessTypeOffline,
+			oauth2.SetAuthURLParam("scope", strings.Join(scopes, " ")),
+		)
 		http.Redirect(w, r.WithContext(ctx), url, 302)
 	}
 }
@@ -132,7 +147,8 @@ func Callback(ctx context.Context) http.HandlerFunc {
 		state := r.FormValue("state")
 		code := r.FormValue("code")
 
-		if !knownState(ctx, state) {
+		ls, ok := knownState(ctx, state)
+		if !ok {
 			write(w, 400, []byte("invalid state"))
 			return
 		}
@@ -143,12 +159,17 @@ func Callback(ctx context.Context) http.HandlerFunc {
 			return
 		}
 
-		user, err := userFromToken(ctx, tok)
+		user, err := userFromToken(ctx, tok, ls.scopes)
 		if err != nil {
 			write(w, 500, []byte("failed to create new user"))
 			return
 		}
 
+		if len(user.Scopes) < 1 {
+			write(w, 400, []byte("no requested scopes were granted"))
+			return
+		}
+
 		if err := db.SaveUser(ctx, user); err != nil {
 			write(w, 500, []byte("failed to save new user"))
 			return
@@ -164,65 +185,34 @@ func Callback(ctx context.Context) http.HandlerFunc {
 	}
 }
 
-// userFromToken creates a userCharacter from the oauth2.Token
+// userFromToken creates a userCharacter from the oauth2.Token, with the
+// requested scopes which were granted
 func userFromToken(
 	ctx context.Context,
 	t *oauth2.Token,
+	requested []string,
 ) (*db.User, error) {
-	charID, owner, err := getOwnerFromJWT(ctx, t)
+	claims, err := VerifyToken(ctx, t.AccessToken)
 	if err != nil {
+		log.Printf("failed to verify token: %+v", err)
 		return nil, err
 	}
 
+	scopes := grantedScopes(requested, claims.Scopes)
+
 	user := &db.User{
-		CharacterID:   charID,
-		OwnerHash:     owner,
-		RefreshToken:  t.RefreshToken,
-		AccessToken:   t.AccessToken,
-		AccessExpires: t.Expiry,
+		CharacterID:     claims.CharacterID,
+		OwnerHash:       claims.Owner,
+		RefreshToken:    t.RefreshToken,
+		AccessToken:     t.AccessToken,
+		AccessExpires:   t.Expiry,
+		Scopes:          pq.StringArray(scopes),
+		CorporationMode: inStrings(CorporationWalletScope, scopes),
 	}
 
 	return user, nil
 }
 
-// getOwnerFromJWT parses the JWT for the character ID and owner hash
-func getOwnerFromJWT(ctx context.Context, t *oauth2.Token) (
-	charID int32,
-	owner string,
-	err error,
-) {
-	// HACK: remove once ccpgames/sso-issues#41 is done
-	return VerifyTokenHack(ctx, t.AccessToken)
-
-	verifier := ctx.Value(cx.Verifier).(*oidc.IDTokenVerifier)
-
-	idToken, err := verifier.Verify(ctx, t.AccessToken)
-	if err != nil {
-		log.Printf("failed to verify token: %+v", err)
-		return charID, owner, err
-	}
-
-	// Extract custom claims
-	var claims struct {
-		Scopes    []string `json:"scp"`
-		Subject   string   `json:"sub"`
-		OwnerHash string   `json:"owner"`
-	}
-	// TODO: verify scopes
-	if claimErr := idToken.Claims(&claims); claimErr != nil {
-		log.Printf("failed to parse claims from JWT: %+v", claimErr)
-		return charID, owner, err
-	}
-
-	char, err := parseCharacterID(claims.Subject)
-	if err != nil {
-		log.Printf("failed to parse characterID from claim data: %+v", err)
-		return char, owner, err
-	}
-
-	return char, claims.OwnerHash, nil
-}
-
 func parseCharacterID(sub string) (int32, error) {
 	subSplit := strings.Split(sub, ":")
 	if len(subSplit) != 3 {
@@ -232,39 +222,3 @@ func parseCharacterID(sub string) (int32, error) {
 	charID, err := strconv.ParseInt(subSplit[2], 10, 32)
 	return int32(charID), err
 }
-
-// VerifyModel is needed as a hack until an sso issue is fixed
-type VerifyModel struct {
-	CharacterID        int32
-	CharacterOwnerHash string
-}
-
-// VerifyTokenHack pulls the charID and owner hash from the JWT
-func VerifyTokenHack(ctx context.Context, token string) (
-	charID int32,
-	owner string,
-	err error,
-) {
-	client := ctx.Value(cx.SSOClient).(*http.Client)
-	res, err := client.Get(
-		fmt.Sprintf("https://esi.evetech.net/verify/?token=%s", token),
-	)
-	if err != nil {
-		log.Printf("failed to verify token (HACK): %+v", err)
-		return 0, "", err
-	}
-
-	model := &VerifyModel{}
-	dec := json.NewDecoder(res.Body)
-
-	if err := dec.Decode(model); err != nil {
-		log.Printf("failed to JSON decode verify response: %+v", err)
-		return 0, "", err
-	}
-
-	if err := res.Body.Close(); err != nil {
-		log.Printf("failed to close response body: %+v", err)
-	}
-
-	return model.CharacterID, model.CharacterOwnerHash, nil
-}
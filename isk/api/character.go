@@ -27,7 +27,7 @@ func CharacterDetails(ctx context.Context) http.HandlerFunc {
 
 		p, err := db.GetPreferences(ctx, "d", charID)
 		if err == nil {
-			if pErr := checkPassphrase(r, c, p); pErr != nil {
+			if pErr := checkPassphrase(r, c.Character, p); pErr != nil {
 				write403(w)
 				return
 			}
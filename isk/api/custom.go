@@ -39,7 +39,7 @@ func Custom(ctx context.Context) http.HandlerFunc {
 			return
 		}
 
-		if pErr := checkPassphrase(r, c, p); pErr != nil {
+		if pErr := checkPassphrase(r, c.Character, p); pErr != nil {
 			write403(w)
 			return
 		}
@@ -60,16 +60,18 @@ func Custom(ctx context.Context) http.HandlerFunc {
 
 func checkPassphrase(
 	r *http.Request,
-	c *db.CharDetails,
+	c *db.Character,
 	p *db.Preferences,
 ) error {
-	if !c.Character.GoodStanding {
+	if !c.GoodStanding {
 		return nil
 	}
 
 	var passphrase string
 	if p.Donations != nil {
 		passphrase = p.Donations.Passphrase
+	} else if p.Top != nil {
+		passphrase = p.Top.Passphrase
 	} else {
 		passphrase = p.Contracts.Passphrase
 	}
@@ -96,6 +98,8 @@ func writeTemplates(
 	var rowErr error
 	if p.Contracts != nil && p.Donations != nil {
 		rowErr = writeRowsMultiple(ctx, w, rows, c, p)
+	} else if p.Top != nil {
+		rowErr = writeRowsTop(ctx, w, rows, c, p.Top)
 	} else if p.Contracts != nil {
 		rowErr = writeRowsSingular(ctx, w, rows, c, p.Contracts, "c")
 	} else {
@@ -118,6 +122,9 @@ func writeHeader(
 		// donation or combined view
 		return t.ExecuteTemplate(w, "T", p.Donations.Header)
 	}
+	if p.Top != nil {
+		return t.ExecuteTemplate(w, "T", p.Top.Header)
+	}
 	return t.ExecuteTemplate(w, "T", p.Contracts.Header)
 }
 
@@ -130,6 +137,9 @@ func writeFooter(
 		// donation or combined view
 		return t.ExecuteTemplate(w, "T", p.Donations.Footer)
 	}
+	if p.Top != nil {
+		return t.ExecuteTemplate(w, "T", p.Top.Footer)
+	}
 	return t.ExecuteTemplate(w, "T", p.Contracts.Footer)
 }
 
@@ -170,6 +180,50 @@ func writeRowsMultiple(
 	return nil
 }
 
+// writeRowsTop writes a row for each of the character's top donors
+func writeRowsTop(
+	ctx context.Context,
+	w http.ResponseWriter,
+	rows *template.Template,
+	c *db.CharDetails,
+	p *db.Prefs,
+) error {
+	donors, err := db.GetTopDonors(
+		ctx,
+		c.Character.ID,
+		*p.Window,
+		p.Minimum,
+		p.Rows,
+	)
+	if err != nil {
+		return err
+	}
+
+	for i, donor := range donors {
+		if err := rows.ExecuteTemplate(w, "T", getTopRow(c, p, i+1, donor)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func getTopRow(c *db.CharDetails, p *db.Prefs, rank int, d *db.TopDonor) string {
+	replacements := stdReplacements(d.TotalISK, d.Last)
+	replacements["%NAME%"] = c.Character.Name
+	replacements["%CHARACTER%"] = d.Name
+	if d.Name == "" {
+		replacements["%CHARACTER%"] = fmt.Sprintf("%d", d.ID)
+	}
+	replacements["%RANK%"] = fmt.Sprintf("%d", rank)
+	replacements["%GIFTS%"] = fmt.Sprintf("%d", d.Gifts)
+
+	pattern := p.Pattern
+	for search, replace := range replacements {
+		pattern = strings.Replace(pattern, search, replace, -1)
+	}
+	return pattern
+}
+
 type rowPatterns []*rowPattern
 
 func (r rowPatterns) Len() int           { return len(r) }
@@ -321,15 +375,16 @@ func getDonationRow(
 	p *db.Prefs,
 	d *db.Donation,
 ) (string, error) {
-	donator, err := db.GetName(ctx, d.Donator)
-	if err != nil {
-		return "", err
+	donator, ok := c.NameAt(d.Donator, d.Timestamp)
+	if !ok {
+		return "", fmt.Errorf("no name known for %d", d.Donator)
 	}
 
 	replacements := stdReplacements(d.Amount, d.Timestamp)
 	replacements["%NAME%"] = c.Character.Name
 	replacements["%CHARACTER%"] = donator
 	replacements["%NOTE%"] = d.Note
+	replacements["%REFTYPE%"] = d.RefType
 
 	pattern := p.Pattern
 	for search, replace := range replacements {
@@ -363,9 +418,9 @@ func getContractRow(
 	p *db.Prefs,
 	k *db.Contract,
 ) (string, error) {
-	contractor, err := db.GetName(ctx, k.Donator)
-	if err != nil {
-		return "", err
+	contractor, ok := c.NameAt(k.Donator, k.Issued)
+	if !ok {
+		return "", fmt.Errorf("no name known for %d", k.Donator)
 	}
 
 	replacements := stdReplacements(k.Value, k.Issued)
@@ -373,6 +428,10 @@ func getContractRow(
 	replacements["%CHARACTER%"] = contractor
 	replacements["%NOTE%"] = k.Note
 	replacements["%ITEMS%"] = fmt.Sprintf("%d", len(k.Items))
+	replacements["%LOCATION%"] = getLocationName(k)
+	replacements["%SYSTEM%"] = k.SystemName
+	replacements["%ITEMLIST%"] = getItemList(k.Items)
+	replacements["%TOPITEM%"] = getTopItem(k.Items)
 
 	pattern := p.Pattern
 	for search, replace := range replacements {
@@ -382,6 +441,58 @@ func getContractRow(
 	return pattern, nil
 }
 
+// getItemList describes the items, e.g. "3x Tritanium, 1x Rifter"
+func getItemList(items []*db.Item) string {
+	names := []string{}
+	quantities := map[string]int32{}
+	for _, item := range items {
+		name := getItemName(item)
+		if _, ok := quantities[name]; !ok {
+			names = append(names, name)
+		}
+		quantities[name] += item.Quantity
+	}
+
+	list := []string{}
+	for _, name := range names {
+		list = append(list, fmt.Sprintf("%dx %s", quantities[name], name))
+	}
+	return strings.Join(list, ", ")
+}
+
+// getTopItem returns the name of the most valuable item
+func getTopItem(items []*db.Item) string {
+	var top *db.Item
+	for _, item := range items {
+		if top == nil ||
+			item.Price*float64(item.Quantity) > top.Price*float64(top.Quantity) {
+			top = item
+		}
+	}
+	if top == nil {
+		return ""
+	}
+	return getItemName(top)
+}
+
+func getItemName(item *db.Item) string {
+	if item.Name != "" {
+		return item.Name
+	}
+	return fmt.Sprintf("Type %d", item.TypeID)
+}
+
+// getLocationName falls back to the solar system for unnamed structures
+func getLocationName(k *db.Contract) string {
+	if k.LocationName != "" {
+		return k.LocationName
+	}
+	if k.SystemName != "" {
+		return k.SystemName
+	}
+	return "Unknown Structure"
+}
+
 func buildTemplates(c *db.CharDetails) (
 	header, rows, footer *template.Template,
 	err error,
@@ -0,0 +1,336 @@
+package api
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+// exportPageRows is how many rows are read from the db at a time
+const exportPageRows = 1000
+
+// exporter writes history rows in an export format
+type exporter interface {
+	// header is written before any rows
+	header() error
+
+	// row writes a single history row
+	row(row *db.HistoryRow, outgoing bool) error
+
+	// flush writes anything buffered
+	flush() error
+}
+
+// exportFormat describes how to serve each export format
+type exportFormat struct {
+	contentType string
+	extension   string
+	new         func(w io.Writer, owner string) exporter
+}
+
+var exportFormats = map[string]*exportFormat{
+	"csv": {
+		contentType: "text/csv; charset=utf-8",
+		extension:   "csv",
+		new: func(w io.Writer, _ string) exporter {
+			return &csvExporter{w: csv.NewWriter(w)}
+		},
+	},
+	"ndjson": {
+		contentType: "application/x-ndjson",
+		extension:   "ndjson",
+		new: func(w io.Writer, _ string) exporter {
+			return &ndjsonExporter{e: json.NewEncoder(w)}
+		},
+	},
+	"ledger": {
+		contentType: "text/plain; charset=utf-8",
+		extension:   "journal",
+		new: func(w io.Writer, owner string) exporter {
+			return &ledgerExporter{w: w, owner: owner}
+		},
+	},
+}
+
+// Export streams the logged in user's history as a download
+func Export(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			write405(w)
+			return
+		}
+
+		charID, ok := sessionCharacter(w, r)
+		if !ok {
+			return
+		}
+
+		owner, err := getPrefsOwner(r.WithContext(ctx), charID)
+		if err != nil {
+			write403(w)
+			return
+		}
+
+		format, filters, err := parseExport(r.URL.Query(), owner)
+		if err != nil {
+			write400(w)
+			return
+		}
+
+		ownerName, err := db.GetName(ctx, owner)
+		if err != nil {
+			ownerName = fmt.Sprintf("%d", owner)
+		}
+
+		w.Header().Set("Content-Type", format.contentType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(
+			"attachment; filename=\"isk-%d.%s\"",
+			owner,
+			format.extension,
+		))
+
+		e := format.new(w, ownerName)
+		if err := writeExport(ctx, e, filters); err != nil {
+			// the response has already started, so all we can do is stop
+			log.Printf("failed to export history of %d: %+v", owner, err)
+		}
+	}
+}
+
+// parseExport reads the export format and filters from the query args.
+// There is a filter for each direction exported
+func parseExport(query url.Values, owner int32) (
+	*exportFormat,
+	[]*db.HistoryFilter,
+	error,
+) {
+	format, ok := exportFormats[query.Get("format")]
+	if !ok {
+		return nil, nil, errors.New("invalid export format")
+	}
+
+	since, err := parseHistoryTime(query.Get("from"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	until, err := parseHistoryTime(query.Get("to"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	directions := []bool{}
+	switch query.Get("direction") {
+	case "":
+		directions = append(directions, false, true)
+	case "in":
+		directions = append(directions, false)
+	case "out":
+		directions = append(directions, true)
+	default:
+		return nil, nil, errors.New("invalid direction")
+	}
+
+	filters := []*db.HistoryFilter{}
+	for _, outgoing := range directions {
+		filters = append(filters, &db.HistoryFilter{
+			CharacterID: owner,
+			Outgoing:    outgoing,
+			Since:       since,
+			Until:       until,
+			Limit:       exportPageRows,
+		})
+	}
+
+	return format, filters, nil
+}
+
+// writeExport pages through the history for each filter
+func writeExport(
+	ctx context.Context,
+	e exporter,
+	filters []*db.HistoryFilter,
+) error {
+	if err := e.header(); err != nil {
+		return err
+	}
+
+	for _, filter := range filters {
+		for {
+			history, err := db.GetHistory(ctx, filter)
+			if err != nil {
+				return err
+			}
+
+			for _, row := range history {
+				if err := e.row(row, filter.Outgoing); err != nil {
+					return err
+				}
+			}
+
+			if err := e.flush(); err != nil {
+				return err
+			}
+
+			if len(history) < filter.Limit {
+				break
+			}
+			filter.Cursor = history[len(history)-1].Cursor()
+		}
+	}
+
+	return nil
+}
+
+func direction(outgoing bool) string {
+	if outgoing {
+		return "out"
+	}
+	return "in"
+}
+
+type csvExporter struct {
+	w *csv.Writer
+}
+
+func (c *csvExporter) header() error {
+	return c.w.Write([]string{
+		"timestamp",
+		"direction",
+		"type",
+		"id",
+		"counterparty",
+		"counterparty_name",
+		"amount",
+		"accepted",
+		"note",
+	})
+}
+
+func (c *csvExporter) row(row *db.HistoryRow, outgoing bool) error {
+	return c.w.Write([]string{
+		row.Timestamp.UTC().Format(time.RFC3339),
+		direction(outgoing),
+		row.Type,
+		strconv.FormatInt(row.ID, 10),
+		strconv.FormatInt(int64(row.Counterparty(outgoing)), 10),
+		csvCell(row.Name),
+		strconv.FormatFloat(row.Amount, 'f', 2, 64),
+		strconv.FormatBool(row.Accepted),
+		csvCell(row.Note),
+	})
+}
+
+// csvCell escapes free text which spreadsheets would read as a formula
+func csvCell(cell string) string {
+	if cell != "" && strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return "'" + cell
+	}
+	return cell
+}
+
+func (c *csvExporter) flush() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+type ndjsonExporter struct {
+	e *json.Encoder
+}
+
+// ndjsonRow is a history row with the direction and counterparty included
+type ndjsonRow struct {
+	*db.HistoryRow
+	Direction    string `json:"direction"`
+	Counterparty int32  `json:"counterparty"`
+}
+
+func (n *ndjsonExporter) header() error { return nil }
+func (n *ndjsonExporter) flush() error  { return nil }
+
+func (n *ndjsonExporter) row(row *db.HistoryRow, outgoing bool) error {
+	return n.e.Encode(&ndjsonRow{
+		HistoryRow:   row,
+		Direction:    direction(outgoing),
+		Counterparty: row.Counterparty(outgoing),
+	})
+}
+
+// ledgerExporter writes a plain text, double entry journal which hledger
+// and ledger can read. Outstanding contracts haven't moved anything yet, so
+// they're left out
+type ledgerExporter struct {
+	w     io.Writer
+	owner string
+}
+
+func (l *ledgerExporter) header() error {
+	_, err := fmt.Fprintf(
+		l.w,
+		"; ESI ISK history of %s\n\ncommodity 1,000.00 ISK\n",
+		l.owner,
+	)
+	return err
+}
+
+func (l *ledgerExporter) flush() error { return nil }
+
+func (l *ledgerExporter) row(row *db.HistoryRow, outgoing bool) error {
+	if !row.Accepted {
+		return nil
+	}
+
+	counterparty := row.Name
+	if counterparty == "" {
+		counterparty = fmt.Sprintf("%d", row.Counterparty(outgoing))
+	}
+
+	kind := strings.ToUpper(row.Type[:1]) + row.Type[1:]
+	description := fmt.Sprintf("%s from %s", kind, counterparty)
+	from := fmt.Sprintf("income:%ss:%s", row.Type, ledgerAccount(counterparty))
+	to := fmt.Sprintf("assets:isk:%s", ledgerAccount(l.owner))
+	if outgoing {
+		description = fmt.Sprintf("%s to %s", kind, counterparty)
+		from = to
+		to = fmt.Sprintf("expenses:%ss:%s", row.Type, ledgerAccount(counterparty))
+	}
+
+	entry := fmt.Sprintf(
+		"\n%s * %s  ; %s:%d\n",
+		row.Timestamp.UTC().Format("2006-01-02"),
+		description,
+		row.Type,
+		row.ID,
+	)
+	if note := ledgerComment(row.Note); note != "" {
+		entry += fmt.Sprintf("    ; %s\n", note)
+	}
+	entry += fmt.Sprintf("    %s  %.2f ISK\n", to, row.Amount)
+	entry += fmt.Sprintf("    %s  %.2f ISK\n", from, -row.Amount)
+
+	_, err := io.WriteString(l.w, entry)
+	return err
+}
+
+// ledgerAccount makes a name safe to use in an account name, where colons
+// separate accounts and two spaces end the name
+func ledgerAccount(name string) string {
+	name = strings.Replace(name, ":", "_", -1)
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// ledgerComment keeps a note on a single comment line
+func ledgerComment(note string) string {
+	return strings.Join(strings.Fields(note), " ")
+}
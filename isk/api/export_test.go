@@ -0,0 +1,160 @@
+package api
+
+import (
+	"bytes"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+func exportRows() []*db.HistoryRow {
+	at := time.Date(2018, 12, 25, 22, 34, 50, 0, time.UTC)
+	return []*db.HistoryRow{
+		{
+			Type:      "donation",
+			ID:        16969206837,
+			Donator:   90000001,
+			Receiver:  2114454465,
+			Timestamp: at,
+			Amount:    10000000,
+			Note:      "Hello,\nworld",
+			Accepted:  true,
+			Name:      "Some: Pilot",
+		},
+		{
+			Type:      "contract",
+			ID:        142345235,
+			Donator:   90000001,
+			Receiver:  2114454465,
+			Timestamp: at,
+			Amount:    1234.5,
+			Accepted:  false,
+		},
+	}
+}
+
+func TestExportCSV(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := exportFormats["csv"].new(buf, "Recipient")
+
+	if err := e.header(); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range exportRows() {
+		if err := e.row(row, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := e.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "timestamp,direction,type,id,counterparty,counterparty_name,amount,accepted,note\n" +
+		"2018-12-25T22:34:50Z,in,donation,16969206837,90000001,Some: Pilot,10000000.00,true,\"Hello,\nworld\"\n" +
+		"2018-12-25T22:34:50Z,in,contract,142345235,90000001,,1234.50,false,\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected csv:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestCSVCell(t *testing.T) {
+	for cell, expected := range map[string]string{
+		"=HYPERLINK(\"x\")": "'=HYPERLINK(\"x\")",
+		"+1":                "'+1",
+		"-1":                "'-1",
+		"@SUM(A1)":          "'@SUM(A1)",
+		"\tcell":            "'\tcell",
+		"\rcell":            "'\rcell",
+		"Some Pilot":        "Some Pilot",
+		"a=b":               "a=b",
+		"":                  "",
+	} {
+		if escaped := csvCell(cell); escaped != expected {
+			t.Errorf("expected %q to escape to %q, got %q", cell, expected, escaped)
+		}
+	}
+}
+
+func TestExportNDJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := exportFormats["ndjson"].new(buf, "Recipient")
+
+	if err := e.row(exportRows()[1], true); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"type":"contract","id":142345235,"donator":90000001,` +
+		`"receiver":2114454465,"timestamp":"2018-12-25T22:34:50Z",` +
+		`"amount":1234.5,"accepted":false,"direction":"out",` +
+		`"counterparty":2114454465}` + "\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected ndjson:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestExportLedger(t *testing.T) {
+	buf := &bytes.Buffer{}
+	e := exportFormats["ledger"].new(buf, "Recipient")
+
+	rows := exportRows()
+	if err := e.row(rows[0], false); err != nil {
+		t.Fatal(err)
+	}
+	// unknown names fall back to the ID
+	unnamed := *rows[0]
+	unnamed.Name = ""
+	if err := e.row(&unnamed, true); err != nil {
+		t.Fatal(err)
+	}
+	// outstanding contracts are left out
+	if err := e.row(rows[1], false); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `
+2018-12-25 * Donation from Some: Pilot  ; donation:16969206837
+    ; Hello, world
+    assets:isk:Recipient  10000000.00 ISK
+    income:donations:Some_ Pilot  -10000000.00 ISK
+
+2018-12-25 * Donation to 2114454465  ; donation:16969206837
+    ; Hello, world
+    expenses:donations:2114454465  10000000.00 ISK
+    assets:isk:Recipient  -10000000.00 ISK
+`
+	if buf.String() != expected {
+		t.Errorf("unexpected ledger:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+}
+
+func TestParseExport(t *testing.T) {
+	format, filters, err := parseExport(url.Values{
+		"format": {"ledger"},
+		"from":   {"2018-12-01"},
+	}, 2114454465)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format.extension != "journal" || len(filters) != 2 {
+		t.Fatalf("unexpected format %+v or filters %+v", format, filters)
+	}
+	if filters[0].Outgoing || !filters[1].Outgoing {
+		t.Errorf("expected both directions")
+	}
+	if filters[0].CharacterID != 2114454465 || filters[0].Since == nil {
+		t.Errorf("unexpected filter: %+v", filters[0])
+	}
+
+	for _, invalid := range []url.Values{
+		{},
+		{"format": {"xml"}},
+		{"format": {"csv"}, "direction": {"up"}},
+		{"format": {"csv"}, "to": {"tomorrow"}},
+	} {
+		if _, _, err := parseExport(invalid, 2114454465); err == nil {
+			t.Errorf("expected %v to be invalid", invalid)
+		}
+	}
+}
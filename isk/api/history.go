@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+const (
+	// defaultHistoryRows is the page size when no limit is given
+	defaultHistoryRows = 50
+
+	// maxHistoryRows is the largest page size allowed
+	maxHistoryRows = 250
+
+	// maxHistoryNote is the longest note search allowed
+	maxHistoryNote = 100
+)
+
+// historyPage is the api return for a page of history
+type historyPage struct {
+	History []*db.HistoryRow `json:"history"`
+
+	// Next is the cursor for the following page, if there may be one
+	Next string `json:"next,omitempty"`
+}
+
+// History returns a page of a character's donations and contracts
+func History(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		filter, err := parseHistoryFilter(r.URL.Query())
+		if err != nil {
+			write400(w)
+			return
+		}
+
+		c, err := db.GetCharacter(ctx, filter.CharacterID)
+		if err != nil {
+			write400(w)
+			return
+		}
+
+		p, err := db.GetPreferences(ctx, "d", filter.CharacterID)
+		if err == nil {
+			if pErr := checkPassphrase(r, c, p); pErr != nil {
+				write403(w)
+				return
+			}
+		}
+
+		history, err := db.GetHistory(ctx, filter)
+		if err != nil {
+			log.Printf("failed to get character history: %+v", err)
+			write500(w)
+			return
+		}
+
+		page := &historyPage{History: history}
+		if len(history) == filter.Limit {
+			page.Next = history[len(history)-1].Cursor().String()
+		}
+
+		writeJSON(ctx, w, page)
+	}
+}
+
+// parseHistoryFilter reads the history query args
+func parseHistoryFilter(query url.Values) (*db.HistoryFilter, error) {
+	charID, err := strconv.ParseInt(query.Get("c"), 10, 32)
+	if err != nil || charID < 1 {
+		return nil, errors.New("invalid character ID")
+	}
+
+	filter := &db.HistoryFilter{
+		CharacterID: int32(charID),
+		Note:        query.Get("note"),
+		Limit:       defaultHistoryRows,
+	}
+
+	switch query.Get("direction") {
+	case "", "in":
+	case "out":
+		filter.Outgoing = true
+	default:
+		return nil, errors.New("invalid direction")
+	}
+
+	switch t := query.Get("type"); t {
+	case "", "donation", "contract":
+		filter.Type = t
+	default:
+		return nil, errors.New("invalid type")
+	}
+
+	if filter.Since, err = parseHistoryTime(query.Get("from")); err != nil {
+		return nil, err
+	}
+	if filter.Until, err = parseHistoryTime(query.Get("to")); err != nil {
+		return nil, err
+	}
+
+	if min := query.Get("min"); min != "" {
+		if filter.Minimum, err = strconv.ParseFloat(min, 64); err != nil {
+			return nil, err
+		}
+	}
+
+	if counterparty := query.Get("counterparty"); counterparty != "" {
+		id, err := strconv.ParseInt(counterparty, 10, 32)
+		if err != nil || id < 1 {
+			return nil, errors.New("invalid counterparty")
+		}
+		filter.Counterparty = int32(id)
+	}
+
+	if len(filter.Note) > maxHistoryNote {
+		return nil, errors.New("note search is too long")
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 || filter.Limit > maxHistoryRows {
+			return nil, errors.New("invalid limit")
+		}
+	}
+
+	if cursor := query.Get("cursor"); cursor != "" {
+		if filter.Cursor, err = db.ParseHistoryCursor(cursor); err != nil {
+			return nil, err
+		}
+	}
+
+	return filter, nil
+}
+
+// parseHistoryTime reads an RFC3339 timestamp or a date, if set
+func parseHistoryTime(s string) (*time.Time, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		if t, err = time.Parse("2006-01-02", s); err != nil {
+			return nil, err
+		}
+	}
+
+	t = t.UTC()
+	return &t, nil
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+func TestParseHistoryFilter(t *testing.T) {
+	cursor := &db.HistoryCursor{
+		Timestamp: time.Date(2018, 12, 25, 22, 34, 0, 123456000, time.UTC),
+		Type:      "contract",
+		ID:        142345235,
+	}
+
+	query := url.Values{
+		"c":            {"2114454465"},
+		"direction":    {"out"},
+		"type":         {"contract"},
+		"from":         {"2018-12-01"},
+		"to":           {"2018-12-31T12:00:00Z"},
+		"min":          {"1000000.5"},
+		"counterparty": {"90000001"},
+		"note":         {"thanks"},
+		"limit":        {"10"},
+		"cursor":       {cursor.String()},
+	}
+
+	filter, err := parseHistoryFilter(query)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch {
+	case filter.CharacterID != 2114454465:
+		t.Errorf("unexpected character ID: %d", filter.CharacterID)
+	case !filter.Outgoing || filter.Type != "contract":
+		t.Errorf("unexpected direction or type: %+v", filter)
+	case !filter.Since.Equal(time.Date(2018, 12, 1, 0, 0, 0, 0, time.UTC)):
+		t.Errorf("unexpected since: %s", filter.Since)
+	case !filter.Until.Equal(time.Date(2018, 12, 31, 12, 0, 0, 0, time.UTC)):
+		t.Errorf("unexpected until: %s", filter.Until)
+	case filter.Minimum != 1000000.5 || filter.Counterparty != 90000001:
+		t.Errorf("unexpected minimum or counterparty: %+v", filter)
+	case filter.Note != "thanks" || filter.Limit != 10:
+		t.Errorf("unexpected note or limit: %+v", filter)
+	case filter.Cursor == nil || *filter.Cursor != *cursor:
+		t.Errorf("cursor did not round trip: %+v", filter.Cursor)
+	}
+
+	filter, err = parseHistoryFilter(url.Values{"c": {"2114454465"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Outgoing || filter.Type != "" || filter.Since != nil ||
+		filter.Cursor != nil || filter.Limit != defaultHistoryRows {
+		t.Errorf("unexpected defaults: %+v", filter)
+	}
+
+	for _, invalid := range []url.Values{
+		{},
+		{"c": {"2114454465"}, "direction": {"sideways"}},
+		{"c": {"2114454465"}, "type": {"loan"}},
+		{"c": {"2114454465"}, "from": {"yesterday"}},
+		{"c": {"2114454465"}, "limit": {"100000"}},
+		{"c": {"2114454465"}, "counterparty": {"-1"}},
+		{"c": {"2114454465"}, "cursor": {"not a cursor"}},
+	} {
+		if _, err := parseHistoryFilter(invalid); err == nil {
+			t.Errorf("expected %v to be invalid", invalid)
+		}
+	}
+}
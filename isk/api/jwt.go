@@ -0,0 +1,157 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	oidc "github.com/coreos/go-oidc"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+const (
+	// jwksURL is where EVE SSO publishes its signing keys
+	jwksURL = "https://login.eveonline.com/oauth/jwks"
+
+	// ssoAudience is included in the audience of every EVE SSO v2 token
+	ssoAudience = "EVE Online"
+
+	// clockSkew is allowed when checking token expiry
+	clockSkew = 30 * time.Second
+)
+
+// ssoIssuers are the accepted iss claims, SSO has used both forms
+var ssoIssuers = []string{
+	"login.eveonline.com",
+	"https://login.eveonline.com",
+}
+
+// Claims are the parsed and verified claims of an SSO access token
+type Claims struct {
+	CharacterID int32
+	Owner       string
+	Scopes      []string
+	Expires     time.Time
+}
+
+// Verifier verifies EVE SSO v2 JWT access tokens against the SSO's JWKS
+type Verifier struct {
+	keys     oidc.KeySet
+	clientID string
+
+	// now is replaceable for tests
+	now func() time.Time
+}
+
+type jwtClaims struct {
+	Issuer   string     `json:"iss"`
+	Audience stringList `json:"aud"`
+	Subject  string     `json:"sub"`
+	Owner    string     `json:"owner"`
+	Scopes   stringList `json:"scp"`
+	Expires  int64      `json:"exp"`
+}
+
+// stringList is a JSON string or array of strings
+type stringList []string
+
+// UnmarshalJSON accepts either a single string or an array of them
+func (s *stringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*s = []string{single}
+		return nil
+	}
+
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*s = list
+	return nil
+}
+
+// NewVerifier returns a Verifier using the SSO's published signing keys.
+// The keys are fetched with their own client, outside the ESI transport
+func NewVerifier(ctx context.Context) *Verifier {
+	opts := ctx.Value(cx.Opts).(*cx.Options)
+
+	clientID := ""
+	if opts.Auth != nil {
+		clientID = opts.Auth.ClientID
+	}
+
+	return newVerifier(&http.Client{Timeout: 10 * time.Second}, jwksURL, clientID)
+}
+
+func newVerifier(client *http.Client, url, clientID string) *Verifier {
+	ctx := oidc.ClientContext(context.Background(), client)
+	return &Verifier{
+		keys:     oidc.NewRemoteKeySet(ctx, url),
+		clientID: clientID,
+		now:      func() time.Time { return time.Now().UTC() },
+	}
+}
+
+// VerifyToken verifies the access token with the Verifier in context
+func VerifyToken(ctx context.Context, token string) (*Claims, error) {
+	return ctx.Value(cx.Verifier).(*Verifier).Verify(ctx, token)
+}
+
+// Verify checks the token's signature, issuer, audience and expiry. Unknown
+// signing keys are refreshed from the JWKS by the key set
+func (v *Verifier) Verify(ctx context.Context, token string) (*Claims, error) {
+	payload, err := v.keys.VerifySignature(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := &jwtClaims{}
+	if err := json.Unmarshal(payload, claims); err != nil {
+		return nil, err
+	}
+
+	return v.checkClaims(claims)
+}
+
+// checkClaims validates the claims of a token with a valid signature
+func (v *Verifier) checkClaims(claims *jwtClaims) (*Claims, error) {
+	if !inStrings(claims.Issuer, ssoIssuers) {
+		return nil, fmt.Errorf("invalid token issuer: %s", claims.Issuer)
+	}
+
+	if !inStrings(ssoAudience, claims.Audience) ||
+		(v.clientID != "" && !inStrings(v.clientID, claims.Audience)) {
+		return nil, errors.New("invalid token audience")
+	}
+
+	expires := time.Unix(claims.Expires, 0).UTC()
+	if v.now().After(expires.Add(clockSkew)) {
+		return nil, errors.New("token has expired")
+	}
+
+	charID, err := parseCharacterID(claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Claims{
+		CharacterID: charID,
+		Owner:       claims.Owner,
+		Scopes:      claims.Scopes,
+		Expires:     expires,
+	}, nil
+}
+
+func inStrings(s string, l []string) bool {
+	for _, i := range l {
+		if i == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,261 @@
+package api
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2018, 12, 25, 22, 34, 0, 0, time.UTC)
+
+// testSSO serves a JWKS with an RSA and an EC key
+type testSSO struct {
+	rsaKey *rsa.PrivateKey
+	rsaKID string
+	ecKey  *ecdsa.PrivateKey
+	server *httptest.Server
+	hits   int32
+}
+
+func newTestSSO(t *testing.T) *testSSO {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sso := &testSSO{rsaKey: rsaKey, rsaKID: "JWT-Signature-Key", ecKey: ecKey}
+	sso.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&sso.hits, 1)
+			enc := base64.RawURLEncoding
+			set := map[string][]map[string]string{"keys": {
+				{
+					"kid": sso.rsaKID,
+					"kty": "RSA",
+					"alg": "RS256",
+					"n":   enc.EncodeToString(sso.rsaKey.N.Bytes()),
+					"e":   enc.EncodeToString(big.NewInt(int64(sso.rsaKey.E)).Bytes()),
+				},
+				{
+					"kid": "JWT-Signature-Key-EC",
+					"kty": "EC",
+					"alg": "ES256",
+					"crv": "P-256",
+					"x":   enc.EncodeToString(sso.ecKey.X.Bytes()),
+					"y":   enc.EncodeToString(sso.ecKey.Y.Bytes()),
+				},
+			}}
+			// without caching headers, unknown keys are always re-fetched
+			if err := json.NewEncoder(w).Encode(set); err != nil {
+				t.Error(err)
+			}
+		},
+	))
+	return sso
+}
+
+func (s *testSSO) verifier() *Verifier {
+	v := newVerifier(s.server.Client(), s.server.URL, "my-client")
+	v.now = func() time.Time { return testNow }
+	return v
+}
+
+func testClaims() map[string]interface{} {
+	return map[string]interface{}{
+		"iss":   "login.eveonline.com",
+		"aud":   []string{"my-client", "EVE Online"},
+		"sub":   "CHARACTER:EVE:2114454465",
+		"owner": "owner-hash",
+		"scp":   []string{"esi-wallet.read_character_wallet.v1"},
+		"exp":   testNow.Add(20 * time.Minute).Unix(),
+	}
+}
+
+// sign returns a JWT signed with the RSA or EC key
+func (s *testSSO) sign(t *testing.T, alg string, claims interface{}) string {
+	enc := base64.RawURLEncoding
+
+	kid := s.rsaKID
+	if alg == "ES256" {
+		kid = "JWT-Signature-Key-EC"
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := enc.EncodeToString(header) + "." + enc.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	if alg == "ES256" {
+		r, s, err := ecdsa.Sign(rand.Reader, s.ecKey, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		copy(signature[32-len(r.Bytes()):32], r.Bytes())
+		copy(signature[64-len(s.Bytes()):], s.Bytes())
+	} else {
+		signature, err = rsa.SignPKCS1v15(rand.Reader, s.rsaKey, crypto.SHA256, hash[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return signed + "." + enc.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	sso := newTestSSO(t)
+	defer sso.server.Close()
+	v := sso.verifier()
+
+	for _, alg := range []string{"RS256", "ES256"} {
+		claims, err := v.Verify(ctx, sso.sign(t, alg, testClaims()))
+		if err != nil {
+			t.Fatalf("failed to verify %s token: %+v", alg, err)
+		}
+
+		if claims.CharacterID != 2114454465 {
+			t.Errorf("invalid character. received %d, expected %d",
+				claims.CharacterID, 2114454465)
+		}
+		if claims.Owner != "owner-hash" {
+			t.Errorf("invalid owner. received %q, expected %q",
+				claims.Owner, "owner-hash")
+		}
+		if len(claims.Scopes) != 1 {
+			t.Errorf("invalid scopes. received %v", claims.Scopes)
+		}
+	}
+
+	// the keys are only fetched once
+	if sso.hits != 1 {
+		t.Errorf("invalid JWKS requests. received %d, expected %d", sso.hits, 1)
+	}
+}
+
+func TestVerifySingleScope(t *testing.T) {
+	ctx := context.Background()
+	sso := newTestSSO(t)
+	defer sso.server.Close()
+
+	c := testClaims()
+	c["scp"] = "esi-wallet.read_character_wallet.v1"
+
+	claims, err := sso.verifier().Verify(ctx, sso.sign(t, "RS256", c))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(claims.Scopes) != 1 {
+		t.Errorf("invalid scopes. received %v", claims.Scopes)
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	ctx := context.Background()
+	sso := newTestSSO(t)
+	defer sso.server.Close()
+	v := sso.verifier()
+
+	tests := map[string]func(map[string]interface{}){
+		"issuer":   func(c map[string]interface{}) { c["iss"] = "evil.example.com" },
+		"audience": func(c map[string]interface{}) { c["aud"] = "EVE Online" },
+		"expired": func(c map[string]interface{}) {
+			c["exp"] = testNow.Add(-time.Hour).Unix()
+		},
+		"subject": func(c map[string]interface{}) { c["sub"] = "2114454465" },
+	}
+
+	for name, modify := range tests {
+		c := testClaims()
+		modify(c)
+		if _, err := v.Verify(ctx, sso.sign(t, "RS256", c)); err == nil {
+			t.Errorf("expected an error for invalid %s", name)
+		}
+	}
+}
+
+func TestVerifyBadSignature(t *testing.T) {
+	ctx := context.Background()
+	sso := newTestSSO(t)
+	defer sso.server.Close()
+
+	other := newTestSSO(t)
+	defer other.server.Close()
+
+	// signed by a key the verifier doesn't know about
+	token := other.sign(t, "RS256", testClaims())
+	if _, err := sso.verifier().Verify(ctx, token); err == nil {
+		t.Error("expected an error for a bad signature")
+	}
+}
+
+func TestVerifyAlgorithmMismatch(t *testing.T) {
+	ctx := context.Background()
+	sso := newTestSSO(t)
+	defer sso.server.Close()
+
+	// an HS256 header on the RSA key must not be accepted
+	token := sso.sign(t, "RS256", testClaims())
+	header := base64.RawURLEncoding.EncodeToString(
+		[]byte(`{"alg":"HS256","kid":"JWT-Signature-Key"}`),
+	)
+	for i := range token {
+		if token[i] == '.' {
+			token = header + token[i:]
+			break
+		}
+	}
+
+	if _, err := sso.verifier().Verify(ctx, token); err == nil {
+		t.Error("expected an error for a mismatched algorithm")
+	}
+}
+
+func TestVerifyRefreshesUnknownKeys(t *testing.T) {
+	sso := newTestSSO(t)
+	defer sso.server.Close()
+	v := sso.verifier()
+
+	ctx := context.Background()
+	if _, err := v.Verify(ctx, sso.sign(t, "RS256", testClaims())); err != nil {
+		t.Fatal(err)
+	}
+
+	// rotated keys are picked up from the JWKS
+	sso.rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	sso.rsaKID = "JWT-Signature-Key-2"
+	if _, err := v.Verify(ctx, sso.sign(t, "RS256", testClaims())); err != nil {
+		t.Errorf("failed to verify with the refreshed keys: %+v", err)
+	}
+	if sso.hits != 2 {
+		t.Errorf("invalid JWKS requests. received %d, expected %d", sso.hits, 2)
+	}
+}
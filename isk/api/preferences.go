@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"sort"
+	"strconv"
 
 	"github.com/a-tal/esi-isk/isk/cx"
 	"github.com/a-tal/esi-isk/isk/db"
@@ -25,42 +26,105 @@ func Preferences(ctx context.Context) http.HandlerFunc {
 			return
 		}
 
-		session := sessions.GetSession(r)
-		char := session.Get("c")
-		if char == nil {
-			if r.Method == http.MethodGet {
-				http.Redirect(w, r, "/login", 302)
-			} else {
-				write403(w)
-			}
+		charID, ok := sessionCharacter(w, r)
+		if !ok {
 			return
 		}
 
-		charID, ok := char.(int32)
-		if !ok || charID < 1 {
+		owner, err := getPrefsOwner(r.WithContext(ctx), charID)
+		if err != nil {
 			write403(w)
 			return
 		}
 
 		if r.Method == http.MethodPost {
-			updatePreferences(w, r.WithContext(ctx), charID)
+			updatePreferences(w, r.WithContext(ctx), owner)
 		} else {
-			writePreferences(w, r.WithContext(ctx), charID)
+			writePreferences(w, r.WithContext(ctx), owner, charID)
 		}
 	}
 }
 
-func writePreferences(w http.ResponseWriter, r *http.Request, charID int32) {
-	p, err := getPreferences(w, r, charID)
+// sessionCharacter returns the logged in character ID or writes an error
+func sessionCharacter(w http.ResponseWriter, r *http.Request) (int32, bool) {
+	session := sessions.GetSession(r)
+	char := session.Get("c")
+	if char == nil {
+		if r.Method == http.MethodGet {
+			http.Redirect(w, r, "/login", 302)
+		} else {
+			write403(w)
+		}
+		return 0, false
+	}
+
+	charID, ok := char.(int32)
+	if !ok || charID < 1 {
+		write403(w)
+		return 0, false
+	}
+
+	return charID, true
+}
+
+// getPrefsOwner returns whose preferences to use. the "o" query arg can be
+// set to the corporation ID when the logged in user tracks their corp wallet
+func getPrefsOwner(r *http.Request, charID int32) (int32, error) {
+	owner := r.URL.Query().Get("o")
+	if owner == "" {
+		return charID, nil
+	}
+
+	ownerID, err := strconv.ParseInt(owner, 10, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	if int32(ownerID) == charID {
+		return charID, nil
+	}
+
+	corpID, err := db.GetUserCorporation(r.Context(), charID)
+	if err != nil {
+		return 0, err
+	}
+
+	if corpID != int32(ownerID) {
+		return 0, errors.New("not tracking the requested corporation")
+	}
+
+	return corpID, nil
+}
+
+// writePreferences writes the owner's preferences, along with the state of
+// the logged in character's token
+func writePreferences(
+	w http.ResponseWriter,
+	r *http.Request,
+	owner int32,
+	charID int32,
+) {
+	p, err := getPreferences(w, r, owner)
 	if err != nil {
 		return
 	}
 
+	token, err := db.GetTokenStatus(r.Context(), charID)
+	if err != nil {
+		log.Printf("failed to get token status: %+v", err)
+	}
+
 	if p.Contracts != nil && p.Donations != nil {
+		p.Token = token
 		writeJSON(r.Context(), w, p)
+	} else if p.Top != nil {
+		p.Top.Token = token
+		writeJSON(r.Context(), w, p.Top)
 	} else if p.Contracts != nil {
+		p.Contracts.Token = token
 		writeJSON(r.Context(), w, p.Contracts)
 	} else {
+		p.Donations.Token = token
 		writeJSON(r.Context(), w, p.Donations)
 	}
 }
@@ -101,6 +165,8 @@ func dropCustomAPICache(
 	var passphrase string
 	if t == "c" {
 		passphrase = p.Contracts.Passphrase
+	} else if t == "t" {
+		passphrase = p.Top.Passphrase
 	} else {
 		passphrase = p.Donations.Passphrase
 	}
@@ -141,7 +207,7 @@ func getPrefType(r *http.Request) (string, error) {
 	t := r.URL.Query().Get("t")
 	if t == "" {
 		t = "d"
-	} else if t != "d" && t != "c" && t != "a" {
+	} else if t != "d" && t != "c" && t != "a" && t != "t" {
 		return "", errors.New("invalid preference type")
 	}
 	return t, nil
@@ -157,8 +223,11 @@ func readPreferences(r *http.Request, t string) (*db.Preferences, error) {
 		return nil, err
 	}
 
-	if t == "d" {
+	switch t {
+	case "d":
 		return &db.Preferences{Donations: p}, nil
+	case "t":
+		return &db.Preferences{Top: p}, nil
 	}
 	return &db.Preferences{Contracts: p}, nil
 }
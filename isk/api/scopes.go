@@ -0,0 +1,63 @@
+package api
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	// WalletScope is needed to track character wallet donations
+	WalletScope = "esi-wallet.read_character_wallet.v1"
+
+	// ContractsScope is needed to track zero ISK contracts
+	ContractsScope = "esi-contracts.read_character_contracts.v1"
+
+	// StructuresScope is needed to name the structures contracts are made in
+	StructuresScope = "esi-universe.read_structures.v1"
+
+	// CorporationWalletScope is needed to track corporation wallet donations
+	CorporationWalletScope = "esi-wallet.read_corporation_wallets.v1"
+)
+
+// trackerScopes are the scopes requested for each thing a user can track
+var trackerScopes = map[string][]string{
+	"wallet":    {WalletScope},
+	"contracts": {ContractsScope, StructuresScope},
+	"corp":      {CorporationWalletScope},
+}
+
+// defaultTrackers are used when the user doesn't pick any
+var defaultTrackers = []string{"wallet", "contracts"}
+
+// requestedScopes returns the scopes for the comma separated trackers
+func requestedScopes(track string) ([]string, error) {
+	trackers := defaultTrackers
+	if track != "" {
+		trackers = strings.Split(track, ",")
+	}
+
+	scopes := []string{}
+	for _, tracker := range trackers {
+		trackerScope, ok := trackerScopes[tracker]
+		if !ok {
+			return nil, errors.New("unknown tracker: " + tracker)
+		}
+		for _, scope := range trackerScope {
+			if !inStrings(scope, scopes) {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return scopes, nil
+}
+
+// grantedScopes returns the requested scopes that were granted
+func grantedScopes(requested, granted []string) []string {
+	scopes := []string{}
+	for _, scope := range requested {
+		if inStrings(scope, granted) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
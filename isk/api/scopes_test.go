@@ -0,0 +1,47 @@
+package api
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRequestedScopes(t *testing.T) {
+	tests := []struct {
+		track    string
+		expected []string
+	}{
+		{"", []string{WalletScope, ContractsScope, StructuresScope}},
+		{"contracts", []string{ContractsScope, StructuresScope}},
+		{"wallet,corp,wallet", []string{WalletScope, CorporationWalletScope}},
+	}
+
+	for _, test := range tests {
+		scopes, err := requestedScopes(test.track)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(scopes, test.expected) {
+			t.Errorf(
+				"invalid scopes for %q. received %v, expected %v",
+				test.track,
+				scopes,
+				test.expected,
+			)
+		}
+	}
+
+	if _, err := requestedScopes("wallet,everything"); err == nil {
+		t.Error("expected an error for an unknown tracker")
+	}
+}
+
+func TestGrantedScopes(t *testing.T) {
+	scopes := grantedScopes(
+		[]string{WalletScope, ContractsScope},
+		[]string{ContractsScope, "publicData"},
+	)
+
+	if !reflect.DeepEqual(scopes, []string{ContractsScope}) {
+		t.Errorf("invalid scopes. received %v, expected %v", scopes, ContractsScope)
+	}
+}
@@ -2,14 +2,24 @@ package api
 
 import (
 	"context"
+	"errors"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/a-tal/esi-isk/isk/db"
 )
 
-// TopRecipients returns JSON describing the current top donation recipients
+// TopRecipients returns JSON describing the current top donation recipients,
+// or the top corporations or alliances if grouped
 func TopRecipients(ctx context.Context) http.HandlerFunc {
-	return func(w http.ResponseWriter, _req *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("group") != "" {
+			topGroups(ctx, w, r)
+			return
+		}
+
 		recipients, err := db.GetTopRecipients(ctx)
 		if err != nil {
 			write500(w)
@@ -30,3 +40,165 @@ func TopRecipients(ctx context.Context) http.HandlerFunc {
 		writeJSON(ctx, w, res)
 	}
 }
+
+// topGroups writes the corporations or alliances which received and
+// donated the most
+func topGroups(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	filter, window, err := parseTopGroups(r.URL.Query())
+	if err != nil {
+		write400(w)
+		return
+	}
+
+	recipients, err := db.GetTopGroups(ctx, filter)
+	if err != nil {
+		log.Printf("failed to get top %s recipients: %+v", filter.Group, err)
+		write500(w)
+		return
+	}
+
+	donated := *filter
+	donated.Donated = true
+	donators, err := db.GetTopGroups(ctx, &donated)
+	if err != nil {
+		log.Printf("failed to get top %s donators: %+v", filter.Group, err)
+		write500(w)
+		return
+	}
+
+	writeJSON(ctx, w, map[string]interface{}{
+		"group":      filter.Group,
+		"window":     window,
+		"recipients": recipients,
+		"donators":   donators,
+	})
+}
+
+const (
+	// defaultTopDonors is how many top donors or groups are returned by default
+	defaultTopDonors = 10
+
+	// maxTopDonors is the most top donors or groups which can be requested
+	maxTopDonors = 100
+)
+
+// topWindows are the allowed windows of top donors and groups, in days
+var topWindows = map[string]int{"7": 7, "30": 30, "all": 0}
+
+// TopDonors returns JSON describing who gave the character the most
+func TopDonors(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		charID, window, limit, err := parseTopDonors(r.URL.Query())
+		if err != nil {
+			write400(w)
+			return
+		}
+
+		c, err := db.GetCharacter(ctx, charID)
+		if err != nil {
+			write400(w)
+			return
+		}
+
+		p, err := db.GetPreferences(ctx, "d", charID)
+		if err == nil {
+			if pErr := checkPassphrase(r, c, p); pErr != nil {
+				write403(w)
+				return
+			}
+		}
+
+		donors, err := db.GetTopDonors(ctx, charID, topWindows[window], 0, limit)
+		if err != nil {
+			log.Printf("failed to get top donors: %+v", err)
+			write500(w)
+			return
+		}
+
+		writeJSON(ctx, w, map[string]interface{}{
+			"window": window,
+			"donors": donors,
+		})
+	}
+}
+
+// parseTopDonors reads the character ID, window and limit query args
+func parseTopDonors(query url.Values) (int32, string, int, error) {
+	charID, err := strconv.ParseInt(query.Get("c"), 10, 32)
+	if err != nil || charID < 1 {
+		return 0, "", 0, errors.New("invalid character ID")
+	}
+
+	window, err := parseTopWindow(query)
+	if err != nil {
+		return 0, "", 0, err
+	}
+
+	limit, err := parseTopLimit(query)
+	if err != nil {
+		return 0, "", 0, err
+	}
+
+	return int32(charID), window, limit, nil
+}
+
+// parseTopGroups reads the leaderboard query args, returning a filter with
+// the group, days, alliance and limit set
+func parseTopGroups(query url.Values) (*db.TopGroupFilter, string, error) {
+	group := query.Get("group")
+	if group != "corporation" && group != "alliance" {
+		return nil, "", errors.New("invalid group")
+	}
+
+	window, err := parseTopWindow(query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	limit, err := parseTopLimit(query)
+	if err != nil {
+		return nil, "", err
+	}
+
+	filter := &db.TopGroupFilter{
+		Group: group,
+		Days:  topWindows[window],
+		Limit: limit,
+	}
+
+	if alliance := query.Get("alliance"); alliance != "" {
+		id, err := strconv.ParseInt(alliance, 10, 32)
+		if err != nil || id < 1 || group != "corporation" {
+			return nil, "", errors.New("invalid alliance")
+		}
+		filter.AllianceID = int32(id)
+	}
+
+	return filter, window, nil
+}
+
+// parseTopWindow reads the window query arg, defaulting to 30 days
+func parseTopWindow(query url.Values) (string, error) {
+	window := query.Get("window")
+	if window == "" {
+		window = "30"
+	}
+	if _, ok := topWindows[window]; !ok {
+		return "", errors.New("invalid window")
+	}
+	return window, nil
+}
+
+// parseTopLimit reads the limit query arg
+func parseTopLimit(query url.Values) (int, error) {
+	raw := query.Get("limit")
+	if raw == "" {
+		return defaultTopDonors, nil
+	}
+
+	limit, err := strconv.Atoi(raw)
+	if err != nil || limit < 1 || limit > maxTopDonors {
+		return 0, errors.New("invalid limit")
+	}
+	return limit, nil
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+func TestParseTopDonors(t *testing.T) {
+	charID, window, limit, err := parseTopDonors(url.Values{"c": {"2114454465"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if charID != 2114454465 || window != "30" || limit != defaultTopDonors {
+		t.Errorf("unexpected defaults: %d %s %d", charID, window, limit)
+	}
+
+	_, window, limit, err = parseTopDonors(url.Values{
+		"c":      {"2114454465"},
+		"window": {"all"},
+		"limit":  {"25"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if window != "all" || topWindows[window] != 0 || limit != 25 {
+		t.Errorf("unexpected window or limit: %s %d", window, limit)
+	}
+
+	for _, invalid := range []url.Values{
+		{},
+		{"c": {"0"}},
+		{"c": {"2114454465"}, "window": {"14"}},
+		{"c": {"2114454465"}, "limit": {"0"}},
+		{"c": {"2114454465"}, "limit": {"101"}},
+	} {
+		if _, _, _, err := parseTopDonors(invalid); err == nil {
+			t.Errorf("expected %v to be invalid", invalid)
+		}
+	}
+}
+
+func TestGetTopRow(t *testing.T) {
+	c := &db.CharDetails{Character: &db.Character{Name: "Send ISK Thanks"}}
+	p := &db.Prefs{Pattern: "%RANK%. %CHARACTER% - %AMOUNT% ISK (%GIFTS%) %NAME%"}
+	donor := &db.TopDonor{
+		ID:       90000001,
+		Name:     "Some Donator",
+		Gifts:    3,
+		TotalISK: 12345678.9,
+		Last:     time.Date(2018, 12, 25, 22, 34, 0, 0, time.UTC),
+	}
+
+	expected := "2. Some Donator - 12,345,678.90 ISK (3) Send ISK Thanks"
+	if row := getTopRow(c, p, 2, donor); row != expected {
+		t.Errorf("expected %q, got %q", expected, row)
+	}
+
+	donor.Name = ""
+	expected = "1. 90000001 - 12,345,678.90 ISK (3) Send ISK Thanks"
+	if row := getTopRow(c, p, 1, donor); row != expected {
+		t.Errorf("expected %q, got %q", expected, row)
+	}
+}
+
+func TestParseTopGroups(t *testing.T) {
+	filter, window, err := parseTopGroups(url.Values{
+		"group":    {"corporation"},
+		"window":   {"7"},
+		"alliance": {"99000001"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	switch {
+	case window != "7" || filter.Days != 7:
+		t.Errorf("unexpected window: %s %d", window, filter.Days)
+	case filter.Group != "corporation" || filter.AllianceID != 99000001:
+		t.Errorf("unexpected group or alliance: %+v", filter)
+	case filter.Donated || filter.Limit != defaultTopDonors:
+		t.Errorf("unexpected defaults: %+v", filter)
+	}
+
+	for _, invalid := range []url.Values{
+		{"group": {"character"}},
+		{"group": {"alliance"}, "alliance": {"99000001"}},
+		{"group": {"corporation"}, "alliance": {"0"}},
+		{"group": {"alliance"}, "window": {"90"}},
+		{"group": {"alliance"}, "limit": {"1000"}},
+	} {
+		if _, _, err := parseTopGroups(invalid); err == nil {
+			t.Errorf("expected %v to be invalid", invalid)
+		}
+	}
+}
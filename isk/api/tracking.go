@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+// Tracking handles getting and setting what is tracked for the user
+func Tracking(ctx context.Context) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			write405(w)
+			return
+		}
+
+		charID, ok := sessionCharacter(w, r)
+		if !ok {
+			return
+		}
+
+		owner, err := getPrefsOwner(r.WithContext(ctx), charID)
+		if err != nil {
+			write403(w)
+			return
+		}
+
+		if r.Method == http.MethodPost {
+			updateTracking(w, r.WithContext(ctx), charID, owner)
+		} else {
+			writeTracking(w, r.WithContext(ctx), charID, owner)
+		}
+	}
+}
+
+func writeTracking(
+	w http.ResponseWriter,
+	r *http.Request,
+	charID, owner int32,
+) {
+	t, err := db.GetTracking(r.Context(), charID, owner)
+	if err != nil {
+		log.Printf("failed to get user tracking: %+v", err)
+		write500(w)
+		return
+	}
+
+	writeJSON(r.Context(), w, t)
+}
+
+func updateTracking(
+	w http.ResponseWriter,
+	r *http.Request,
+	charID, owner int32,
+) {
+	decoder := json.NewDecoder(r.Body)
+	t := &db.Tracking{}
+	if err := decoder.Decode(t); err != nil {
+		write400(w)
+		return
+	}
+
+	if err := t.Sanity(); err != nil {
+		write400(w)
+		return
+	}
+
+	if err := db.SetTracking(r.Context(), charID, owner, t); err != nil {
+		if ue, ok := err.(db.UserError); ok {
+			write(w, ue.Code, ue.Msg)
+			return
+		}
+		log.Printf("failed to set user tracking: %+v", err)
+		write500(w)
+		return
+	}
+
+	w.WriteHeader(204)
+}
@@ -9,10 +9,7 @@ const (
 	// Opts is our global server runtime (*cx.Options)
 	Opts = Key("Opts")
 
-	// Provider holds the oidc provider
-	Provider = Key("Provider")
-
-	// Verifier verifies JWTs
+	// Verifier verifies SSO JWTs (*api.Verifier)
 	Verifier = Key("Verifier")
 
 	// DB is our pg connection (*sqlx.DB)
@@ -27,15 +24,18 @@ const (
 	// Prices is our in-memory cache of market prices
 	Prices = Key("Prices")
 
+	// Names is our in-memory cache of resolved names and affiliations
+	Names = Key("Names")
+
+	// PriceSources are the ways to value contract items, by name
+	PriceSources = Key("PriceSources")
+
 	// Statements is our map of prepared statements (map[Key]sqlx.Stmt)
 	Statements = Key("Statements")
 
 	// StateStore is our in-memory auth state store (*api.StateStore)
 	StateStore = Key("StateStore")
 
-	// SSOClient is XXX HACK REMOVE ME
-	SSOClient = Key("SSOClient")
-
 	// Client is the goesi client
 	Client = Key("Client")
 
@@ -45,6 +45,15 @@ const (
 	// Authenticator is the global goesi SSO authenticator
 	Authenticator = Key("Authenticator")
 
+	// SaveLock serializes character total updates between workers (*db.SaveLock)
+	SaveLock = Key("SaveLock")
+
+	// WorkerID identifies this worker process in user claims (string)
+	WorkerID = Key("WorkerID")
+
+	// Tx is the transaction db statements run in, if set (*sqlx.Tx)
+	Tx = Key("Tx")
+
 	/* -- API Statements -- */
 
 	// StmtTopReceived pulls the top character_id and receiver totals
@@ -53,6 +62,18 @@ const (
 	// StmtTopDonated pulls the top character_id and donation totals
 	StmtTopDonated = Key("StmtTopDonated")
 
+	// StmtTopCorporationsReceived pulls the corporations receiving the most
+	StmtTopCorporationsReceived = Key("StmtTopCorporationsReceived")
+
+	// StmtTopCorporationsDonated pulls the corporations donating the most
+	StmtTopCorporationsDonated = Key("StmtTopCorporationsDonated")
+
+	// StmtTopAlliancesReceived pulls the alliances receiving the most
+	StmtTopAlliancesReceived = Key("StmtTopAlliancesReceived")
+
+	// StmtTopAlliancesDonated pulls the alliances donating the most
+	StmtTopAlliancesDonated = Key("StmtTopAlliancesDonated")
+
 	// StmtCharDetails pulls details for a specific character
 	StmtCharDetails = Key("StmtCharDetails")
 
@@ -68,6 +89,15 @@ const (
 	// StmtCharContracted pulls the contracts from a character
 	StmtCharContracted = Key("StmtCharContracted")
 
+	// StmtTopDonors sums the donations and contracts to a character by donator
+	StmtTopDonors = Key("StmtTopDonors")
+
+	// StmtHistoryIn pages through the donations and contracts to a character
+	StmtHistoryIn = Key("StmtHistoryIn")
+
+	// StmtHistoryOut pages through the donations and contracts from a character
+	StmtHistoryOut = Key("StmtHistoryOut")
+
 	// StmtContractItems pulls the items for a contract
 	StmtContractItems = Key("StmtContractItems")
 
@@ -80,48 +110,109 @@ const (
 	// StmtGetUser pulls a user by ID
 	StmtGetUser = Key("StmtGetUser")
 
-	// StmtGetUsers pulls users needing an update (up to 100)
-	StmtGetUsers = Key("StmtGetUsers")
+	// StmtNextPoll returns when the next user is due to be polled
+	StmtNextPoll = Key("StmtNextPoll")
+
+	// StmtDeferUser sets when a user will next be polled
+	StmtDeferUser = Key("StmtDeferUser")
+
+	// StmtClaimUsers leases users due to be polled to a worker
+	StmtClaimUsers = Key("StmtClaimUsers")
+
+	// StmtRenewClaim extends a worker's lease on a user, if still held
+	StmtRenewClaim = Key("StmtRenewClaim")
 
-	// StmtGetNullUsers pulls users with null last processed timestamps
-	StmtGetNullUsers = Key("StmtGetNullUsers")
+	// StmtReleaseUser ends a worker's lease on a user
+	StmtReleaseUser = Key("StmtReleaseUser")
+
+	// StmtClaimMaintenance claims a maintenance task if it's due
+	StmtClaimMaintenance = Key("StmtClaimMaintenance")
+
+	// StmtSaveLock takes the transaction level lock for saving totals
+	StmtSaveLock = Key("StmtSaveLock")
 
 	// StmtUpdateUser updates a user's character (auth updates)
 	StmtUpdateUser = Key("StmtUpdateUser")
 
+	// StmtSaveProgress saves a user's cursors and polling after a pull
+	StmtSaveProgress = Key("StmtSaveProgress")
+
+	// StmtGetAllUsers pulls every user, used to re-encrypt their tokens
+	StmtGetAllUsers = Key("StmtGetAllUsers")
+
+	// StmtUpdateTokens saves a user's refreshed tokens
+	StmtUpdateTokens = Key("StmtUpdateTokens")
+
+	// StmtSetTokenState records a user's token refresh failures
+	StmtSetTokenState = Key("StmtSetTokenState")
+
 	// StmtDeleteUser deletes a user
 	StmtDeleteUser = Key("StmtDeleteUser")
 
+	// StmtDeleteUserToken deletes the user with a token
+	StmtDeleteUserToken = Key("StmtDeleteUserToken")
+
 	// StmtAddDonation inserts a donation into the donations table
 	StmtAddDonation = Key("StmtAddDonation")
 
 	// StmtGetName returns the name for an ID
 	StmtGetName = Key("StmtGetName")
 
+	// StmtGetNames returns the names for an array of IDs
+	StmtGetNames = Key("StmtGetNames")
+
+	// StmtGetNameHistory returns the previous names for an array of IDs
+	StmtGetNameHistory = Key("StmtGetNameHistory")
+
 	// StmtNewName creates a new mapping of ID<->name
 	StmtNewName = Key("StmtNewName")
 
-	// StmtUpdateName updates a mapping of ID<->name
+	// StmtUpdateName updates a mapping of ID<->name, keeping the old name
 	StmtUpdateName = Key("StmtUpdateName")
 
+	// StmtGetStaleNames returns the IDs of names not resolved in :days
+	StmtGetStaleNames = Key("StmtGetStaleNames")
+
+	// StmtGetAffiliations returns the stored affiliations for an array of IDs
+	StmtGetAffiliations = Key("StmtGetAffiliations")
+
+	// StmtTouchNames marks an array of IDs as resolved now, without renaming
+	StmtTouchNames = Key("StmtTouchNames")
+
+	// StmtUpdateAffiliation updates a character's corporation and alliance
+	StmtUpdateAffiliation = Key("StmtUpdateAffiliation")
+
 	// StmtCreateCharacter creates a new character
 	StmtCreateCharacter = Key("StmtCreateCharacter")
 
 	// StmtUpdateCharacter updates a known character
 	StmtUpdateCharacter = Key("StmtUpdateCharacter")
 
+	// StmtGetAllCharacters pulls every character's stored totals
+	StmtGetAllCharacters = Key("StmtGetAllCharacters")
+
+	// StmtCharacterSources sums every character's donations and contracts
+	StmtCharacterSources = Key("StmtCharacterSources")
+
+	// StmtRefreshWindows recalculates every character's 30 day totals
+	StmtRefreshWindows = Key("StmtRefreshWindows")
+
 	// StmtAddContract creates a new contract
 	StmtAddContract = Key("StmtAddContract")
 
 	// StmtAddContractItems creates a new contract item row
 	StmtAddContractItems = Key("StmtAddContractItems")
 
-	// StmtCharStandingISK queries donations towards standings
-	StmtCharStandingISK = Key("StmtCharStandingISK")
+	// StmtUpdateStanding sets a character's standing from their donations
+	StmtUpdateStanding = Key("StmtUpdateStanding")
 
 	// StmtCreatePreferences creates a new preferences row for the user
 	StmtCreatePreferences = Key("StmtCreatePreferences")
 
+	// StmtCreateRefTypePreferences creates a new preferences row with the
+	// journal ref types counted as donations
+	StmtCreateRefTypePreferences = Key("StmtCreateRefTypePreferences")
+
 	// StmtGetPreferences gets the preferences for the user
 	StmtGetPreferences = Key("StmtGetPreferences")
 
@@ -131,27 +222,78 @@ const (
 	// StmtSetContractPreferences updates the contract preferences for the user
 	StmtSetContractPreferences = Key("StmtSetContractPreferences")
 
+	// StmtSetTopPreferences updates the top donors preferences for the user
+	StmtSetTopPreferences = Key("StmtSetTopPreferences")
+
 	// StmtGetOutstandingContracts retrieves the outstanding contracts for a user
 	StmtGetOutstandingContracts = Key("StmtGetOutstandingContracts")
 
-	// StmtAcceptContract updates a contract status to accepted
+	// StmtAcceptContract sets a contract accepted, returning it if it changed
 	StmtAcceptContract = Key("StmtAcceptContract")
 
 	// StmtSetCombinedPreferences updates the combined preferences
 	StmtSetCombinedPreferences = Key("StmtSetCombinedPreferences")
 
-	// StmtGetStaleContracts returns contracts older than 30 days
+	// StmtGetStaleContracts returns contracts older than the retention period
 	StmtGetStaleContracts = Key("StmtGetStaleContracts")
 
-	// StmtGetStaleDonations returns donations older than 30 days
+	// StmtGetStaleDonations returns donations older than the retention period
 	StmtGetStaleDonations = Key("StmtGetStaleDonations")
 
-	// StmtRemoveContract removes a contract by ID
+	// StmtRemoveContract removes a contract by ID, keeping it in prunedTotals
 	StmtRemoveContract = Key("StmtRemoveContract")
 
 	// StmtRemoveContractItems removes contract items by ID
 	StmtRemoveContractItems = Key("StmtRemoveContractItems")
 
-	// StmtRemoveDonation removes a donation by ID
+	// StmtRemoveDonation removes a donation by ID, keeping it in prunedTotals
 	StmtRemoveDonation = Key("StmtRemoveDonation")
+
+	// StmtSetRefTypes updates the journal ref types counted as donations
+	StmtSetRefTypes = Key("StmtSetRefTypes")
+
+	// StmtSetPriceSource updates how contract items are valued
+	StmtSetPriceSource = Key("StmtSetPriceSource")
+
+	// StmtGetLocation pulls a resolved station or structure
+	StmtGetLocation = Key("StmtGetLocation")
+
+	// StmtSaveLocation upserts a resolved station or structure
+	StmtSaveLocation = Key("StmtSaveLocation")
+
+	// StmtGetUnknownTypes filters type IDs to those without a name
+	StmtGetUnknownTypes = Key("StmtGetUnknownTypes")
+
+	// StmtSaveType upserts an item type name
+	StmtSaveType = Key("StmtSaveType")
+
+	// StmtGetDivisions pulls the tracked wallet divisions of a corporation
+	StmtGetDivisions = Key("StmtGetDivisions")
+
+	// StmtAddDivision starts tracking a corporation wallet division
+	StmtAddDivision = Key("StmtAddDivision")
+
+	// StmtRemoveDivisions stops tracking all divisions not in a list
+	StmtRemoveDivisions = Key("StmtRemoveDivisions")
+
+	// StmtDefaultDivisions tracks the master wallet if nothing is tracked
+	StmtDefaultDivisions = Key("StmtDefaultDivisions")
+
+	// StmtUpdateDivision updates the journal cursor of a division
+	StmtUpdateDivision = Key("StmtUpdateDivision")
+
+	// StmtGetCachedResponse returns a cached ESI response, marking it accessed
+	StmtGetCachedResponse = Key("StmtGetCachedResponse")
+
+	// StmtSetCachedResponse creates or replaces a cached ESI response
+	StmtSetCachedResponse = Key("StmtSetCachedResponse")
+
+	// StmtDeleteCachedResponse removes a cached ESI response
+	StmtDeleteCachedResponse = Key("StmtDeleteCachedResponse")
+
+	// StmtExpireCachedResponses removes cached responses not recently accessed
+	StmtExpireCachedResponses = Key("StmtExpireCachedResponses")
+
+	// StmtTrimCachedResponses removes the least recently accessed responses
+	StmtTrimCachedResponses = Key("StmtTrimCachedResponses")
 )
@@ -6,20 +6,24 @@ import (
 	"flag"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"strings"
 
 	"golang.org/x/oauth2"
 )
 
 // Options describes all runtime options for the API
 type Options struct {
-	Production, Debug, HTTPS                bool
-	Port, CacheTime, CacheResp, MaxPrefRows int
-	CharacterID, MaxPrefLen, MaxPatternLen  int32
-	Hostname, ESI, AppSecret                string
-	DB                                      *DBOptions
-	Auth                                    *oauth2.Config
+	Production, Debug, HTTPS                         bool
+	Port, CacheTime, CacheResp, MaxPrefRows, Workers int
+	HTTPCacheSize, HTTPCacheAge, TokenFailures       int
+	MaxIdle, Retention, NameAge                      int
+	CharacterID, MaxPrefLen, MaxPatternLen           int32
+	Hostname, ESI, AppSecret, TokenAction            string
+	DB                                               *DBOptions
+	Transport                                        *TransportOptions
+	Tokens                                           *TokenKeys
+	Auth                                             *oauth2.Config
 }
 
 // DBOptions describes our database connection
@@ -27,6 +31,56 @@ type DBOptions struct {
 	Host, User, Password, Name, Mode string
 }
 
+// TransportOptions describes how the worker treats ESI errors
+type TransportOptions struct {
+	ErrorFloor, Retries, Failures, Cooldown int
+}
+
+// TokenKeys encrypt users' tokens at rest. The first key encrypts, the rest
+// are only used to decrypt until the rows are re-encrypted with the first
+type TokenKeys struct {
+	Keys    []*TokenKey `json:"keys"`
+	HashKey []byte      `json:"hash_key"` // base64 in json
+}
+
+// TokenKey is a named 256 bit AES key
+type TokenKey struct {
+	ID  string `json:"id"`
+	Key []byte `json:"key"` // base64 in json
+}
+
+// readTokenKeys returns the token keys, or nil if there are none. The API
+// and worker refuse to start without keys, but the admin commands don't
+// need them
+func readTokenKeys(filePath string) *TokenKeys {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		log.Println("Warning: no token keys found")
+		return nil
+	}
+
+	rawKeys, err := ioutil.ReadFile(filePath) // #nosec
+	if err != nil {
+		log.Fatalf("failed to read token keys: %+v", err)
+	}
+
+	keys := &TokenKeys{}
+	if err := json.Unmarshal(rawKeys, keys); err != nil {
+		log.Fatalf("failed to unmarshal token keys: %+v", err)
+	}
+
+	if len(keys.Keys) < 1 || len(keys.HashKey) < 32 {
+		log.Fatalf("token keys need at least one key and a 32 byte hash key")
+	}
+
+	for _, key := range keys.Keys {
+		if key.ID == "" || strings.Contains(key.ID, ":") || len(key.Key) != 32 {
+			log.Fatalf("invalid token key %q, keys need an ID and 32 bytes", key.ID)
+		}
+	}
+
+	return keys
+}
+
 func readAuthConf(ctx context.Context, filePath string) *oauth2.Config {
 	if _, err := os.Stat(filePath); os.IsNotExist(err) {
 		log.Println("Warning: no oauth config found. no one can sign up")
@@ -46,10 +100,6 @@ func readAuthConf(ctx context.Context, filePath string) *oauth2.Config {
 		return nil
 	}
 
-	// HACK: remove once ccpgames/sso-issues#41 is done
-	// provider := ctx.Value(Provider).(*oidc.Provider)
-	// conf.Endpoint = provider.Endpoint()
-
 	return conf
 }
 
@@ -66,6 +116,7 @@ func NewOptions(ctx context.Context) context.Context {
 	https := flag.Bool("https", false, "should be addressed via https")
 	production := flag.Bool("production", false, "if this is being run in prod")
 	authConf := flag.String("auth", "/secret/sso.json", "path to auth config")
+	tokenKeys := flag.String("token-keys", "/secret/tokens.json", "path to token keys")
 	esi := flag.String("esi", "https://esi.evetech.net", "basepath for ESI")
 	characterID := flag.Int("character", 2114454465, "standings char ID")
 	cacheTime := flag.Int("cache-time", 300, "seconds to cache responses for")
@@ -74,11 +125,33 @@ func NewOptions(ctx context.Context) context.Context {
 	maxPrefLen := flag.Int("max-pref", 1500, "max length header/footer strings")
 	maxPatternLen := flag.Int("max-pattern", 500, "max length row pattern string")
 	maxPrefRows := flag.Int("max-rows", 100, "max number of rows to allow")
+	workers := flag.Int("workers", 4, "number of users to process at once")
+	errorFloor := flag.Int("esi-error-floor", 20, "ESI error limit to pause at")
+	retries := flag.Int("esi-retries", 3, "times to retry failed ESI GETs")
+	failures := flag.Int("esi-failures", 10, "ESI failures to stop requests at")
+	cooldown := flag.Int("esi-cooldown", 60, "seconds to stop ESI requests for")
+	httpCacheSize := flag.Int("esi-cache-size", 512, "MB of ESI responses to keep")
+	httpCacheAge := flag.Int("esi-cache-age", 168, "hours to keep ESI responses")
+	tokenFailures := flag.Int("token-failures", 5, "token refresh failures allowed")
+	tokenAction := flag.String("token-action", "park", "park or delete bad users")
+	maxIdle := flag.Int("max-idle", 360, "max minutes between idle user polls")
+	retention := flag.Int("retention", 0, "days of history to keep, 0 for all")
+	nameAge := flag.Int("name-age", 7, "days before names and affiliations are refreshed")
 
 	flag.Parse()
 
-	// HACK: remove once ccpgames/sso-issues#41 is done
-	// provider := ctx.Value(Provider).(*oidc.Provider)
+	if *tokenAction != "park" && *tokenAction != "delete" {
+		log.Fatalf("invalid token action: %s", *tokenAction)
+	}
+
+	// 30 day totals are summed from history, so at least that much is kept
+	if *retention != 0 && *retention < 30 {
+		log.Fatalf("invalid retention, must be 0 or 30+ days: %d", *retention)
+	}
+
+	if *nameAge < 1 {
+		log.Fatalf("invalid name age, must be 1+ days: %d", *nameAge)
+	}
 
 	opts := &Options{
 		Production:  *production,
@@ -97,24 +170,29 @@ func NewOptions(ctx context.Context) context.Context {
 			Name:     *name,
 			Mode:     *sslmode,
 		},
+		Transport: &TransportOptions{
+			ErrorFloor: *errorFloor,
+			Retries:    *retries,
+			Failures:   *failures,
+			Cooldown:   *cooldown,
+		},
 		Auth:          readAuthConf(ctx, *authConf),
+		Tokens:        readTokenKeys(*tokenKeys),
 		AppSecret:     *appSecret,
 		MaxPrefLen:    int32(*maxPrefLen),
 		MaxPatternLen: int32(*maxPatternLen),
 		MaxPrefRows:   *maxPrefRows,
+		Workers:       *workers,
+		HTTPCacheSize: *httpCacheSize,
+		HTTPCacheAge:  *httpCacheAge,
+		TokenFailures: *tokenFailures,
+		TokenAction:   *tokenAction,
+		MaxIdle:       *maxIdle,
+		Retention:     *retention,
+		NameAge:       *nameAge,
 	}
 
-	// HACK: remove once ccpgames/sso-issues#41 is done
-	// ctx = context.WithValue(
-	// 	ctx,
-	// 	Verifier,
-	// 	provider.Verifier(&oidc.Config{ClientID: opts.Auth.ClientID}),
-	// )
-
 	ctx = context.WithValue(ctx, Opts, opts)
 
-	// HACK TEMPORARY UNTIL ccpgames/sso-issues#41
-	ctx = context.WithValue(ctx, SSOClient, &http.Client{})
-
 	return ctx
 }
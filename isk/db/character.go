@@ -156,6 +156,40 @@ type CharDetails struct {
 	// ISK OUT
 	Donated    Donations `json:"donated,omitempty"`
 	Contracted Contracts `json:"contracted,omitempty"`
+
+	// Names of everyone in the donations and contracts, by ID
+	Names map[int32]string `json:"-"`
+
+	// History of everyone's previous names, by ID
+	History map[int32][]*NameChange `json:"-"`
+}
+
+// NameAt returns the name the ID had at the time, so older donations show
+// the name they were made under
+func (c *CharDetails) NameAt(id int32, at time.Time) (string, bool) {
+	for _, change := range c.History[id] {
+		if at.Before(change.Replaced) {
+			return change.Name, true
+		}
+	}
+	name, ok := c.Names[id]
+	return name, ok
+}
+
+// involved returns the IDs of everyone in the donations and contracts
+func (c *CharDetails) involved() []int32 {
+	ids := []int32{}
+	for _, donations := range []Donations{c.Donations, c.Donated} {
+		for _, donation := range donations {
+			ids = append(ids, donation.Donator, donation.Recipient)
+		}
+	}
+	for _, contracts := range []Contracts{c.Contracts, c.Contracted} {
+		for _, contract := range contracts {
+			ids = append(ids, contract.Donator, contract.Receiver)
+		}
+	}
+	return ids
 }
 
 // GetCharDetails returns details for the character from pg
@@ -193,17 +227,45 @@ func GetCharDetails(ctx context.Context, charID int32) (*CharDetails, error) {
 		Contracted: contracted,
 	}
 
+	details.Names, err = GetNames(ctx, details.involved()...)
+	if err != nil {
+		return nil, err
+	}
+
+	details.History, err = GetNameHistory(ctx, details.involved()...)
+	if err != nil {
+		return nil, err
+	}
+
 	return details, nil
 }
 
+// Is returns true if the affiliation describes the character or corporation
+func (a *Affiliation) Is(id int32) bool {
+	if a.Character != nil {
+		return a.Character.ID == id
+	}
+	// corporations can also donate, or receive when tracking a corp wallet
+	return a.Corporation != nil && a.Corporation.ID == id
+}
+
+// ID returns the ID of the character, or the corporation if it has none
+func (a *Affiliation) ID() int32 {
+	if a.Character != nil {
+		return a.Character.ID
+	}
+	return a.Corporation.ID
+}
+
+// getAffiliation returns the affiliation of the character, or nil if it
+// could not be resolved
 func getAffiliation(charID int32, affiliations []*Affiliation) *Affiliation {
 	for _, aff := range affiliations {
-		if aff.Character.ID == charID {
+		if aff.Is(charID) {
 			return aff
 		}
 	}
-	// this should never happen
-	panic(fmt.Errorf("no affiliation found for character %d", charID))
+	return nil
 }
 
 // SaveCharacterDonations updates all totals in the characters table
@@ -211,7 +273,6 @@ func SaveCharacterDonations(
 	ctx context.Context,
 	donations []*Donation,
 	affiliations []*Affiliation,
-	addition bool,
 ) error {
 	newCharacters := []*CharacterRow{}
 	updatedCharacters := []*CharacterRow{}
@@ -232,12 +293,7 @@ func SaveCharacterDonations(
 			}
 		}
 
-		if addition {
-			addToTotals(donation, newCharacters, updatedCharacters)
-		} else {
-			removeFromTotals(donation, newCharacters, updatedCharacters)
-		}
-
+		addToTotals(donation, newCharacters, updatedCharacters)
 	}
 
 	return saveCharacters(ctx, newCharacters, updatedCharacters)
@@ -248,7 +304,6 @@ func SaveCharacterContracts(
 	ctx context.Context,
 	donations Contracts,
 	affiliations []*Affiliation,
-	addition bool,
 ) error {
 	newCharacters := []*CharacterRow{}
 	updatedCharacters := []*CharacterRow{}
@@ -272,16 +327,21 @@ func SaveCharacterContracts(
 			}
 		}
 
-		if addition {
-			addToContractTotals(contract, newCharacters, updatedCharacters)
-		} else {
-			removeFromContractTotals(contract, newCharacters, updatedCharacters)
-		}
+		addToContractTotals(contract, newCharacters, updatedCharacters)
 	}
 
 	return saveCharacters(ctx, newCharacters, updatedCharacters)
 }
 
+// UpdateStanding recalculates the character's good standing
+func UpdateStanding(ctx context.Context, charID int32) error {
+	return executeNamed(
+		ctx,
+		cx.StmtUpdateStanding,
+		map[string]interface{}{"character_id": charID},
+	)
+}
+
 // SaveCharacter saves a single character
 func SaveCharacter(ctx context.Context, char *Character) error {
 	return updateCharacter(ctx, char.toRow())
@@ -332,6 +392,11 @@ func bindAffiliation(
 		row = char.toRow()
 	}
 
+	// unresolved characters keep their last known affiliation, if any
+	if aff == nil {
+		return row, new
+	}
+
 	row.CorporationID = aff.Corporation.ID
 	if aff.Alliance != nil {
 		row.AllianceID = aff.Alliance.ID
@@ -342,43 +407,51 @@ func bindAffiliation(
 
 // addToTotals adds donation/received totals
 func addToTotals(donation *Donation, characters ...[]*CharacterRow) {
+	addGift(
+		donation.Donator,
+		donation.Recipient,
+		donation.Amount,
+		donation.Timestamp,
+		characters...,
+	)
+}
+
+// windowDays is the length of the rolling window in the _30 totals
+const windowDays = 30
+
+// addGift adds a donation or accepted contract to the donator's and
+// receiver's totals. Gifts count at their timestamp and value, as in the
+// totals query they are reconciled against, so only gifts from the last 30
+// days are added to the _30 totals
+func addGift(
+	donator, receiver int32,
+	value float64,
+	at time.Time,
+	characters ...[]*CharacterRow,
+) {
+	recent := at.After(time.Now().Add(-windowDays * 24 * time.Hour))
 	for _, chars := range characters {
 		for _, char := range chars {
-			if char.ID == donation.Donator {
-				char.DonatedISK += donation.Amount
+			if char.ID == donator {
+				char.DonatedISK += value
 				char.Donated++
-				char.DonatedISK30 += donation.Amount
-				char.Donated30++
-				if !char.LastDonated.Valid || char.LastDonated.Time.Before(
-					donation.Timestamp) {
-					char.LastDonated = pq.NullTime{Time: donation.Timestamp, Valid: true}
-					char.LastDonated.Valid = true
+				if recent {
+					char.DonatedISK30 += value
+					char.Donated30++
 				}
-			} else if char.ID == donation.Recipient {
-				char.ReceivedISK += donation.Amount
+				if !char.LastDonated.Valid || char.LastDonated.Time.Before(at) {
+					char.LastDonated = pq.NullTime{Time: at, Valid: true}
+				}
+			} else if char.ID == receiver {
+				char.ReceivedISK += value
 				char.Received++
-				char.ReceivedISK30 += donation.Amount
-				char.Received30++
-				if !char.LastReceived.Valid || char.LastReceived.Time.Before(
-					donation.Timestamp) {
-					char.LastReceived = pq.NullTime{Time: donation.Timestamp, Valid: true}
-					char.LastReceived.Valid = true
+				if recent {
+					char.ReceivedISK30 += value
+					char.Received30++
+				}
+				if !char.LastReceived.Valid || char.LastReceived.Time.Before(at) {
+					char.LastReceived = pq.NullTime{Time: at, Valid: true}
 				}
-			}
-		}
-	}
-}
-
-// removeFromTotals removes donation/received totals (from 30 day)
-func removeFromTotals(donation *Donation, characters ...[]*CharacterRow) {
-	for _, chars := range characters {
-		for _, char := range chars {
-			if char.ID == donation.Donator {
-				char.DonatedISK30 -= donation.Amount
-				char.Donated30--
-			} else if char.ID == donation.Recipient {
-				char.ReceivedISK30 -= donation.Amount
-				char.Received30--
 			}
 		}
 	}
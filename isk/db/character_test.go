@@ -0,0 +1,38 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNameAt(t *testing.T) {
+	renamed := time.Date(2018, 12, 25, 22, 34, 0, 0, time.UTC)
+	later := renamed.Add(time.Hour)
+	details := &CharDetails{
+		Names: map[int32]string{90000001: "Current Name"},
+		History: map[int32][]*NameChange{
+			90000001: {
+				{ID: 90000001, Name: "First Name", Replaced: renamed},
+				{ID: 90000001, Name: "Second Name", Replaced: later},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		at       time.Time
+		expected string
+	}{
+		{renamed.Add(-time.Minute), "First Name"},
+		{renamed.Add(time.Minute), "Second Name"},
+		{renamed.Add(2 * time.Hour), "Current Name"},
+	} {
+		name, ok := details.NameAt(90000001, tc.at)
+		if !ok || name != tc.expected {
+			t.Errorf("expected %q at %v, got %q", tc.expected, tc.at, name)
+		}
+	}
+
+	if _, ok := details.NameAt(90000002, renamed); ok {
+		t.Errorf("expected no name for an unknown ID")
+	}
+}
@@ -0,0 +1,105 @@
+package db
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+// saveLockID is the advisory lock ID held while saving character totals
+const saveLockID int64 = 0x69736b
+
+// SaveLock serializes character total updates between goroutines, and
+// between worker processes with a Postgres advisory lock
+type SaveLock struct {
+	lock *sync.Mutex
+}
+
+// NewSaveLock returns a new, unlocked, SaveLock
+func NewSaveLock() *SaveLock {
+	return &SaveLock{lock: &sync.Mutex{}}
+}
+
+// begin blocks until no other goroutine or worker is saving totals, then
+// returns a transaction holding the advisory lock until it ends
+func (l *SaveLock) begin(ctx context.Context) (*sqlx.Tx, error) {
+	l.lock.Lock()
+
+	tx, err := ctx.Value(cx.DB).(*sqlx.DB).Beginx()
+	if err != nil {
+		l.lock.Unlock()
+		return nil, err
+	}
+
+	txCtx := context.WithValue(ctx, cx.Tx, tx)
+	if err := executeNamed(txCtx, cx.StmtSaveLock, map[string]interface{}{
+		"lock_id": saveLockID,
+	}); err != nil {
+		rollback(tx)
+		l.lock.Unlock()
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// Transaction runs f in a transaction holding the save lock, committing if
+// f succeeds. Transactions within f are a part of it
+func Transaction(ctx context.Context, f func(context.Context) error) error {
+	if _, ok := ctx.Value(cx.Tx).(*sqlx.Tx); ok {
+		return f(ctx)
+	}
+
+	lock := ctx.Value(cx.SaveLock).(*SaveLock)
+	tx, err := lock.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer lock.lock.Unlock()
+
+	if err := f(context.WithValue(ctx, cx.Tx, tx)); err != nil {
+		rollback(tx)
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func rollback(tx *sqlx.Tx) {
+	if err := tx.Rollback(); err != nil {
+		log.Printf("failed to rollback transaction: %+v", err)
+	}
+}
+
+// ClaimMaintenance returns true if the maintenance task was last run over
+// every ago, marking it as run now. Only one worker gets each run
+func ClaimMaintenance(
+	ctx context.Context,
+	name string,
+	every time.Duration,
+) (bool, error) {
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtClaimMaintenance,
+		map[string]interface{}{
+			"name":  name,
+			"every": int(every.Seconds()),
+		},
+	)
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		if err := rows.Close(); err != nil {
+			log.Printf("failed to close rows: %+v", err)
+		}
+	}()
+
+	return rows.Next(), rows.Err()
+}
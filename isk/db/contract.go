@@ -6,7 +6,6 @@ import (
 	"time"
 
 	"github.com/a-tal/esi-isk/isk/cx"
-	"github.com/lib/pq"
 )
 
 // Contract describes zero ISK donation contracts
@@ -22,7 +21,12 @@ type Contract struct {
 
 	// Location is the station or structure ID
 	Location int64 `db:"location" json:"location"`
-	// TODO: resolve locationID to a name (or system name)
+
+	// LocationName is the station or structure name, if known
+	LocationName string `db:"location_name" json:"location_name,omitempty"`
+
+	// SystemName is the solar system of the location, if known
+	SystemName string `db:"system_name" json:"system_name,omitempty"`
 
 	// Issued timestamp
 	Issued time.Time `db:"issued" json:"issued"`
@@ -36,6 +40,9 @@ type Contract struct {
 	// Value is an estimated value of the contract items
 	Value float64 `db:"value" json:"value"`
 
+	// PriceSource is how the contract items were valued
+	PriceSource string `db:"price_source" json:"price_source"`
+
 	// Note is the title of the contract
 	Note string `db:"note" json:"note"`
 
@@ -63,11 +70,17 @@ type Item struct {
 	// TypeID of the item in the contract
 	TypeID int32 `db:"type_id" json:"type_id"`
 
+	// Name of the item type, if resolved
+	Name string `db:"name" json:"name,omitempty"`
+
 	// Quantity of items given
 	Quantity int32 `db:"quantity" json:"quantity"`
 
 	// ItemID of the item in the contract (if possible to determine)
 	ItemID int64 `db:"item_id" json:"item_id,omitempty"`
+
+	// Price per unit of the item when the contract was valued
+	Price float64 `db:"price" json:"price"`
 }
 
 func getCharContracts(ctx context.Context, charID int32) (Contracts, error) {
@@ -106,9 +119,13 @@ func getContracts(ctx context.Context, charID int32, key cx.Key) (
 	return contracts, itemErr
 }
 
-// GetStaleContracts returns contracts issued more than 30 days ago
-func GetStaleContracts(ctx context.Context) (Contracts, error) {
-	rows, err := queryNamedResult(ctx, cx.StmtGetStaleContracts, nil)
+// GetStaleContracts returns contracts issued more than days ago
+func GetStaleContracts(ctx context.Context, days int) (Contracts, error) {
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtGetStaleContracts,
+		map[string]interface{}{"days": days},
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -125,7 +142,8 @@ func GetStaleContracts(ctx context.Context) (Contracts, error) {
 	return contracts, nil
 }
 
-// PruneContract removes a contract and deducts from the 30d totals
+// PruneContract removes a contract and its items, adding it to the pruned
+// totals if it was accepted
 func PruneContract(ctx context.Context, c *Contract) error {
 	if err := executeContract(ctx, cx.StmtRemoveContract, c); err != nil {
 		return err
@@ -180,45 +198,63 @@ func GetContractItems(
 	return nil
 }
 
-// SaveContract saves the contract and associated items in the db
-func SaveContract(ctx context.Context, contract *Contract) error {
-	err := executeNamed(ctx, cx.StmtAddContract, map[string]interface{}{
-		"contract_id": contract.ID,
-		"donator":     contract.Donator,
-		"receiver":    contract.Receiver,
-		"location":    contract.Location,
-		"issued":      contract.Issued,
-		"expires":     contract.Expires,
-		"accepted":    contract.Accepted,
-		"value":       contract.Value,
-		"note":        contract.Note,
+// SaveContract saves the contract and associated items in the db,
+// returning false if the contract was already known
+func SaveContract(ctx context.Context, contract *Contract) (bool, error) {
+	added, err := executeNamedCount(ctx, cx.StmtAddContract, map[string]interface{}{
+		"contract_id":  contract.ID,
+		"donator":      contract.Donator,
+		"receiver":     contract.Receiver,
+		"location":     contract.Location,
+		"issued":       contract.Issued,
+		"expires":      contract.Expires,
+		"accepted":     contract.Accepted,
+		"value":        contract.Value,
+		"note":         contract.Note,
+		"price_source": contract.PriceSource,
 	})
-	if err != nil {
-		return err
+	if err != nil || added < 1 {
+		return false, err
 	}
-	return saveContractItems(ctx, contract.Items)
+	return true, saveContractItems(ctx, contract.Items)
 }
 
-// UpdateContracts sets the contract as accepted in the db, if it has been
+// UpdateContracts sets the contracts as accepted in the db, if they have
+// been. Only contracts which weren't already accepted are added to the
+// totals, at their stored value
 func UpdateContracts(
 	ctx context.Context,
 	contracts []*Contract,
 	aff []*Affiliation,
 ) error {
-	if err := SaveCharacterContracts(ctx, contracts, aff, true); err != nil {
-		return err
-	}
-
+	accepted := Contracts{}
 	for _, contract := range contracts {
-		if err := executeNamed(ctx, cx.StmtAcceptContract, map[string]interface{}{
-			"contract_id":  contract.ID,
-			"character_id": contract.Receiver,
-		}); err != nil {
+		if !contract.Accepted {
+			continue
+		}
+
+		rows, err := queryNamedResult(
+			ctx,
+			cx.StmtAcceptContract,
+			map[string]interface{}{
+				"contract_id":  contract.ID,
+				"character_id": contract.Receiver,
+			},
+		)
+		if err != nil {
 			return err
 		}
+
+		res, err := scan(rows, func() interface{} { return &Contract{} })
+		if err != nil {
+			return err
+		}
+		for _, i := range res {
+			accepted = append(accepted, i.(*Contract))
+		}
 	}
 
-	return nil
+	return SaveCharacterContracts(ctx, accepted, aff)
 }
 
 func saveContractItems(ctx context.Context, items []*Item) error {
@@ -229,6 +265,7 @@ func saveContractItems(ctx context.Context, items []*Item) error {
 			"type_id":     item.TypeID,
 			"item_id":     0, // XXX replace once item IDs are in all contract endpoints
 			"quantity":    item.Quantity,
+			"price":       item.Price,
 		})
 		if err != nil {
 			return err
@@ -237,46 +274,17 @@ func saveContractItems(ctx context.Context, items []*Item) error {
 	return nil
 }
 
-// addToContractTotals adds donation/received totals from contracts
+// addToContractTotals adds donation/received totals from contracts. A
+// contract only counts once it's accepted, at its stored value
 func addToContractTotals(contract *Contract, characters ...[]*CharacterRow) {
-	for _, chars := range characters {
-		for _, char := range chars {
-			if char.ID == contract.Donator {
-				char.DonatedISK += contract.Value
-				char.Donated++
-				char.DonatedISK30 += contract.Value
-				char.Donated30++
-				if !char.LastDonated.Valid || char.LastDonated.Time.Before(
-					contract.Issued) {
-					char.LastDonated = pq.NullTime{Time: contract.Issued, Valid: true}
-					char.LastDonated.Valid = true
-				}
-			} else if char.ID == contract.Receiver {
-				char.ReceivedISK += contract.Value
-				char.Received++
-				char.ReceivedISK30 += contract.Value
-				char.Received30++
-				if !char.LastReceived.Valid || char.LastReceived.Time.Before(
-					contract.Issued) {
-					char.LastReceived = pq.NullTime{Time: contract.Issued, Valid: true}
-					char.LastReceived.Valid = true
-				}
-			}
-		}
-	}
-}
-
-// removeFromContractTotals removes donation/received totals from contracts
-func removeFromContractTotals(contract *Contract, chars ...[]*CharacterRow) {
-	for _, characters := range chars {
-		for _, char := range characters {
-			if char.ID == contract.Donator {
-				char.DonatedISK30 -= contract.Value
-				char.Donated30--
-			} else if char.ID == contract.Receiver {
-				char.ReceivedISK30 -= contract.Value
-				char.Received30--
-			}
-		}
+	if !contract.Accepted {
+		return
 	}
+	addGift(
+		contract.Donator,
+		contract.Receiver,
+		contract.Value,
+		contract.Issued,
+		characters...,
+	)
 }
@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/lib/pq"
+)
+
+// Division is a tracked corporation wallet division
+type Division struct {
+	// CorporationID is the corporation whose wallet is tracked
+	CorporationID int32 `db:"corporation_id"`
+
+	// Division is the wallet division (1-7)
+	Division int32 `db:"division"`
+
+	// LastJournalID is the last seen journal entry ID in the division
+	LastJournalID sql.NullInt64 `db:"last_journal_id"`
+}
+
+// GetDivisions returns the tracked wallet divisions of the corporation
+func GetDivisions(ctx context.Context, corpID int32) ([]*Division, error) {
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtGetDivisions,
+		map[string]interface{}{"corporation_id": corpID},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &Division{} })
+	if err != nil {
+		return nil, err
+	}
+
+	divisions := []*Division{}
+	for _, i := range res {
+		divisions = append(divisions, i.(*Division))
+	}
+	return divisions, nil
+}
+
+// SetDivisions tracks only the given wallet divisions of the corporation
+func SetDivisions(ctx context.Context, corpID int32, divisions []int32) error {
+	if err := executeNamed(ctx, cx.StmtRemoveDivisions, map[string]interface{}{
+		"corporation_id": corpID,
+		"divisions":      pq.Array(divisions),
+	}); err != nil {
+		return err
+	}
+
+	for _, division := range divisions {
+		if err := executeNamed(ctx, cx.StmtAddDivision, map[string]interface{}{
+			"corporation_id": corpID,
+			"division":       division,
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DefaultDivisions tracks the master wallet if no divisions are tracked
+func DefaultDivisions(ctx context.Context, corpID int32) error {
+	return executeNamed(ctx, cx.StmtDefaultDivisions, map[string]interface{}{
+		"corporation_id": corpID,
+	})
+}
+
+// SaveDivision stores the journal cursor of the division, unless another
+// director of the corporation has already moved it further
+func SaveDivision(ctx context.Context, division *Division) error {
+	return executeNamed(ctx, cx.StmtUpdateDivision, map[string]interface{}{
+		"corporation_id":  division.CorporationID,
+		"division":        division.Division,
+		"last_journal_id": division.LastJournalID,
+	})
+}
+
+// GetUserCorporation returns the corporation ID tracked by the character
+func GetUserCorporation(ctx context.Context, charID int32) (int32, error) {
+	user, err := getUser(ctx, charID)
+	if err != nil {
+		return 0, err
+	}
+
+	if !user.CorporationMode || user.CorporationID < 1 {
+		return 0, UserError{
+			Msg:  []byte("Corporation is not tracked"),
+			Code: 403,
+		}
+	}
+
+	return user.CorporationID, nil
+}
@@ -0,0 +1,181 @@
+package db
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+// tokenVersion prefixes encrypted tokens, anything else is plaintext
+const tokenVersion = "v1"
+
+var errNoTokenKeys = errors.New("no token keys configured")
+
+// getTokenKeys returns the configured token keys
+func getTokenKeys(ctx context.Context) (*cx.TokenKeys, error) {
+	opts := ctx.Value(cx.Opts).(*cx.Options)
+	if opts.Tokens == nil || len(opts.Tokens.Keys) < 1 {
+		return nil, errNoTokenKeys
+	}
+	return opts.Tokens, nil
+}
+
+// CheckTokenKeys returns an error if no token keys are configured. Neither
+// the API nor the worker can store or read tokens without them
+func CheckTokenKeys(ctx context.Context) error {
+	_, err := getTokenKeys(ctx)
+	return err
+}
+
+// encryptToken seals the token with a new data key, which is itself sealed
+// with the first token key. The result is "v1:<key ID>:<data key>:<token>"
+func encryptToken(ctx context.Context, token string) (string, error) {
+	keys, err := getTokenKeys(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+
+	sealed, err := seal(dataKey, []byte(token))
+	if err != nil {
+		return "", err
+	}
+
+	wrapped, err := seal(keys.Keys[0].Key, dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join([]string{
+		tokenVersion,
+		keys.Keys[0].ID,
+		base64.RawStdEncoding.EncodeToString(wrapped),
+		base64.RawStdEncoding.EncodeToString(sealed),
+	}, ":"), nil
+}
+
+// decryptToken opens an encrypted token. Plaintext tokens from before
+// encryption are returned as they are, until they are re-encrypted
+func decryptToken(ctx context.Context, stored string) (string, error) {
+	parts := strings.Split(stored, ":")
+	if len(parts) != 4 || parts[0] != tokenVersion {
+		return stored, nil
+	}
+
+	keys, err := getTokenKeys(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	var key []byte
+	for _, k := range keys.Keys {
+		if k.ID == parts[1] {
+			key = k.Key
+		}
+	}
+	if key == nil {
+		return "", fmt.Errorf("unknown token key: %s", parts[1])
+	}
+
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", err
+	}
+
+	dataKey, err := open(key, wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	token, err := open(dataKey, sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(token), nil
+}
+
+// needsEncrypting returns true if the stored token is plaintext, or isn't
+// encrypted with the first token key
+func needsEncrypting(ctx context.Context, stored string) bool {
+	keys, err := getTokenKeys(ctx)
+	if err != nil {
+		return false
+	}
+
+	parts := strings.Split(stored, ":")
+	return len(parts) != 4 ||
+		parts[0] != tokenVersion ||
+		parts[1] != keys.Keys[0].ID
+}
+
+// hashToken returns the keyed hash used to look up the token
+func hashToken(ctx context.Context, token string) (string, error) {
+	keys, err := getTokenKeys(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	mac := hmac.New(sha256.New, keys.HashKey)
+	if _, err := mac.Write([]byte(token)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// seal encrypts with AES-GCM, prefixing the nonce
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// open decrypts the output of seal
+func open(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("sealed value is too short")
+	}
+
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
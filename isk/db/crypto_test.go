@@ -0,0 +1,130 @@
+package db
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+func tokenContext(keys ...*cx.TokenKey) context.Context {
+	return context.WithValue(context.Background(), cx.Opts, &cx.Options{
+		Tokens: &cx.TokenKeys{
+			Keys:    keys,
+			HashKey: bytes.Repeat([]byte("h"), 32),
+		},
+	})
+}
+
+func TestEncryptToken(t *testing.T) {
+	ctx := tokenContext(&cx.TokenKey{ID: "a", Key: bytes.Repeat([]byte("a"), 32)})
+
+	stored, err := encryptToken(ctx, "refresh-me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Contains(stored, "refresh-me") || !strings.HasPrefix(stored, "v1:a:") {
+		t.Errorf("invalid encrypted token: %q", stored)
+	}
+
+	token, err := decryptToken(ctx, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "refresh-me" {
+		t.Errorf("invalid token. received %q, expected %q", token, "refresh-me")
+	}
+
+	if needsEncrypting(ctx, stored) {
+		t.Error("token encrypted with the current key needs encrypting")
+	}
+}
+
+func TestDecryptPlaintextToken(t *testing.T) {
+	ctx := tokenContext(&cx.TokenKey{ID: "a", Key: bytes.Repeat([]byte("a"), 32)})
+
+	token, err := decryptToken(ctx, "plain-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "plain-token" {
+		t.Errorf("invalid token. received %q, expected %q", token, "plain-token")
+	}
+
+	if !needsEncrypting(ctx, "plain-token") {
+		t.Error("plaintext token does not need encrypting")
+	}
+}
+
+func TestRotateTokenKey(t *testing.T) {
+	oldKey := &cx.TokenKey{ID: "old", Key: bytes.Repeat([]byte("o"), 32)}
+	newKey := &cx.TokenKey{ID: "new", Key: bytes.Repeat([]byte("n"), 32)}
+
+	stored, err := encryptToken(tokenContext(oldKey), "refresh-me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := tokenContext(newKey, oldKey)
+
+	if !needsEncrypting(ctx, stored) {
+		t.Error("token encrypted with an old key does not need encrypting")
+	}
+
+	token, err := decryptToken(ctx, stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token != "refresh-me" {
+		t.Errorf("invalid token. received %q, expected %q", token, "refresh-me")
+	}
+
+	if _, err := decryptToken(tokenContext(newKey), stored); err == nil {
+		t.Error("expected an error decrypting with a removed key")
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	ctx := tokenContext(&cx.TokenKey{ID: "a", Key: bytes.Repeat([]byte("a"), 32)})
+
+	h1, err := hashToken(ctx, "refresh-me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h2, err := hashToken(ctx, "refresh-me")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h3, err := hashToken(ctx, "refresh-you")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h1 != h2 || h1 == h3 {
+		t.Errorf("invalid hashes: %q, %q, %q", h1, h2, h3)
+	}
+}
+
+func TestCheckTokenKeys(t *testing.T) {
+	if err := CheckTokenKeys(tokenContext()); err == nil {
+		t.Error("expected an error without token keys")
+	}
+
+	none := context.WithValue(context.Background(), cx.Opts, &cx.Options{})
+	if err := CheckTokenKeys(none); err == nil {
+		t.Error("expected an error without a token keys file")
+	}
+
+	ctx := tokenContext(&cx.TokenKey{ID: "a", Key: bytes.Repeat([]byte("a"), 32)})
+	if err := CheckTokenKeys(ctx); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
@@ -27,6 +27,9 @@ type Donation struct {
 
 	// Amount of ISK transferred
 	Amount float64 `db:"amount" json:"amount"`
+
+	// RefType is the wallet journal type of the transfer
+	RefType string `db:"ref_type" json:"ref_type"`
 }
 
 // Donations are time sorted
@@ -48,23 +51,13 @@ func GetCharDonated(ctx context.Context, charID int32) (Donations, error) {
 	return getDonations(ctx, charID, cx.StmtCharDonated)
 }
 
-// GetCharStandingISK returns the amount donated towards improving standing
-func GetCharStandingISK(ctx context.Context, charID int32) (float64, error) {
-	donations, err := getDonations(ctx, charID, cx.StmtCharStandingISK)
-	if err != nil {
-		return 0, err
-	}
-
-	total := float64(0)
-	for _, d := range donations {
-		total += d.Amount
-	}
-	return total, nil
-}
-
-// GetStaleDonations returns donations from more than 30 days ago
-func GetStaleDonations(ctx context.Context) (Donations, error) {
-	rows, err := queryNamedResult(ctx, cx.StmtGetStaleDonations, nil)
+// GetStaleDonations returns donations from more than days ago
+func GetStaleDonations(ctx context.Context, days int) (Donations, error) {
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtGetStaleDonations,
+		map[string]interface{}{"days": days},
+	)
 	if err != nil {
 		return nil, err
 	}
@@ -108,19 +101,22 @@ func getDonations(ctx context.Context, charID int32, key cx.Key) (
 	return donations, nil
 }
 
-// SaveDonation stores a donation in the database
-func SaveDonation(ctx context.Context, donation *Donation) error {
-	return executeNamed(ctx, cx.StmtAddDonation, map[string]interface{}{
+// SaveDonation stores a donation in the database, returning false if it
+// was already known
+func SaveDonation(ctx context.Context, donation *Donation) (bool, error) {
+	added, err := executeNamedCount(ctx, cx.StmtAddDonation, map[string]interface{}{
 		"transaction_id": donation.ID,
 		"donator":        donation.Donator,
 		"receiver":       donation.Recipient,
 		"timestamp":      donation.Timestamp,
 		"note":           donation.Note,
 		"amount":         donation.Amount,
+		"ref_type":       donation.RefType,
 	})
+	return added > 0, err
 }
 
-// PruneDonation removes a donation by ID
+// PruneDonation removes a donation by ID, adding it to the pruned totals
 func PruneDonation(ctx context.Context, donation *Donation) error {
 	return executeNamed(ctx, cx.StmtRemoveDonation, map[string]interface{}{
 		"transaction_id": donation.ID,
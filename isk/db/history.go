@@ -0,0 +1,196 @@
+package db
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+// HistoryRow is a donation or contract in a character's history
+type HistoryRow struct {
+	// Type is either "donation" or "contract"
+	Type string `db:"type" json:"type"`
+
+	// ID is the transaction or contract ID
+	ID int64 `db:"id" json:"id"`
+
+	// Donator who sent the ISK or contract
+	Donator int32 `db:"donator" json:"donator"`
+
+	// Receiver of the ISK or contract
+	Receiver int32 `db:"receiver" json:"receiver"`
+
+	// Timestamp of the transfer, or when the contract was issued
+	Timestamp time.Time `db:"at" json:"timestamp"`
+
+	// Amount of ISK transferred, or the value of the contract items
+	Amount float64 `db:"value" json:"amount"`
+
+	// Note or contract title
+	Note string `db:"note" json:"note,omitempty"`
+
+	// Accepted is false for contracts which are still outstanding
+	Accepted bool `db:"accepted" json:"accepted"`
+
+	// Name of the other character, if known
+	Name string `db:"-" json:"name,omitempty"`
+}
+
+// HistoryCursor is the position of the last row of a history page
+type HistoryCursor struct {
+	Timestamp time.Time
+	Type      string
+	ID        int64
+}
+
+// String encodes the cursor to be passed back for the next page
+func (c *HistoryCursor) String() string {
+	raw := fmt.Sprintf(
+		"%s|%s|%d",
+		c.Timestamp.UTC().Format(time.RFC3339Nano),
+		c.Type,
+		c.ID,
+	)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+// ParseHistoryCursor decodes a cursor from HistoryCursor.String
+func ParseHistoryCursor(s string) (*HistoryCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := strings.Split(string(raw), "|")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid history cursor")
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	return &HistoryCursor{Timestamp: timestamp, Type: parts[1], ID: id}, nil
+}
+
+// HistoryFilter selects a page of a character's history
+type HistoryFilter struct {
+	// CharacterID whose history this is
+	CharacterID int32
+
+	// Outgoing selects what the character sent, instead of received
+	Outgoing bool
+
+	// Type is "donation" or "contract", or empty for both
+	Type string
+
+	// Since and Until limit the timestamps, if set
+	Since, Until *time.Time
+
+	// Minimum amount of ISK or contract value
+	Minimum float64
+
+	// Counterparty is the other character, or 0 for anyone
+	Counterparty int32
+
+	// Note must contain this text, case insensitively, if set
+	Note string
+
+	// Cursor is the last row of the previous page, or nil for the first
+	Cursor *HistoryCursor
+
+	// Limit is the most rows to return
+	Limit int
+}
+
+// GetHistory returns a page of the character's donations and contracts,
+// newest first, with the counterparty names filled in
+func GetHistory(ctx context.Context, filter *HistoryFilter) (
+	[]*HistoryRow,
+	error,
+) {
+	key := cx.StmtHistoryIn
+	if filter.Outgoing {
+		key = cx.StmtHistoryOut
+	}
+
+	values := map[string]interface{}{
+		"character_id": filter.CharacterID,
+		"type":         filter.Type,
+		"since":        nil,
+		"until":        nil,
+		"minimum":      filter.Minimum,
+		"counterparty": filter.Counterparty,
+		"note":         filter.Note,
+		"cursor_at":    nil,
+		"cursor_type":  "",
+		"cursor_id":    int64(0),
+		"limit":        filter.Limit,
+	}
+	if filter.Since != nil {
+		values["since"] = *filter.Since
+	}
+	if filter.Until != nil {
+		values["until"] = *filter.Until
+	}
+	if filter.Cursor != nil {
+		values["cursor_at"] = filter.Cursor.Timestamp
+		values["cursor_type"] = filter.Cursor.Type
+		values["cursor_id"] = filter.Cursor.ID
+	}
+
+	rows, err := queryNamedResult(ctx, key, values)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &HistoryRow{} })
+	if err != nil {
+		return nil, err
+	}
+
+	history := []*HistoryRow{}
+	ids := []int32{}
+	for _, i := range res {
+		row := i.(*HistoryRow)
+		history = append(history, row)
+		ids = append(ids, row.Counterparty(filter.Outgoing))
+	}
+
+	names, err := GetNames(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range history {
+		row.Name = names[row.Counterparty(filter.Outgoing)]
+	}
+
+	return history, nil
+}
+
+// Cursor returns the position of this row, to continue on from
+func (h *HistoryRow) Cursor() *HistoryCursor {
+	return &HistoryCursor{Timestamp: h.Timestamp, Type: h.Type, ID: h.ID}
+}
+
+// Counterparty returns the other character, who received what the character
+// sent when outgoing, or sent what they received otherwise
+func (h *HistoryRow) Counterparty(outgoing bool) int32 {
+	if outgoing {
+		return h.Receiver
+	}
+	return h.Donator
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+// HTTPCache implements httpcache.Cache using the httpcache table, so cached
+// ESI responses (and their ETags) are shared between workers and restarts
+type HTTPCache struct {
+	ctx context.Context
+
+	// maxSize is the total size of cached responses to keep, in bytes
+	maxSize int64
+
+	// maxAge is how long an unused response is kept for
+	maxAge time.Duration
+}
+
+type cachedResponse struct {
+	Value []byte `db:"value"`
+}
+
+// NewHTTPCache returns a new HTTPCache which evicts in the background
+func NewHTTPCache(ctx context.Context) *HTTPCache {
+	opts := ctx.Value(cx.Opts).(*cx.Options)
+	c := &HTTPCache{
+		ctx:     ctx,
+		maxSize: int64(opts.HTTPCacheSize) * 1024 * 1024,
+		maxAge:  time.Duration(opts.HTTPCacheAge) * time.Hour,
+	}
+	go c.maintenance()
+	return c
+}
+
+// Get returns the cached response for the key, if any
+func (c *HTTPCache) Get(key string) ([]byte, bool) {
+	res := &cachedResponse{}
+	err := getNamedResult(c.ctx, cx.StmtGetCachedResponse, res,
+		map[string]interface{}{"cache_key": key},
+	)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("failed to get cached response: %+v", err)
+		}
+		return nil, false
+	}
+	return res.Value, true
+}
+
+// Set stores the response for the key
+func (c *HTTPCache) Set(key string, value []byte) {
+	if err := executeNamed(c.ctx, cx.StmtSetCachedResponse,
+		map[string]interface{}{
+			"cache_key": key,
+			"value":     value,
+			"size":      len(value),
+		},
+	); err != nil {
+		log.Printf("failed to cache response: %+v", err)
+	}
+}
+
+// Delete removes the response for the key
+func (c *HTTPCache) Delete(key string) {
+	if err := executeNamed(c.ctx, cx.StmtDeleteCachedResponse,
+		map[string]interface{}{"cache_key": key},
+	); err != nil {
+		log.Printf("failed to delete cached response: %+v", err)
+	}
+}
+
+// maintenance evicts old and oversized responses every few minutes
+func (c *HTTPCache) maintenance() {
+	for {
+		time.Sleep(5 * time.Minute)
+		if err := c.evict(); err != nil {
+			log.Printf("failed to evict cached responses: %+v", err)
+		}
+	}
+}
+
+// evict removes responses past the max age, then trims to the max size
+func (c *HTTPCache) evict() error {
+	if err := executeNamed(c.ctx, cx.StmtExpireCachedResponses,
+		map[string]interface{}{"max_age": int(c.maxAge.Seconds())},
+	); err != nil {
+		return err
+	}
+
+	return executeNamed(c.ctx, cx.StmtTrimCachedResponses,
+		map[string]interface{}{"max_size": c.maxSize},
+	)
+}
@@ -0,0 +1,48 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+// Location is a resolved station or structure
+type Location struct {
+	// ID of the station or structure
+	ID int64 `db:"id"`
+
+	// Name of the station or structure, empty if it couldn't be resolved
+	Name string `db:"name"`
+
+	// SystemID is the solar system of the location, if known
+	SystemID int32 `db:"system_id"`
+
+	// SystemName is the name of the solar system, if known
+	SystemName string `db:"system_name"`
+
+	// Updated is when the location was last resolved
+	Updated time.Time `db:"updated"`
+}
+
+// GetLocation returns the location, or sql.ErrNoRows if it needs resolving
+func GetLocation(ctx context.Context, id int64) (*Location, error) {
+	location := &Location{}
+	err := getNamedResult(ctx, cx.StmtGetLocation, location,
+		map[string]interface{}{"id": id},
+	)
+	if err != nil {
+		return nil, err
+	}
+	return location, nil
+}
+
+// SaveLocation saves the resolved location
+func SaveLocation(ctx context.Context, location *Location) error {
+	return executeNamed(ctx, cx.StmtSaveLocation, map[string]interface{}{
+		"id":          location.ID,
+		"name":        location.Name,
+		"system_id":   location.SystemID,
+		"system_name": location.SystemName,
+	})
+}
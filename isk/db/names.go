@@ -2,8 +2,10 @@ package db
 
 import (
 	"context"
+	"time"
 
 	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/lib/pq"
 )
 
 // Name represents an ID -> name mapping
@@ -12,6 +14,13 @@ type Name struct {
 	Name string `db:"name"`
 }
 
+// NameChange is a previous name, which was used until it was replaced
+type NameChange struct {
+	ID       int32     `db:"id"`
+	Name     string    `db:"name"`
+	Replaced time.Time `db:"replaced"`
+}
+
 // SaveNames stores the map of ids:names in the db
 func SaveNames(ctx context.Context, affiliations []*Affiliation) error {
 	names := map[int32]string{}
@@ -30,14 +39,14 @@ func SaveNames(ctx context.Context, affiliations []*Affiliation) error {
 }
 
 func saveNames(ctx context.Context, names map[int32]string) error {
-	known := map[int32]string{}
+	ids := []int32{}
 	for id := range names {
-		knownNames, err := GetNames(ctx, id)
-		if err == nil {
-			for knownID, knownName := range knownNames {
-				known[knownID] = knownName
-			}
-		}
+		ids = append(ids, id)
+	}
+
+	known, err := GetNames(ctx, ids...)
+	if err != nil {
+		return err
 	}
 
 	for id, name := range names {
@@ -58,6 +67,140 @@ func saveNames(ctx context.Context, names map[int32]string) error {
 	return nil
 }
 
+// RefreshNames stores freshly resolved names, keeping any previous names in
+// the name history
+func RefreshNames(ctx context.Context, names map[int32]string) error {
+	for id, name := range names {
+		updated, err := executeNamedCount(
+			ctx,
+			cx.StmtUpdateName,
+			map[string]interface{}{"id": id, "name": name},
+		)
+		if err != nil {
+			return err
+		}
+		if updated > 0 {
+			continue
+		}
+		if err := newName(ctx, id, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TouchNames marks the IDs as resolved now without changing their names, so
+// IDs which fail to refresh are retried after the others
+func TouchNames(ctx context.Context, ids []int32) error {
+	if len(ids) < 1 {
+		return nil
+	}
+	return executeNamed(
+		ctx,
+		cx.StmtTouchNames,
+		map[string]interface{}{"ids": pq.Array(ids)},
+	)
+}
+
+// GetStaleNames returns up to limit IDs whose names were last resolved more
+// than days ago, oldest first
+func GetStaleNames(ctx context.Context, days, limit int) ([]int32, error) {
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtGetStaleNames,
+		map[string]interface{}{"days": days, "limit": limit},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &Name{} })
+	if err != nil {
+		return nil, err
+	}
+
+	ids := []int32{}
+	for _, i := range res {
+		ids = append(ids, i.(*Name).ID)
+	}
+	return ids, nil
+}
+
+// affiliationRow is a stored affiliation with all of its names
+type affiliationRow struct {
+	CharacterID     int32  `db:"character_id"`
+	CorporationID   int32  `db:"corporation_id"`
+	AllianceID      int32  `db:"alliance_id"`
+	CharacterName   string `db:"character_name"`
+	CorporationName string `db:"corporation_name"`
+	AllianceName    string `db:"alliance_name"`
+}
+
+func (r *affiliationRow) toAffiliation() *Affiliation {
+	aff := &Affiliation{
+		Corporation: &Name{ID: r.CorporationID, Name: r.CorporationName},
+	}
+	// corporations are stored as characters in their own corporation
+	if r.CharacterID != r.CorporationID {
+		aff.Character = &Name{ID: r.CharacterID, Name: r.CharacterName}
+	}
+	if r.AllianceID > 0 {
+		aff.Alliance = &Name{ID: r.AllianceID, Name: r.AllianceName}
+	}
+	return aff
+}
+
+// GetAffiliations returns the stored affiliations of the character or
+// corporation IDs. IDs without a known affiliation, or without the names
+// for it, are left out
+func GetAffiliations(ctx context.Context, ids ...int32) (
+	[]*Affiliation,
+	error,
+) {
+	affiliations := []*Affiliation{}
+	if len(ids) < 1 {
+		return affiliations, nil
+	}
+
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtGetAffiliations,
+		map[string]interface{}{"ids": pq.Array(ids)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &affiliationRow{} })
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range res {
+		affiliations = append(affiliations, i.(*affiliationRow).toAffiliation())
+	}
+	return affiliations, nil
+}
+
+// UpdateAffiliation sets the corporation and alliance of a known character,
+// returning true if they had changed
+func UpdateAffiliation(ctx context.Context, aff *Affiliation) (bool, error) {
+	values := map[string]interface{}{
+		"character_id":   aff.Corporation.ID,
+		"corporation_id": aff.Corporation.ID,
+		"alliance_id":    int32(0),
+	}
+	if aff.Character != nil {
+		values["character_id"] = aff.Character.ID
+	}
+	if aff.Alliance != nil {
+		values["alliance_id"] = aff.Alliance.ID
+	}
+
+	updated, err := executeNamedCount(ctx, cx.StmtUpdateAffiliation, values)
+	return updated > 0, err
+}
+
 func newName(ctx context.Context, id int32, name string) error {
 	return executeNamed(
 		ctx,
@@ -80,21 +223,68 @@ func updateName(ctx context.Context, id int32, name string) error {
 	)
 }
 
-// GetNames returns the names for the IDs from the db
+// GetNames returns the names for the IDs from the db, in one query. IDs
+// without a known name are left out
 func GetNames(ctx context.Context, ids ...int32) (map[int32]string, error) {
 	names := map[int32]string{}
+	if len(ids) < 1 {
+		return names, nil
+	}
 
-	for _, id := range ids {
-		name, err := GetName(ctx, id)
-		if err != nil {
-			return nil, err
-		}
-		names[id] = name
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtGetNames,
+		map[string]interface{}{"ids": pq.Array(ids)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &Name{} })
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range res {
+		name := i.(*Name)
+		names[name.ID] = name.Name
 	}
 
 	return names, nil
 }
 
+// GetNameHistory returns the previous names of the IDs, oldest first
+func GetNameHistory(ctx context.Context, ids ...int32) (
+	map[int32][]*NameChange,
+	error,
+) {
+	history := map[int32][]*NameChange{}
+	if len(ids) < 1 {
+		return history, nil
+	}
+
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtGetNameHistory,
+		map[string]interface{}{"ids": pq.Array(ids)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &NameChange{} })
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range res {
+		change := i.(*NameChange)
+		history[change.ID] = append(history[change.ID], change)
+	}
+
+	return history, nil
+}
+
 // GetName returns the name for a single character ID from the DB
 func GetName(ctx context.Context, id int32) (string, error) {
 	name := &Name{}
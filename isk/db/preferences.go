@@ -8,6 +8,7 @@ import (
 	"regexp"
 
 	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/lib/pq"
 )
 
 const (
@@ -17,6 +18,9 @@ const (
 	// DefaultContractRow is used if the user has not set a contract row pattern
 	DefaultContractRow = "%CHARACTER% just contracted %ITEMS% items worth" +
 		" %AMOUNT% ISK!"
+
+	// DefaultTopRow is used if the user has not set a top donors row pattern
+	DefaultTopRow = "%RANK%. %CHARACTER% - %AMOUNT% ISK"
 )
 
 var (
@@ -27,8 +31,10 @@ var (
 // Preferences exports Prefs for donations, contracts, or both
 // NB: the JSON form of this is only used for the combined view
 type Preferences struct {
-	Donations *Prefs `json:"donations"`
-	Contracts *Prefs `json:"contracts"`
+	Donations *Prefs       `json:"donations"`
+	Contracts *Prefs       `json:"contracts"`
+	Top       *Prefs       `json:"top,omitempty"`
+	Token     *TokenStatus `json:"token,omitempty"`
 }
 
 // Prefs exports preferences for either donations or contracts
@@ -40,6 +46,13 @@ type Prefs struct {
 	Rows       int     `json:"rows"`
 	MaxAge     int     `json:"max_age,omitempty"` // seconds
 	Minimum    float64 `json:"minimum"`
+
+	// Window is the days of gifts totalled by the top donors view, 0 for all.
+	// It's left unchanged when not set
+	Window *int `json:"window,omitempty"`
+
+	// Token is only set when writing, for the logged in character
+	Token *TokenStatus `json:"token,omitempty"`
 }
 
 type dbPreferences struct {
@@ -67,6 +80,15 @@ type dbPreferences struct {
 	DonationPassphrase      sql.NullString `db:"donation_passphrase"`
 	ContractPassphrase      sql.NullString `db:"contract_passphrase"`
 	CombinedPassphrase      sql.NullString `db:"combined_passphrase"`
+	TopRows                 int32          `db:"top_rows"`
+	TopWindow               int32          `db:"top_window"`
+	TopMinimum              float64        `db:"top_min"`
+	TopHeader               sql.NullString `db:"top_header"`
+	TopFooter               sql.NullString `db:"top_footer"`
+	TopPattern              sql.NullString `db:"top_pattern"`
+	TopPassphrase           sql.NullString `db:"top_passphrase"`
+	RefTypes                pq.StringArray `db:"ref_types"`
+	PriceSource             string         `db:"price_source"`
 }
 
 // UserError can bubble up http errors to the api package
@@ -150,6 +172,20 @@ func (p *dbPreferences) toPreferences(ctx context.Context, t string) (
 			},
 		}, nil
 
+	case "t":
+		window := int(p.TopWindow)
+		return &Preferences{
+			Top: &Prefs{
+				Header:     p.TopHeader.String,
+				Footer:     p.TopFooter.String,
+				Pattern:    getPattern(p.TopPattern, DefaultTopRow),
+				Rows:       getRows(ctx, p.TopRows),
+				Minimum:    p.TopMinimum,
+				Passphrase: p.TopPassphrase.String,
+				Window:     &window,
+			},
+		}, nil
+
 	default:
 		return nil, UserError{
 			Msg:  []byte("Unknown preference type"),
@@ -204,10 +240,36 @@ func dbPrefs(ctx context.Context, charID int32) (*dbPreferences, error) {
 	}
 }
 
+// CreatePreferences creates the default preferences row, if it's missing
+func CreatePreferences(ctx context.Context, charID int32) error {
+	return executeNamed(ctx, cx.StmtCreatePreferences, map[string]interface{}{
+		"character_id": charID,
+	})
+}
+
+// CreateRefTypePreferences creates a preferences row counting the ref types
+// as donations. Existing preferences, and the ref types chosen, are kept
+func CreateRefTypePreferences(
+	ctx context.Context,
+	charID int32,
+	refTypes []string,
+) error {
+	return executeNamed(
+		ctx,
+		cx.StmtCreateRefTypePreferences,
+		map[string]interface{}{
+			"character_id": charID,
+			"ref_types":    pq.StringArray(refTypes),
+		},
+	)
+}
+
 // SetPreferences sets the Preferences for the logged in user
 func SetPreferences(ctx context.Context, charID int32, p *Preferences) error {
 	if p.Contracts != nil && p.Donations != nil {
 		return setPreferences(ctx, charID, p)
+	} else if p.Top != nil {
+		return setPrefs(ctx, charID, p.Top, cx.StmtSetTopPreferences)
 	} else if p.Contracts != nil {
 		return setPrefs(ctx, charID, p.Contracts, cx.StmtSetContractPreferences)
 	} else {
@@ -247,6 +309,7 @@ func setPrefs(ctx context.Context, charID int32, p *Prefs, key cx.Key) error {
 			"rows":         p.Rows,
 			"minimum":      p.Minimum,
 			"max_age":      p.MaxAge,
+			"window":       p.Window,
 			"passphrase":   p.Passphrase,
 		},
 	)
@@ -266,6 +329,13 @@ func (p *Prefs) Sanity(ctx context.Context) error {
 		}
 	}
 
+	if p.Window != nil && *p.Window != 0 && *p.Window != 7 && *p.Window != 30 {
+		return UserError{
+			Msg:  []byte("Window must be 7, 30 or 0 days"),
+			Code: 400,
+		}
+	}
+
 	return nil
 }
 
@@ -1,8 +1,12 @@
 package db
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"testing"
+
+	"github.com/a-tal/esi-isk/isk/cx"
 )
 
 func TestGetPattern(t *testing.T) {
@@ -53,3 +57,36 @@ func TestGetPattern(t *testing.T) {
 		t.Errorf("invalid pattern. received %q, expected %q", p4, s5.String)
 	}
 }
+
+func TestPrefsWindow(t *testing.T) {
+	ctx := context.WithValue(context.Background(), cx.Opts, &cx.Options{
+		MaxPrefLen:    100,
+		MaxPatternLen: 100,
+		MaxPrefRows:   10,
+	})
+
+	p := &Prefs{}
+	if err := json.Unmarshal([]byte(`{"rows": 5}`), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Window != nil {
+		t.Errorf("expected an absent window to be left unset, got %d", *p.Window)
+	}
+	if err := p.Sanity(ctx); err != nil {
+		t.Errorf("expected an absent window to be valid: %v", err)
+	}
+
+	p = &Prefs{}
+	if err := json.Unmarshal([]byte(`{"window": 0}`), p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Window == nil || *p.Window != 0 {
+		t.Errorf("expected an all time window to be set, got %v", p.Window)
+	}
+
+	window := 14
+	p = &Prefs{Window: &window}
+	if err := p.Sanity(ctx); err == nil {
+		t.Errorf("expected a 14 day window to be invalid")
+	}
+}
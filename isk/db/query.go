@@ -16,6 +16,181 @@ func GetStatements(ctx context.Context) map[cx.Key]*sqlx.NamedStmt {
 	opts := ctx.Value(cx.Opts).(*cx.Options)
 	statements := map[cx.Key]*sqlx.NamedStmt{}
 
+	// totals sums each character's donations and accepted contracts, all
+	// time and over the last 30 days. Ingestion totals the same way, in
+	// addGift: a contract counts once accepted, at its stored value, when
+	// it was issued. Pruned rows are counted from prunedTotals
+	totals := `WITH events AS (
+    SELECT donator, receiver, amount AS value, "timestamp" AS at
+    FROM donations
+    UNION ALL
+    SELECT donator, receiver, value, issued AS at
+    FROM contracts WHERE accepted
+), received AS (
+    SELECT receiver AS character_id, COUNT(*) AS total, SUM(value) AS isk,
+    COUNT(*) FILTER (WHERE at > NOW() - INTERVAL '30 days') AS total_30,
+    SUM(value) FILTER (WHERE at > NOW() - INTERVAL '30 days') AS isk_30,
+    MAX(at) AS last
+    FROM events GROUP BY receiver
+), donated AS (
+    SELECT donator AS character_id, COUNT(*) AS total, SUM(value) AS isk,
+    COUNT(*) FILTER (WHERE at > NOW() - INTERVAL '30 days') AS total_30,
+    SUM(value) FILTER (WHERE at > NOW() - INTERVAL '30 days') AS isk_30,
+    MAX(at) AS last
+    FROM events GROUP BY donator
+), totals AS (
+    SELECT
+    characters.character_id,
+    COALESCE(received.total, 0) + COALESCE(pruned.received, 0)
+        AS received,
+    COALESCE(received.isk, 0) + COALESCE(pruned.received_isk, 0)
+        AS received_isk,
+    COALESCE(received.total_30, 0) AS received_30,
+    COALESCE(received.isk_30, 0) AS received_isk_30,
+    COALESCE(donated.total, 0) + COALESCE(pruned.donated, 0) AS donated,
+    COALESCE(donated.isk, 0) + COALESCE(pruned.donated_isk, 0)
+        AS donated_isk,
+    COALESCE(donated.total_30, 0) AS donated_30,
+    COALESCE(donated.isk_30, 0) AS donated_isk_30,
+    GREATEST(donated.last, pruned.last_donated) AS last_donated,
+    GREATEST(received.last, pruned.last_received) AS last_received
+    FROM characters
+    LEFT JOIN received ON received.character_id = characters.character_id
+    LEFT JOIN donated ON donated.character_id = characters.character_id
+    LEFT JOIN prunedTotals pruned
+    ON pruned.character_id = characters.character_id
+) `
+
+	// prune follows a removed CTE, which deletes donations or contracts
+	// returning their donator, receiver, value, at and accepted, adding
+	// the accepted rows to prunedTotals in the same statement
+	prune := `, moved AS (
+    SELECT receiver AS character_id, 1 AS received, value AS received_isk,
+    0 AS donated, CAST(0 AS DOUBLE PRECISION) AS donated_isk,
+    at AS last_received, CAST(NULL AS TIMESTAMP) AS last_donated
+    FROM removed WHERE accepted
+    UNION ALL
+    SELECT donator, 0, 0, 1, value, NULL, at
+    FROM removed WHERE accepted
+)
+INSERT INTO prunedTotals (
+    character_id,
+    received,
+    received_isk,
+    donated,
+    donated_isk,
+    last_received,
+    last_donated
+)
+SELECT character_id, SUM(received), SUM(received_isk), SUM(donated),
+SUM(donated_isk), MAX(last_received), MAX(last_donated)
+FROM moved GROUP BY character_id
+ON CONFLICT (character_id) DO UPDATE SET
+    received = prunedTotals.received + EXCLUDED.received,
+    received_isk = prunedTotals.received_isk + EXCLUDED.received_isk,
+    donated = prunedTotals.donated + EXCLUDED.donated,
+    donated_isk = prunedTotals.donated_isk + EXCLUDED.donated_isk,
+    last_received = GREATEST(
+        prunedTotals.last_received,
+        EXCLUDED.last_received
+    ),
+    last_donated = GREATEST(
+        prunedTotals.last_donated,
+        EXCLUDED.last_donated
+    )`
+
+	// windows sums each character's donations and accepted contracts over
+	// the last 30 days only, the same as totals, so the hourly refresh only
+	// reads recent rows (by the donations_timestamp and contracts_issued
+	// indexes) however much history is kept
+	windows := `WITH recent AS (
+    SELECT donator, receiver, amount AS value
+    FROM donations WHERE "timestamp" > NOW() - INTERVAL '30 days'
+    UNION ALL
+    SELECT donator, receiver, value
+    FROM contracts WHERE issued > NOW() - INTERVAL '30 days' AND accepted
+), received AS (
+    SELECT receiver AS character_id, COUNT(*) AS total, SUM(value) AS isk
+    FROM recent GROUP BY receiver
+), donated AS (
+    SELECT donator AS character_id, COUNT(*) AS total, SUM(value) AS isk
+    FROM recent GROUP BY donator
+), windows AS (
+    SELECT
+    characters.character_id,
+    COALESCE(received.total, 0) AS received_30,
+    COALESCE(received.isk, 0) AS received_isk_30,
+    COALESCE(donated.total, 0) AS donated_30,
+    COALESCE(donated.isk, 0) AS donated_isk_30
+    FROM characters
+    LEFT JOIN received ON received.character_id = characters.character_id
+    LEFT JOIN donated ON donated.character_id = characters.character_id
+) `
+
+	// history pages through the donations and contracts where the character
+	// is in column, newest first, optionally filtered
+	history := func(column, other string) string {
+		return fmt.Sprintf(`SELECT * FROM (
+    SELECT 'donation' AS type, transaction_id AS id, donator, receiver,
+    "timestamp" AS at, amount AS value, note, TRUE AS accepted
+    FROM donations WHERE %[1]s = :character_id
+    UNION ALL
+    SELECT 'contract' AS type, CAST(contract_id AS BIGINT) AS id, donator,
+    receiver, issued AS at, value, note, accepted
+    FROM contracts WHERE %[1]s = :character_id
+) AS history
+WHERE (CAST(:type AS TEXT) = '' OR type = CAST(:type AS TEXT))
+AND (CAST(:since AS TIMESTAMP) IS NULL OR at >= CAST(:since AS TIMESTAMP))
+AND (CAST(:until AS TIMESTAMP) IS NULL OR at < CAST(:until AS TIMESTAMP))
+AND value >= CAST(:minimum AS DOUBLE PRECISION)
+AND (CAST(:counterparty AS INTEGER) = 0
+    OR %[2]s = CAST(:counterparty AS INTEGER))
+AND (CAST(:note AS TEXT) = ''
+    OR strpos(lower(note), lower(CAST(:note AS TEXT))) > 0)
+AND (CAST(:cursor_at AS TIMESTAMP) IS NULL OR (at, type, id) < (
+    CAST(:cursor_at AS TIMESTAMP),
+    CAST(:cursor_type AS TEXT),
+    CAST(:cursor_id AS BIGINT)
+))
+ORDER BY at DESC, type DESC, id DESC
+LIMIT :limit`, column, other)
+	}
+
+	// topGroups sums the donations and accepted contracts by the current
+	// corporation or alliance of the character in column, counting only
+	// characters in good standing as the other leaderboards do, optionally
+	// limited to the members of one alliance
+	topGroups := func(group, column string) string {
+		return fmt.Sprintf(`WITH events AS (
+    SELECT donator, receiver, amount AS value, "timestamp" AS at
+    FROM donations
+    UNION ALL
+    SELECT donator, receiver, value, issued AS at
+    FROM contracts WHERE accepted
+)
+SELECT
+    characters.%[1]s AS group_id,
+    COUNT(DISTINCT characters.character_id) AS characters,
+    COUNT(*) AS gifts,
+    SUM(events.value) AS isk,
+    MAX(events.at) AS last
+FROM events
+JOIN characters ON characters.character_id = events.%[2]s
+    AND characters.good_standing
+WHERE characters.%[1]s > 0
+AND (
+    CAST(:days AS INTEGER) = 0
+    OR events.at > NOW() - CAST(:days AS INTEGER) * INTERVAL '1 day'
+)
+AND (
+    CAST(:alliance_id AS INTEGER) = 0
+    OR characters.alliance_id = CAST(:alliance_id AS INTEGER)
+)
+GROUP BY characters.%[1]s
+ORDER BY isk DESC, group_id
+LIMIT :limit`, group, column)
+	}
+
 	queries := map[cx.Key]string{
 		cx.StmtTopReceived: `SELECT * FROM characters WHERE good_standing
 ORDER BY received_isk_30 DESC LIMIT 6`,
@@ -23,23 +198,70 @@ ORDER BY received_isk_30 DESC LIMIT 6`,
 		cx.StmtTopDonated: `SELECT * FROM characters WHERE good_standing
 ORDER BY donated_isk_30 DESC LIMIT 6`,
 
+		cx.StmtTopCorporationsReceived: topGroups("corporation_id", "receiver"),
+		cx.StmtTopCorporationsDonated:  topGroups("corporation_id", "donator"),
+		cx.StmtTopAlliancesReceived:    topGroups("alliance_id", "receiver"),
+		cx.StmtTopAlliancesDonated:     topGroups("alliance_id", "donator"),
+
 		cx.StmtCharDetails: `SELECT * FROM characters
 WHERE character_id = :character_id LIMIT 1`,
 
 		// ISK IN
 		cx.StmtCharDonations: `SELECT * FROM donations
-WHERE receiver = :character_id`,
-		cx.StmtCharContracts: `SELECT * FROM contracts
-WHERE receiver = :character_id`,
+WHERE receiver = :character_id
+AND "timestamp" > NOW() - INTERVAL '30 days'`,
+		cx.StmtCharContracts: `SELECT contracts.*,
+    COALESCE(locations.name, '') AS location_name,
+    COALESCE(locations.system_name, '') AS system_name
+FROM contracts
+LEFT JOIN locations ON locations.id = contracts.location
+WHERE receiver = :character_id
+AND issued > NOW() - INTERVAL '30 days'`,
 
 		// ISK OUT
 		cx.StmtCharDonated: `SELECT * FROM donations
-WHERE donator = :character_id`,
-		cx.StmtCharContracted: `SELECT * FROM contracts
-WHERE donator = :character_id`,
-
-		cx.StmtContractItems: `SELECT * FROM contractItems
-WHERE contract_id = :contract_id LIMIT 1`,
+WHERE donator = :character_id
+AND "timestamp" > NOW() - INTERVAL '30 days'`,
+		cx.StmtCharContracted: `SELECT contracts.*,
+    COALESCE(locations.name, '') AS location_name,
+    COALESCE(locations.system_name, '') AS system_name
+FROM contracts
+LEFT JOIN locations ON locations.id = contracts.location
+WHERE donator = :character_id
+AND issued > NOW() - INTERVAL '30 days'`,
+
+		// HISTORY
+		cx.StmtHistoryIn:  history("receiver", "donator"),
+		cx.StmtHistoryOut: history("donator", "receiver"),
+
+		cx.StmtTopDonors: `WITH gifts AS (
+    SELECT 'donation' AS kind, donator, amount AS value, "timestamp" AS at
+    FROM donations WHERE receiver = :character_id
+    UNION ALL
+    SELECT 'contract' AS kind, donator, value, issued AS at
+    FROM contracts WHERE receiver = :character_id AND accepted
+)
+SELECT
+    donator AS character_id,
+    COUNT(*) AS gifts,
+    COALESCE(SUM(value) FILTER (WHERE kind = 'donation'), 0) AS donated_isk,
+    COALESCE(SUM(value) FILTER (WHERE kind = 'contract'), 0) AS contracted_isk,
+    SUM(value) AS total_isk,
+    MAX(at) AS last
+FROM gifts
+WHERE CAST(:days AS INTEGER) = 0
+OR at > NOW() - CAST(:days AS INTEGER) * INTERVAL '1 day'
+GROUP BY donator
+HAVING SUM(value) >= CAST(:minimum AS DOUBLE PRECISION)
+ORDER BY total_isk DESC, donator
+LIMIT :limit`,
+
+		cx.StmtContractItems: `SELECT contractItems.*,
+    COALESCE(types.name, '') AS name
+FROM contractItems
+LEFT JOIN types ON types.id = contractItems.type_id
+WHERE contract_id = :contract_id
+ORDER BY contractItems.id`,
 
 		// USERS - user is a character w/ a token
 		cx.StmtCreateUser: `INSERT INTO users (
@@ -47,35 +269,117 @@ WHERE contract_id = :contract_id LIMIT 1`,
     refresh_token,
     access_token,
     access_expires,
-    owner_hash
+    owner_hash,
+    corporation_mode,
+    token_hash,
+    scopes
 ) VALUES (
     :character_id,
     :refresh_token,
     :access_token,
     :access_expires,
-    :owner_hash
+    :owner_hash,
+    :corporation_mode,
+    :token_hash,
+    :scopes
 )`,
 
 		cx.StmtGetUser: `SELECT * FROM users
 WHERE character_id = :character_id LIMIT 1`,
 
-		cx.StmtGetUsers: `SELECT * FROM users
-WHERE last_processed < NOW() - INTERVAL '1 hour' LIMIT 100`,
-
-		cx.StmtGetNullUsers: `SELECT * FROM users
-WHERE last_processed IS NULL LIMIT 100`,
+		cx.StmtClaimUsers: `UPDATE users SET
+    claimed_by = :worker_id,
+    claimed_until = NOW() + CAST(:lease AS INTEGER) * INTERVAL '1 second'
+WHERE character_id IN (
+    SELECT character_id FROM users
+    WHERE (next_poll_at IS NULL OR next_poll_at <= NOW())
+    AND (claimed_until IS NULL OR claimed_until < NOW())
+    AND token_state IN ('valid', 'failing')
+    ORDER BY next_poll_at ASC NULLS FIRST LIMIT :limit
+    FOR UPDATE SKIP LOCKED
+) RETURNING *`,
+
+		cx.StmtRenewClaim: `UPDATE users SET
+    claimed_until = NOW() + CAST(:lease AS INTEGER) * INTERVAL '1 second'
+WHERE character_id = :character_id
+AND claimed_by = :worker_id
+AND claimed_until > NOW()`,
+
+		cx.StmtReleaseUser: `UPDATE users SET
+    claimed_by = NULL,
+    claimed_until = NULL
+WHERE character_id = :character_id AND claimed_by = :worker_id`,
+
+		cx.StmtNextPoll: `SELECT MIN(GREATEST(next_poll_at, claimed_until, NOW()))
+    AS next_poll_at
+FROM users WHERE token_state IN ('valid', 'failing')`,
+
+		cx.StmtDeferUser: `UPDATE users SET next_poll_at = :next_poll_at
+WHERE character_id = :character_id`,
 
 		cx.StmtUpdateUser: `UPDATE users SET
     refresh_token = :refresh_token,
     access_token = :access_token,
     access_expires = :access_expires,
+    token_hash = :token_hash,
     character_id = :character_id,
     owner_hash = :owner_hash,
     last_journal_id = :last_journal_id,
     last_contract_id = :last_contract_id,
+    corporation_mode = :corporation_mode,
+    corporation_id = :corporation_id,
+    scopes = :scopes,
+    next_poll_at = :next_poll_at,
+    idle_polls = :idle_polls,
+    refresh_failures = 0,
+    token_state = 'valid',
     last_processed = NOW()
 WHERE character_id = :character_id`,
 
+		// only what a pull changes is saved, and only while the user still
+		// has the same token, so a sign in during the pull is kept
+		cx.StmtSaveProgress: `UPDATE users SET
+    last_journal_id = :last_journal_id,
+    last_contract_id = :last_contract_id,
+    corporation_id = :corporation_id,
+    next_poll_at = :next_poll_at,
+    idle_polls = :idle_polls,
+    refresh_failures = 0,
+    token_state = 'valid',
+    last_processed = NOW()
+WHERE token_hash = :previous_hash
+OR (token_hash IS NULL AND character_id = :character_id)`,
+
+		cx.StmtGetAllUsers: `SELECT * FROM users`,
+
+		// tokens are found by the keyed hash of the one they replace, so a
+		// token from a newer sign in isn't overwritten. Rows from before
+		// encryption have no hash until they're re-encrypted
+		cx.StmtUpdateTokens: `UPDATE users SET
+    refresh_token = :refresh_token,
+    access_token = :access_token,
+    access_expires = :access_expires,
+    token_hash = :token_hash
+WHERE token_hash = :previous_hash
+OR (token_hash IS NULL AND character_id = :character_id)`,
+
+		cx.StmtSetTokenState: `UPDATE users SET
+    refresh_failures = :refresh_failures,
+    token_state = :token_state,
+    next_poll_at = NOW() + INTERVAL '1 hour',
+    last_processed = NOW()
+WHERE token_hash = :token_hash`,
+
+		cx.StmtDeleteUserToken: `DELETE FROM users WHERE token_hash = :token_hash`,
+
+		cx.StmtClaimMaintenance: `INSERT INTO maintenance (name, last_run)
+VALUES (:name, NOW())
+ON CONFLICT (name) DO UPDATE SET last_run = NOW()
+WHERE maintenance.last_run < NOW() - CAST(:every AS INTEGER) * INTERVAL '1 second'
+RETURNING name`,
+
+		cx.StmtSaveLock: `SELECT pg_advisory_xact_lock(:lock_id)`,
+
 		cx.StmtDeleteUser: `DELETE FROM users WHERE character_id = :character_id`,
 
 		cx.StmtAddDonation: `INSERT INTO donations (
@@ -84,21 +388,65 @@ WHERE character_id = :character_id`,
     receiver,
     "timestamp",
     note,
-    amount
+    amount,
+    ref_type
 ) VALUES (
     :transaction_id,
     :donator,
     :receiver,
     :timestamp,
     :note,
-    :amount
-)`,
+    :amount,
+    :ref_type
+) ON CONFLICT (transaction_id) DO NOTHING`,
 
 		cx.StmtNewName: `INSERT INTO names (id, name) VALUES (:id, :name)`,
 
-		cx.StmtUpdateName: `UPDATE names SET name = :name WHERE id = :id`,
-
-		cx.StmtGetName: `SELECT * FROM names WHERE id = :id LIMIT 1`,
+		cx.StmtUpdateName: `WITH previous AS (
+    INSERT INTO name_history (id, name)
+    SELECT id, name FROM names WHERE id = :id AND name <> :name
+)
+UPDATE names SET name = :name, updated = NOW() WHERE id = :id`,
+
+		cx.StmtGetName: `SELECT id, name FROM names WHERE id = :id LIMIT 1`,
+
+		cx.StmtGetNames: `SELECT id, name FROM names
+WHERE id = ANY(CAST(:ids AS INTEGER[]))`,
+
+		cx.StmtGetNameHistory: `SELECT id, name, replaced FROM name_history
+WHERE id = ANY(CAST(:ids AS INTEGER[]))
+ORDER BY id, replaced`,
+
+		cx.StmtGetStaleNames: `SELECT id FROM names
+WHERE updated < NOW() - CAST(:days AS INTEGER) * INTERVAL '1 day'
+ORDER BY updated LIMIT :limit`,
+
+		cx.StmtTouchNames: `UPDATE names SET updated = NOW()
+WHERE id = ANY(CAST(:ids AS INTEGER[]))`,
+
+		cx.StmtGetAffiliations: `SELECT
+    characters.character_id,
+    characters.corporation_id,
+    characters.alliance_id,
+    character_names.name AS character_name,
+    corporation_names.name AS corporation_name,
+    COALESCE(alliance_names.name, '') AS alliance_name
+FROM characters
+JOIN names character_names
+    ON character_names.id = characters.character_id
+JOIN names corporation_names
+    ON corporation_names.id = characters.corporation_id
+LEFT JOIN names alliance_names
+    ON alliance_names.id = characters.alliance_id
+WHERE characters.character_id = ANY(CAST(:ids AS INTEGER[]))
+AND characters.corporation_id > 0
+AND (characters.alliance_id = 0 OR alliance_names.id IS NOT NULL)`,
+
+		cx.StmtUpdateAffiliation: `UPDATE characters SET
+    corporation_id = :corporation_id,
+    alliance_id = :alliance_id
+WHERE character_id = :character_id
+AND (corporation_id <> :corporation_id OR alliance_id <> :alliance_id)`,
 
 		cx.StmtCreateCharacter: `INSERT INTO characters (
     character_id,
@@ -148,6 +496,23 @@ WHERE character_id = :character_id`,
     good_standing = :good_standing
 WHERE character_id = :character_id`,
 
+		cx.StmtGetAllCharacters: `SELECT * FROM characters`,
+
+		cx.StmtCharacterSources: totals + `SELECT * FROM totals`,
+
+		cx.StmtRefreshWindows: windows + `UPDATE characters SET
+    received_30 = windows.received_30,
+    received_isk_30 = windows.received_isk_30,
+    donated_30 = windows.donated_30,
+    donated_isk_30 = windows.donated_isk_30
+FROM windows
+WHERE windows.character_id = characters.character_id AND (
+    characters.received_30 <> windows.received_30
+    OR characters.donated_30 <> windows.donated_30
+    OR ABS(characters.received_isk_30 - windows.received_isk_30) > 0.01
+    OR ABS(characters.donated_isk_30 - windows.donated_isk_30) > 0.01
+)`,
+
 		cx.StmtAddContract: `INSERT INTO contracts (
     contract_id,
     donator,
@@ -157,7 +522,8 @@ WHERE character_id = :character_id`,
     expires,
     accepted,
     value,
-    note
+    note,
+    price_source
 ) VALUES (
     :contract_id,
     :donator,
@@ -167,25 +533,35 @@ WHERE character_id = :character_id`,
     :expires,
     :accepted,
     :value,
-    :note
-)`,
+    :note,
+    :price_source
+) ON CONFLICT (contract_id) DO NOTHING`,
 
 		cx.StmtAddContractItems: `INSERT INTO contractItems (
     id,
     contract_id,
     type_id,
     item_id,
-    quantity
+    quantity,
+    price
 ) VALUES (
     :id,
     :contract_id,
     :type_id,
     :item_id,
-    :quantity
-)`,
-
-		cx.StmtCharStandingISK: fmt.Sprintf(
-			"SELECT * FROM donations WHERE receiver = %d AND donator = :character_id",
+    :quantity,
+    :price
+) ON CONFLICT (id) DO NOTHING`,
+
+		// standing is 1% of the ISK received in the last 30 days donated to
+		// us, set in one statement so totals saved meanwhile aren't lost
+		cx.StmtUpdateStanding: fmt.Sprintf(`UPDATE characters SET
+    good_standing = COALESCE((
+        SELECT SUM(amount) FROM donations
+        WHERE receiver = %d AND donator = characters.character_id
+        AND "timestamp" > NOW() - INTERVAL '30 days'
+    ), 0) > characters.received_isk_30 * 0.01
+WHERE character_id = :character_id`,
 			opts.CharacterID,
 		),
 
@@ -193,7 +569,15 @@ WHERE character_id = :character_id`,
     character_id
 ) VALUES (
     :character_id
-)`,
+) ON CONFLICT (character_id) DO NOTHING`,
+
+		cx.StmtCreateRefTypePreferences: `INSERT INTO preferences (
+    character_id,
+    ref_types
+) VALUES (
+    :character_id,
+    :ref_types
+) ON CONFLICT (character_id) DO NOTHING`,
 
 		cx.StmtGetPreferences: `SELECT * FROM preferences
 WHERE character_id = :character_id LIMIT 1`,
@@ -218,12 +602,25 @@ WHERE character_id = :character_id`,
     contract_passphrase = :passphrase
 WHERE character_id = :character_id`,
 
+		cx.StmtSetTopPreferences: `UPDATE preferences SET
+    top_rows = :rows,
+    top_window = COALESCE(CAST(:window AS INTEGER), top_window),
+    top_min = :minimum,
+    top_header = :header,
+    top_footer = :footer,
+    top_pattern = :pattern,
+    top_passphrase = :passphrase
+WHERE character_id = :character_id`,
+
 		cx.StmtGetOutstandingContracts: `SELECT * FROM contracts
-WHERE accepted = false AND receiver = :character_id LIMIT 100`,
+WHERE accepted = false AND receiver = :character_id
+AND issued > NOW() - INTERVAL '30 days' LIMIT 100`,
 
 		cx.StmtAcceptContract: `UPDATE contracts SET
     accepted = true
-WHERE contract_id = :contract_id AND receiver = :character_id`,
+WHERE contract_id = :contract_id AND receiver = :character_id
+AND accepted = false
+RETURNING *`,
 
 		cx.StmtSetCombinedPreferences: `UPDATE preferences SET
     combined_rows = :rows,
@@ -238,19 +635,129 @@ WHERE contract_id = :contract_id AND receiver = :character_id`,
 WHERE character_id = :character_id`,
 
 		cx.StmtGetStaleContracts: `SELECT * FROM contracts
-WHERE issued < NOW() - INTERVAL '30 days' LIMIT 100`,
+WHERE issued < NOW() - CAST(:days AS INTEGER) * INTERVAL '1 day' LIMIT 100`,
 
 		cx.StmtGetStaleDonations: `SELECT * FROM donations
-WHERE "timestamp" < NOW() - INTERVAL '30 days' LIMIT 100`,
+WHERE "timestamp" < NOW() - CAST(:days AS INTEGER) * INTERVAL '1 day'
+LIMIT 100`,
 
-		cx.StmtRemoveContract: `DELETE FROM contracts
-WHERE contract_id = :contract_id`,
+		cx.StmtRemoveContract: `WITH removed AS (
+    DELETE FROM contracts WHERE contract_id = :contract_id
+    RETURNING donator, receiver, value, issued AS at, accepted
+)` + prune,
 
 		cx.StmtRemoveContractItems: `DELETE FROM contractItems
 WHERE contract_id = :contract_id`,
 
-		cx.StmtRemoveDonation: `DELETE FROM donations
-WHERE transaction_id = :transaction_id`,
+		cx.StmtRemoveDonation: `WITH removed AS (
+    DELETE FROM donations WHERE transaction_id = :transaction_id
+    RETURNING donator, receiver, amount AS value, "timestamp" AS at,
+    TRUE AS accepted
+)` + prune,
+
+		cx.StmtSetRefTypes: `UPDATE preferences SET
+    ref_types = :ref_types
+WHERE character_id = :character_id`,
+
+		cx.StmtSetPriceSource: `UPDATE preferences SET
+    price_source = :price_source
+WHERE character_id = :character_id`,
+
+		// LOCATIONS - inaccessible structures are retried daily
+		cx.StmtGetLocation: `SELECT * FROM locations
+WHERE id = :id AND (name <> '' OR updated > NOW() - INTERVAL '1 day')`,
+
+		cx.StmtSaveLocation: `INSERT INTO locations (
+    id,
+    name,
+    system_id,
+    system_name
+) VALUES (
+    :id,
+    :name,
+    :system_id,
+    :system_name
+) ON CONFLICT (id) DO UPDATE SET
+    name = EXCLUDED.name,
+    system_id = EXCLUDED.system_id,
+    system_name = EXCLUDED.system_name,
+    updated = NOW()`,
+
+		// TYPES
+		cx.StmtGetUnknownTypes: `SELECT DISTINCT id
+FROM unnest(CAST(:type_ids AS INTEGER[])) AS id
+WHERE id NOT IN (SELECT id FROM types)`,
+
+		cx.StmtSaveType: `INSERT INTO types (
+    id,
+    name
+) VALUES (
+    :id,
+    :name
+) ON CONFLICT (id) DO UPDATE SET
+    name = EXCLUDED.name`,
+
+		// CORPORATION WALLETS
+		cx.StmtGetDivisions: `SELECT * FROM corporationDivisions
+WHERE corporation_id = :corporation_id ORDER BY division`,
+
+		cx.StmtAddDivision: `INSERT INTO corporationDivisions (
+    corporation_id,
+    division
+) VALUES (
+    :corporation_id,
+    :division
+) ON CONFLICT (corporation_id, division) DO NOTHING`,
+
+		cx.StmtRemoveDivisions: `DELETE FROM corporationDivisions
+WHERE corporation_id = :corporation_id AND NOT (division = ANY(:divisions))`,
+
+		cx.StmtDefaultDivisions: `INSERT INTO corporationDivisions (
+    corporation_id,
+    division
+) SELECT CAST(:corporation_id AS INTEGER), 1 WHERE NOT EXISTS (
+    SELECT 1 FROM corporationDivisions WHERE corporation_id = :corporation_id
+)`,
+
+		// directors of the same corporation can be pulled at once, the
+		// cursor only ever moves forward
+		cx.StmtUpdateDivision: `UPDATE corporationDivisions SET
+    last_journal_id = GREATEST(
+        last_journal_id,
+        CAST(:last_journal_id AS BIGINT)
+    )
+WHERE corporation_id = :corporation_id AND division = :division`,
+
+		// ESI HTTP CACHE
+		cx.StmtGetCachedResponse: `UPDATE httpcache SET accessed = NOW()
+WHERE cache_key = :cache_key RETURNING value`,
+
+		cx.StmtSetCachedResponse: `INSERT INTO httpcache (
+    cache_key,
+    value,
+    size
+) VALUES (
+    :cache_key,
+    :value,
+    :size
+) ON CONFLICT (cache_key) DO UPDATE SET
+    value = EXCLUDED.value,
+    size = EXCLUDED.size,
+    created = NOW(),
+    accessed = NOW()`,
+
+		cx.StmtDeleteCachedResponse: `DELETE FROM httpcache
+WHERE cache_key = :cache_key`,
+
+		cx.StmtExpireCachedResponses: `DELETE FROM httpcache
+WHERE accessed < NOW() - CAST(:max_age AS INTEGER) * INTERVAL '1 second'`,
+
+		cx.StmtTrimCachedResponses: `DELETE FROM httpcache WHERE cache_key IN (
+    SELECT cache_key FROM (
+        SELECT cache_key, SUM(size) OVER (ORDER BY accessed DESC) AS total
+        FROM httpcache
+    ) AS sized WHERE total > :max_size
+)`,
 	}
 
 	for key, query := range queries {
@@ -0,0 +1,163 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"math"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/lib/pq"
+)
+
+// iskTolerance allows for rounding in sums of ISK values
+const iskTolerance = 0.01
+
+// Drift describes a character whose stored totals disagree with the
+// donations and contracts it was totalled from
+type Drift struct {
+	// Stored are the totals as they were in the characters table
+	Stored *CharacterRow
+
+	// Expected are the stored totals with the drifted fields corrected
+	Expected *CharacterRow
+
+	// Fields are the names of the columns which drifted
+	Fields []string
+}
+
+// String returns a summary of the drifted fields
+func (d *Drift) String() string {
+	return fmt.Sprintf("character %d drifted: %v", d.Stored.ID, d.Fields)
+}
+
+// Reconcile compares every character's totals with their donations and
+// contracts, returning those which drifted. With fix, the drifted totals
+// are corrected
+//
+// The _30 totals are rebuilt from the last 30 days of rows. The all time
+// totals and last_* timestamps are rebuilt from every row, counting pruned
+// rows from the prunedTotals kept when they were removed
+func Reconcile(ctx context.Context, fix bool) ([]*Drift, error) {
+	var drifts []*Drift
+	err := Transaction(ctx, func(ctx context.Context) (err error) {
+		drifts, err = reconcile(ctx, fix)
+		return err
+	})
+	return drifts, err
+}
+
+// RefreshWindows recalculates the 30 day totals of every character from
+// their donations and contracts, returning the number of characters changed
+func RefreshWindows(ctx context.Context) (int64, error) {
+	var changed int64
+	err := Transaction(ctx, func(ctx context.Context) (err error) {
+		changed, err = executeNamedCount(
+			ctx,
+			cx.StmtRefreshWindows,
+			map[string]interface{}{},
+		)
+		return err
+	})
+	return changed, err
+}
+
+func reconcile(ctx context.Context, fix bool) ([]*Drift, error) {
+	stored, err := queryCharacterRows(ctx, cx.StmtGetAllCharacters)
+	if err != nil {
+		return nil, err
+	}
+
+	sources, err := queryCharacterRows(ctx, cx.StmtCharacterSources)
+	if err != nil {
+		return nil, err
+	}
+
+	bySource := map[int32]*CharacterRow{}
+	for _, source := range sources {
+		bySource[source.ID] = source
+	}
+
+	drifts := []*Drift{}
+	for _, char := range stored {
+		source, ok := bySource[char.ID]
+		if !ok {
+			continue
+		}
+
+		expected, fields := compareTotals(char, source)
+		if len(fields) < 1 {
+			continue
+		}
+
+		drift := &Drift{Stored: char, Expected: expected, Fields: fields}
+		drifts = append(drifts, drift)
+
+		if fix {
+			if err := updateCharacter(ctx, expected); err != nil {
+				return drifts, err
+			}
+		}
+	}
+
+	return drifts, nil
+}
+
+func queryCharacterRows(ctx context.Context, key cx.Key) ([]*CharacterRow, error) {
+	rows, err := queryNamedResult(ctx, key, map[string]interface{}{})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &CharacterRow{} })
+	if err != nil {
+		return nil, err
+	}
+
+	chars := []*CharacterRow{}
+	for _, i := range res {
+		chars = append(chars, i.(*CharacterRow))
+	}
+	return chars, nil
+}
+
+// compareTotals returns the stored row with any drifted totals corrected
+// from the source row, and the names of the fields which drifted
+func compareTotals(stored, source *CharacterRow) (*CharacterRow, []string) {
+	expected := *stored
+	fields := []string{}
+
+	exact := func(name string, have *int64, want int64) {
+		if *have != want {
+			*have = want
+			fields = append(fields, name)
+		}
+	}
+	exactISK := func(name string, have *float64, want float64) {
+		if math.Abs(*have-want) > iskTolerance {
+			*have = want
+			fields = append(fields, name)
+		}
+	}
+	exactTime := func(name string, have *pq.NullTime, want pq.NullTime) {
+		if have.Valid != want.Valid ||
+			(want.Valid && !have.Time.Equal(want.Time)) {
+			*have = want
+			fields = append(fields, name)
+		}
+	}
+
+	exact("received_30", &expected.Received30, source.Received30)
+	exactISK("received_isk_30", &expected.ReceivedISK30, source.ReceivedISK30)
+	exact("donated_30", &expected.Donated30, source.Donated30)
+	exactISK("donated_isk_30", &expected.DonatedISK30, source.DonatedISK30)
+
+	exact("received", &expected.Received, source.Received)
+	exactISK("received_isk", &expected.ReceivedISK, source.ReceivedISK)
+	exact("donated", &expected.Donated, source.Donated)
+	exactISK("donated_isk", &expected.DonatedISK, source.DonatedISK)
+
+	exactTime("last_received", &expected.LastReceived, source.LastReceived)
+	exactTime("last_donated", &expected.LastDonated, source.LastDonated)
+
+	return &expected, fields
+}
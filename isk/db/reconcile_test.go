@@ -0,0 +1,118 @@
+package db
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestCompareTotals(t *testing.T) {
+	now := time.Date(2018, 12, 25, 22, 34, 0, 0, time.UTC)
+
+	stored := &CharacterRow{
+		ID:            2114454465,
+		Received:      10,
+		ReceivedISK:   1000,
+		Received30:    3,
+		ReceivedISK30: 300,
+		Donated:       1,
+		DonatedISK:    50,
+		Donated30:     1,
+		DonatedISK30:  50.001,
+		LastReceived:  pq.NullTime{Time: now.Add(-time.Hour), Valid: true},
+		LastDonated:   pq.NullTime{Time: now, Valid: true},
+	}
+
+	// the stored totals counted a donation twice, and missed the last one
+	source := &CharacterRow{
+		ID:            2114454465,
+		Received:      9,
+		ReceivedISK:   900,
+		Received30:    4,
+		ReceivedISK30: 400,
+		Donated:       1,
+		DonatedISK:    50,
+		Donated30:     1,
+		DonatedISK30:  50,
+		LastReceived:  pq.NullTime{Time: now, Valid: true},
+		LastDonated:   pq.NullTime{Time: now.Add(-time.Hour), Valid: true},
+	}
+
+	expected, fields := compareTotals(stored, source)
+
+	wantFields := []string{
+		"received_30",
+		"received_isk_30",
+		"received",
+		"received_isk",
+		"last_received",
+		"last_donated",
+	}
+	if !reflect.DeepEqual(fields, wantFields) {
+		t.Errorf("invalid drifted fields. received %v, expected %v", fields, wantFields)
+	}
+
+	if expected.Received != 9 || expected.ReceivedISK != 900 {
+		t.Errorf("over counted all time totals should be lowered: %+v", expected)
+	}
+	if expected.Received30 != 4 || expected.ReceivedISK30 != 400 {
+		t.Errorf("30 day totals should be rebuilt: %+v", expected)
+	}
+	if !expected.LastReceived.Time.Equal(now) ||
+		!expected.LastDonated.Time.Equal(now.Add(-time.Hour)) {
+		t.Errorf("invalid last timestamps: %+v", expected)
+	}
+	if stored.Received30 != 3 {
+		t.Error("the stored row should not be modified")
+	}
+
+	if _, fields := compareTotals(expected, source); len(fields) > 0 {
+		t.Errorf("expected no drift after fixing, received %v", fields)
+	}
+}
+
+func TestAddContractTotals(t *testing.T) {
+	donator := &CharacterRow{ID: 1}
+	receiver := &CharacterRow{ID: 2}
+	chars := []*CharacterRow{donator, receiver}
+
+	recent := &Contract{
+		Donator:  1,
+		Receiver: 2,
+		Issued:   time.Now().Add(-time.Hour),
+		Accepted: true,
+		Value:    100,
+	}
+	old := &Contract{
+		Donator:  1,
+		Receiver: 2,
+		Issued:   time.Now().Add(-45 * 24 * time.Hour),
+		Accepted: true,
+		Value:    50,
+	}
+	outstanding := &Contract{
+		Donator:  1,
+		Receiver: 2,
+		Issued:   time.Now(),
+		Value:    1000,
+	}
+
+	for _, contract := range []*Contract{recent, old, outstanding} {
+		addToContractTotals(contract, chars)
+	}
+
+	if receiver.Received != 2 || receiver.ReceivedISK != 150 {
+		t.Errorf("invalid all time totals: %+v", receiver)
+	}
+	if receiver.Received30 != 1 || receiver.ReceivedISK30 != 100 {
+		t.Errorf("only recent contracts should be in the 30 day totals: %+v", receiver)
+	}
+	if donator.Donated != 2 || donator.DonatedISK30 != 100 {
+		t.Errorf("invalid donated totals: %+v", donator)
+	}
+	if !receiver.LastReceived.Time.Equal(recent.Issued) {
+		t.Errorf("outstanding contracts should not set the last received time")
+	}
+}
@@ -2,7 +2,9 @@ package db
 
 import (
 	"context"
+	"fmt"
 	"log"
+	"time"
 
 	"github.com/a-tal/esi-isk/isk/cx"
 	"github.com/jmoiron/sqlx"
@@ -61,18 +63,27 @@ func getTop(
 	}
 
 	characters := []*Character{}
+	ids := []int32{}
 	for _, charRow := range chars {
 		char := transform(charRow)
 		if char == nil {
 			continue
 		}
-		name, err := GetName(ctx, char.ID)
-		if err != nil {
+		characters = append(characters, char)
+		ids = append(ids, char.ID)
+	}
+
+	names, err := GetNames(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, char := range characters {
+		name, ok := names[char.ID]
+		if !ok {
 			log.Printf("failed to lookup name for: %d", char.ID)
-		} else {
-			char.Name = name
 		}
-		characters = append(characters, char)
+		char.Name = name
 	}
 
 	return characters, nil
@@ -106,3 +117,171 @@ func scanCharacterRows(rows *sqlx.Rows) ([]*CharacterRow, error) {
 	}
 	return chars, nil
 }
+
+// TopDonor is the total a character has given one recipient
+type TopDonor struct {
+	// ID is the characterID of the donator
+	ID int32 `db:"character_id" json:"id"`
+
+	// Name of the donator, if known
+	Name string `db:"-" json:"name,omitempty"`
+
+	// Gifts is the number of donations and accepted contracts
+	Gifts int64 `db:"gifts" json:"gifts"`
+
+	// DonatedISK is the value of all ISK donated
+	DonatedISK float64 `db:"donated_isk" json:"donated_isk"`
+
+	// ContractedISK is the value of all accepted contracts
+	ContractedISK float64 `db:"contracted_isk" json:"contracted_isk"`
+
+	// TotalISK is the value of both donations and contracts
+	TotalISK float64 `db:"total_isk" json:"total_isk"`
+
+	// Last timestamp of a donation or contract
+	Last time.Time `db:"last" json:"last"`
+}
+
+// GetTopDonors returns who gave the character the most ISK and contract
+// value over the last days, or all time if days is 0
+func GetTopDonors(
+	ctx context.Context,
+	charID int32,
+	days int,
+	minimum float64,
+	limit int,
+) ([]*TopDonor, error) {
+	rows, err := queryNamedResult(ctx, cx.StmtTopDonors, map[string]interface{}{
+		"character_id": charID,
+		"days":         days,
+		"minimum":      minimum,
+		"limit":        limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &TopDonor{} })
+	if err != nil {
+		return nil, err
+	}
+
+	donors := []*TopDonor{}
+	ids := []int32{}
+	for _, i := range res {
+		donor := i.(*TopDonor)
+		donor.DonatedISK = round2(donor.DonatedISK)
+		donor.ContractedISK = round2(donor.ContractedISK)
+		donor.TotalISK = round2(donor.TotalISK)
+		donors = append(donors, donor)
+		ids = append(ids, donor.ID)
+	}
+
+	names, err := GetNames(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, donor := range donors {
+		donor.Name = names[donor.ID]
+	}
+
+	return donors, nil
+}
+
+// TopGroup is the total a corporation or alliance has received or donated
+type TopGroup struct {
+	// ID is the corporation or alliance ID
+	ID int32 `db:"group_id" json:"id"`
+
+	// Name of the corporation or alliance, if known
+	Name string `db:"-" json:"name,omitempty"`
+
+	// Characters is the number of members who received or donated
+	Characters int64 `db:"characters" json:"characters"`
+
+	// Gifts is the number of donations and accepted contracts
+	Gifts int64 `db:"gifts" json:"gifts"`
+
+	// ISK is the value of the donations and contracts
+	ISK float64 `db:"isk" json:"isk"`
+
+	// Last timestamp of a donation or contract
+	Last time.Time `db:"last" json:"last"`
+}
+
+// TopGroupFilter selects a corporation or alliance leaderboard
+type TopGroupFilter struct {
+	// Group is either "corporation" or "alliance"
+	Group string
+
+	// Donated ranks by what the members donated, instead of received
+	Donated bool
+
+	// Days of donations and contracts to total, or 0 for all time
+	Days int
+
+	// AllianceID limits the members to one alliance, or 0 for any
+	AllianceID int32
+
+	// Limit is the most groups to return
+	Limit int
+}
+
+// topGroupStatements are the leaderboard queries by group, then by donated
+var topGroupStatements = map[string]map[bool]cx.Key{
+	"corporation": {
+		false: cx.StmtTopCorporationsReceived,
+		true:  cx.StmtTopCorporationsDonated,
+	},
+	"alliance": {
+		false: cx.StmtTopAlliancesReceived,
+		true:  cx.StmtTopAlliancesDonated,
+	},
+}
+
+// GetTopGroups returns the corporations or alliances whose current members
+// received or donated the most, with their names filled in
+func GetTopGroups(ctx context.Context, filter *TopGroupFilter) (
+	[]*TopGroup,
+	error,
+) {
+	key, ok := topGroupStatements[filter.Group][filter.Donated]
+	if !ok {
+		return nil, fmt.Errorf("unknown group: %s", filter.Group)
+	}
+
+	rows, err := queryNamedResult(ctx, key, map[string]interface{}{
+		"days":        filter.Days,
+		"alliance_id": filter.AllianceID,
+		"limit":       filter.Limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &TopGroup{} })
+	if err != nil {
+		return nil, err
+	}
+
+	groups := []*TopGroup{}
+	ids := []int32{}
+	for _, i := range res {
+		group := i.(*TopGroup)
+		group.ISK = round2(group.ISK)
+		groups = append(groups, group)
+		ids = append(ids, group.ID)
+	}
+
+	names, err := GetNames(ctx, ids...)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		group.Name = names[group.ID]
+	}
+
+	return groups, nil
+}
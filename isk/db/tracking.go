@@ -0,0 +1,207 @@
+package db
+
+import (
+	"context"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/lib/pq"
+)
+
+var (
+	// RefTypes are the wallet journal ref types which can count as donations
+	RefTypes = []string{
+		"player_donation",
+		"player_trading",
+		"contract_reward",
+		"corporation_account_withdrawal",
+	}
+
+	// DefaultRefTypes are counted as donations unless the user picks others
+	DefaultRefTypes = []string{"player_donation"}
+
+	// PriceSources are the ways contract items can be valued
+	PriceSources = []string{"adjusted", "average", "jita_buy", "jita_sell"}
+)
+
+// DefaultPriceSource values contract items unless the user picks another
+const DefaultPriceSource = "adjusted"
+
+// Tracking describes what the worker pulls for a user
+type Tracking struct {
+	// Corporation is true if the user's corporation wallet is tracked
+	Corporation bool `json:"corporation"`
+
+	// CorporationID is the tracked corporation, once known
+	CorporationID int32 `json:"corporation_id,omitempty"`
+
+	// Divisions are the tracked corporation wallet divisions
+	Divisions []int32 `json:"divisions,omitempty"`
+
+	// RefTypes are the wallet journal ref types counted as donations
+	RefTypes []string `json:"ref_types,omitempty"`
+
+	// PriceSource is how contract items are valued
+	PriceSource string `json:"price_source,omitempty"`
+
+	// Scopes are the ESI scopes granted by the user, read only
+	Scopes []string `json:"scopes,omitempty"`
+}
+
+// GetTracking returns the Tracking for the logged in user. The owner is
+// either the same character, or the corporation they are tracking
+func GetTracking(ctx context.Context, charID, owner int32) (*Tracking, error) {
+	user, err := getUser(ctx, charID)
+	if err != nil {
+		return nil, err
+	}
+
+	refTypes, err := GetRefTypes(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	priceSource, err := GetPriceSource(ctx, owner)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tracking{
+		Corporation:   user.CorporationMode,
+		CorporationID: user.CorporationID,
+		Divisions:     []int32{},
+		RefTypes:      refTypes,
+		PriceSource:   priceSource,
+		Scopes:        user.Scopes,
+	}
+
+	if !user.CorporationMode || user.CorporationID < 1 {
+		return t, nil
+	}
+
+	divisions, err := GetDivisions(ctx, user.CorporationID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, division := range divisions {
+		t.Divisions = append(t.Divisions, division.Division)
+	}
+
+	return t, nil
+}
+
+// SetTracking sets the Tracking for the logged in user
+func SetTracking(ctx context.Context, charID, owner int32, t *Tracking) error {
+	if len(t.RefTypes) > 0 {
+		if err := SetRefTypes(ctx, owner, t.RefTypes); err != nil {
+			return err
+		}
+	}
+
+	if t.PriceSource != "" {
+		if err := SetPriceSource(ctx, owner, t.PriceSource); err != nil {
+			return err
+		}
+	}
+
+	if t.Divisions == nil {
+		return nil
+	}
+
+	user, err := getUser(ctx, charID)
+	if err != nil {
+		return err
+	}
+
+	if !user.CorporationMode {
+		return UserError{
+			Msg:  []byte("Sign in with your corporation wallet first"),
+			Code: 400,
+		}
+	}
+
+	if user.CorporationID < 1 {
+		return UserError{
+			Msg:  []byte("Corporation wallet has not been pulled yet"),
+			Code: 400,
+		}
+	}
+
+	return SetDivisions(ctx, user.CorporationID, t.Divisions)
+}
+
+// GetRefTypes returns the journal ref types counted as donations
+func GetRefTypes(ctx context.Context, charID int32) ([]string, error) {
+	p, err := dbPrefs(ctx, charID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(p.RefTypes) < 1 {
+		return DefaultRefTypes, nil
+	}
+
+	return []string(p.RefTypes), nil
+}
+
+// SetRefTypes sets the journal ref types counted as donations
+func SetRefTypes(ctx context.Context, charID int32, refTypes []string) error {
+	return executeNamed(ctx, cx.StmtSetRefTypes, map[string]interface{}{
+		"character_id": charID,
+		"ref_types":    pq.StringArray(refTypes),
+	})
+}
+
+// GetPriceSource returns how contract items donated to the character are valued
+func GetPriceSource(ctx context.Context, charID int32) (string, error) {
+	p, err := dbPrefs(ctx, charID)
+	if err != nil {
+		return "", err
+	}
+
+	if p.PriceSource == "" {
+		return DefaultPriceSource, nil
+	}
+
+	return p.PriceSource, nil
+}
+
+// SetPriceSource sets how contract items donated to the character are valued
+func SetPriceSource(ctx context.Context, charID int32, source string) error {
+	return executeNamed(ctx, cx.StmtSetPriceSource, map[string]interface{}{
+		"character_id": charID,
+		"price_source": source,
+	})
+}
+
+// Sanity ensures the tracking options are acceptable
+func (t *Tracking) Sanity() error {
+	seen := map[int32]bool{}
+	for _, division := range t.Divisions {
+		if division < 1 || division > 7 || seen[division] {
+			return UserError{
+				Msg:  []byte("Invalid wallet division"),
+				Code: 400,
+			}
+		}
+		seen[division] = true
+	}
+
+	for _, refType := range t.RefTypes {
+		if !inString(refType, RefTypes) {
+			return UserError{
+				Msg:  []byte("Invalid journal ref type"),
+				Code: 400,
+			}
+		}
+	}
+
+	if t.PriceSource != "" && !inString(t.PriceSource, PriceSources) {
+		return UserError{
+			Msg:  []byte("Invalid price source"),
+			Code: 400,
+		}
+	}
+
+	return nil
+}
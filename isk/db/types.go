@@ -0,0 +1,53 @@
+package db
+
+import (
+	"context"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/lib/pq"
+)
+
+// ItemType is a resolved item type name
+type ItemType struct {
+	// ID is the type ID
+	ID int32 `db:"id"`
+
+	// Name of the type
+	Name string `db:"name"`
+}
+
+// GetUnknownTypes returns the type IDs which have not been resolved yet
+func GetUnknownTypes(ctx context.Context, typeIDs []int32) ([]int32, error) {
+	rows, err := queryNamedResult(
+		ctx,
+		cx.StmtGetUnknownTypes,
+		map[string]interface{}{"type_ids": pq.Array(typeIDs)},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := scan(rows, func() interface{} { return &ItemType{} })
+	if err != nil {
+		return nil, err
+	}
+
+	unknown := []int32{}
+	for _, i := range res {
+		unknown = append(unknown, i.(*ItemType).ID)
+	}
+	return unknown, nil
+}
+
+// SaveTypes saves the resolved item types
+func SaveTypes(ctx context.Context, types []*ItemType) error {
+	for _, t := range types {
+		if err := executeNamed(ctx, cx.StmtSaveType, map[string]interface{}{
+			"id":   t.ID,
+			"name": t.Name,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
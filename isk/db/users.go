@@ -9,48 +9,138 @@ import (
 
 	"github.com/a-tal/esi-isk/isk/cx"
 	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
 )
 
+// ErrTokenReplaced is returned when saving tokens for a user who has since
+// signed in again, the newer tokens are kept
+var ErrTokenReplaced = errors.New("token was replaced by a newer sign in")
+
 // User describes a mapping between a user and a character
 type User struct {
-	RefreshToken   string        `db:"refresh_token"`
-	AccessToken    string        `db:"access_token"`
-	OwnerHash      string        `db:"owner_hash"`
-	CharacterID    int32         `db:"character_id"`
-	LastJournalID  sql.NullInt64 `db:"last_journal_id"`
-	LastContractID sql.NullInt64 `db:"last_contract_id"`
-	AccessExpires  time.Time     `db:"access_expires"`
-	LastProcessed  *time.Time    `db:"last_processed"`
-}
-
-// GetUsersToProcess returns all characters needing to be processed
-func GetUsersToProcess(ctx context.Context) ([]*User, error) {
-	users := []*User{}
+	RefreshToken    string         `db:"refresh_token"`
+	AccessToken     string         `db:"access_token"`
+	OwnerHash       string         `db:"owner_hash"`
+	CharacterID     int32          `db:"character_id"`
+	LastJournalID   sql.NullInt64  `db:"last_journal_id"`
+	LastContractID  sql.NullInt64  `db:"last_contract_id"`
+	AccessExpires   time.Time      `db:"access_expires"`
+	LastProcessed   *time.Time     `db:"last_processed"`
+	CorporationMode bool           `db:"corporation_mode"`
+	CorporationID   int32          `db:"corporation_id"`
+	RefreshFailures int            `db:"refresh_failures"`
+	TokenState      string         `db:"token_state"`
+	TokenHash       sql.NullString `db:"token_hash"`
+	Scopes          pq.StringArray `db:"scopes"`
+	NextPollAt      *time.Time     `db:"next_poll_at"`
+	IdlePolls       int            `db:"idle_polls"`
+	ClaimedBy       sql.NullString `db:"claimed_by"`
+	ClaimedUntil    *time.Time     `db:"claimed_until"`
 
-	nullUsers, err := queryUsers(ctx, cx.StmtGetNullUsers)
-	if err != nil {
-		return nil, err
-	}
-	users = append(users, nullUsers...)
+	// ESIExpires is the earliest ESI cache expiry seen while pulling
+	ESIExpires time.Time `db:"-"`
+}
 
-	updateUsers, err := queryUsers(ctx, cx.StmtGetUsers)
-	if err != nil {
-		return nil, err
+// HasScope returns true if the user granted the scope
+func (u *User) HasScope(scope string) bool {
+	for _, s := range u.Scopes {
+		if s == scope {
+			return true
+		}
 	}
-	users = append(users, updateUsers...)
+	return false
+}
 
-	return users, nil
+const (
+	// TokenValid is the state of a user whose token last refreshed fine
+	TokenValid = "valid"
+
+	// TokenFailing users have failed to refresh, and will be retried
+	TokenFailing = "failing"
+
+	// TokenRevoked users have revoked access, and are no longer processed
+	TokenRevoked = "revoked"
+
+	// TokenParked users failed too many times, and are no longer processed
+	TokenParked = "parked"
+)
+
+// TokenStatus describes the health of a user's token
+type TokenStatus struct {
+	State    string `json:"state"`
+	Failures int    `json:"failures,omitempty"`
 }
 
-func queryUsers(
+// ClaimUsers leases up to limit characters due to be polled to this worker.
+// Other workers skip them until they are released or the lease runs out
+func ClaimUsers(
 	ctx context.Context,
-	key cx.Key,
+	workerID string,
+	lease time.Duration,
+	limit int,
 ) ([]*User, error) {
-	rows, err := queryNamedResult(ctx, key, map[string]interface{}{})
+	rows, err := queryNamedResult(ctx, cx.StmtClaimUsers, map[string]interface{}{
+		"worker_id": workerID,
+		"lease":     int(lease.Seconds()),
+		"limit":     limit,
+	})
 	if err != nil {
 		return nil, err
 	}
-	return scanUsers(rows)
+	return scanUsers(ctx, rows)
+}
+
+// RenewClaim extends this worker's lease on the character. Returns false if
+// the lease has already run out, when another worker may have claimed them
+func RenewClaim(
+	ctx context.Context,
+	charID int32,
+	workerID string,
+	lease time.Duration,
+) (bool, error) {
+	renewed, err := executeNamedCount(
+		ctx,
+		cx.StmtRenewClaim,
+		map[string]interface{}{
+			"character_id": charID,
+			"worker_id":    workerID,
+			"lease":        int(lease.Seconds()),
+		},
+	)
+	return renewed > 0, err
+}
+
+// ReleaseUser ends this worker's lease on the character
+func ReleaseUser(ctx context.Context, charID int32, workerID string) error {
+	return executeNamed(ctx, cx.StmtReleaseUser, map[string]interface{}{
+		"character_id": charID,
+		"worker_id":    workerID,
+	})
+}
+
+// GetNextPoll returns when the next character is due to be polled, or nil
+// if there are no characters to poll
+func GetNextPoll(ctx context.Context) (*time.Time, error) {
+	res := &struct {
+		NextPollAt *time.Time `db:"next_poll_at"`
+	}{}
+	if err := getNamedResult(
+		ctx,
+		cx.StmtNextPoll,
+		res,
+		map[string]interface{}{},
+	); err != nil {
+		return nil, err
+	}
+	return res.NextPollAt, nil
+}
+
+// DeferUser sets when the character will next be polled
+func DeferUser(ctx context.Context, charID int32, next time.Time) error {
+	return executeNamed(ctx, cx.StmtDeferUser, map[string]interface{}{
+		"character_id": charID,
+		"next_poll_at": next,
+	})
 }
 
 // SaveUser attempts to save the User in the db
@@ -77,31 +167,96 @@ func SaveUser(ctx context.Context, user *User) error {
 }
 
 func updateUser(ctx context.Context, user *User) error {
-	return executeNamed(ctx, cx.StmtUpdateUser, map[string]interface{}{
-		"character_id":     user.CharacterID,
-		"refresh_token":    user.RefreshToken,
-		"access_token":     user.AccessToken,
-		"access_expires":   user.AccessExpires,
-		"owner_hash":       user.OwnerHash,
-		"last_journal_id":  user.LastJournalID,
-		"last_contract_id": user.LastContractID,
-	})
+	values, err := encryptedTokens(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	values["character_id"] = user.CharacterID
+	values["access_expires"] = user.AccessExpires
+	values["owner_hash"] = user.OwnerHash
+	values["last_journal_id"] = user.LastJournalID
+	values["last_contract_id"] = user.LastContractID
+	values["corporation_mode"] = user.CorporationMode
+	values["corporation_id"] = user.CorporationID
+	values["scopes"] = user.Scopes
+	values["next_poll_at"] = user.NextPollAt
+	values["idle_polls"] = user.IdlePolls
+
+	return executeNamed(ctx, cx.StmtUpdateUser, values)
+}
+
+// SaveProgress stores the cursors and polling of the user after a pull. If
+// the user signed in again in the meantime ErrTokenReplaced is returned, and
+// nothing is saved
+func SaveProgress(ctx context.Context, user *User) error {
+	updated, err := executeNamedCount(
+		ctx,
+		cx.StmtSaveProgress,
+		map[string]interface{}{
+			"character_id":     user.CharacterID,
+			"previous_hash":    user.TokenHash,
+			"last_journal_id":  user.LastJournalID,
+			"last_contract_id": user.LastContractID,
+			"corporation_id":   user.CorporationID,
+			"next_poll_at":     user.NextPollAt,
+			"idle_polls":       user.IdlePolls,
+		},
+	)
+	if err != nil {
+		return err
+	}
+	if updated < 1 {
+		return ErrTokenReplaced
+	}
+	return nil
 }
 
 // save the newly created (or replaced) user
 func saveNewUser(ctx context.Context, user *User) error {
-	if err := executeNamed(ctx, cx.StmtCreateUser, map[string]interface{}{
-		"character_id":   user.CharacterID,
-		"refresh_token":  user.RefreshToken,
-		"access_token":   user.AccessToken,
-		"access_expires": user.AccessExpires,
-		"owner_hash":     user.OwnerHash,
-	}); err != nil {
+	values, err := encryptedTokens(ctx, user)
+	if err != nil {
 		return err
 	}
-	return executeNamed(ctx, cx.StmtCreatePreferences, map[string]interface{}{
-		"character_id": user.CharacterID,
-	})
+
+	values["character_id"] = user.CharacterID
+	values["access_expires"] = user.AccessExpires
+	values["owner_hash"] = user.OwnerHash
+	values["corporation_mode"] = user.CorporationMode
+	values["scopes"] = user.Scopes
+
+	if err := executeNamed(ctx, cx.StmtCreateUser, values); err != nil {
+		return err
+	}
+	return CreatePreferences(ctx, user.CharacterID)
+}
+
+// encryptedTokens returns the user's tokens as they are stored, along with
+// the keyed hash of the refresh token
+func encryptedTokens(
+	ctx context.Context,
+	user *User,
+) (map[string]interface{}, error) {
+	refreshToken, err := encryptToken(ctx, user.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	accessToken, err := encryptToken(ctx, user.AccessToken)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenHash, err := hashToken(ctx, user.RefreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]interface{}{
+		"refresh_token": refreshToken,
+		"access_token":  accessToken,
+		"token_hash":    tokenHash,
+	}, nil
 }
 
 // pull the known user for this characterID
@@ -119,7 +274,7 @@ func getUser(
 		return nil, err
 	}
 
-	users, err := scanUsers(rows)
+	users, err := scanUsers(ctx, rows)
 	if err != nil {
 		return nil, err
 	} else if len(users) != 1 {
@@ -129,7 +284,26 @@ func getUser(
 	return users[0], nil
 }
 
-func scanUsers(rows *sqlx.Rows) ([]*User, error) {
+// scanUsers returns the users with their tokens decrypted
+func scanUsers(ctx context.Context, rows *sqlx.Rows) ([]*User, error) {
+	users, err := scanRawUsers(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if user.RefreshToken, err = decryptToken(ctx, user.RefreshToken); err != nil {
+			return nil, err
+		}
+		if user.AccessToken, err = decryptToken(ctx, user.AccessToken); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// scanRawUsers returns the users with their tokens as stored
+func scanRawUsers(rows *sqlx.Rows) ([]*User, error) {
 	res, err := scan(rows, func() interface{} { return &User{} })
 	if err != nil {
 		return nil, err
@@ -141,6 +315,100 @@ func scanUsers(rows *sqlx.Rows) ([]*User, error) {
 	return users, nil
 }
 
+// ReencryptUsers encrypts any plaintext tokens, or those encrypted with an
+// old key, with the current key. Returns the number of users re-encrypted
+func ReencryptUsers(ctx context.Context) (int, error) {
+	rows, err := queryNamedResult(ctx, cx.StmtGetAllUsers, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	users, err := scanRawUsers(rows)
+	if err != nil {
+		return 0, err
+	}
+
+	reencrypted := 0
+	for _, user := range users {
+		if user.TokenHash.Valid &&
+			!needsEncrypting(ctx, user.RefreshToken) &&
+			!needsEncrypting(ctx, user.AccessToken) {
+			continue
+		}
+
+		if user.RefreshToken, err = decryptToken(ctx, user.RefreshToken); err != nil {
+			return reencrypted, err
+		}
+		if user.AccessToken, err = decryptToken(ctx, user.AccessToken); err != nil {
+			return reencrypted, err
+		}
+
+		if err := SaveTokens(ctx, user); err != nil {
+			return reencrypted, err
+		}
+		reencrypted++
+	}
+
+	return reencrypted, nil
+}
+
+// SaveTokens stores the user's refreshed (and possibly rotated) tokens in
+// place of the tokens the user was loaded with. Returns ErrTokenReplaced if
+// the character signed in again since
+func SaveTokens(ctx context.Context, user *User) error {
+	values, err := encryptedTokens(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	values["character_id"] = user.CharacterID
+	values["access_expires"] = user.AccessExpires
+	values["previous_hash"] = user.TokenHash
+
+	updated, err := executeNamedCount(ctx, cx.StmtUpdateTokens, values)
+	if err != nil {
+		return err
+	}
+	if updated < 1 {
+		return ErrTokenReplaced
+	}
+
+	user.TokenHash = sql.NullString{
+		String: values["token_hash"].(string),
+		Valid:  true,
+	}
+	return nil
+}
+
+// SetTokenState records the failures and state of the user's token
+func SetTokenState(ctx context.Context, user *User) error {
+	return executeNamed(ctx, cx.StmtSetTokenState, map[string]interface{}{
+		"token_hash":       user.TokenHash,
+		"refresh_failures": user.RefreshFailures,
+		"token_state":      user.TokenState,
+	})
+}
+
+// DeleteUserToken removes the user, if they still have the same token
+func DeleteUserToken(ctx context.Context, user *User) error {
+	return executeNamed(ctx, cx.StmtDeleteUserToken, map[string]interface{}{
+		"token_hash": user.TokenHash,
+	})
+}
+
+// GetTokenStatus returns the health of the character's token
+func GetTokenStatus(ctx context.Context, charID int32) (*TokenStatus, error) {
+	user, err := getUser(ctx, charID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenStatus{
+		State:    user.TokenState,
+		Failures: user.RefreshFailures,
+	}, nil
+}
+
 // DeleteUser removes a user (auth/tracked character)
 func DeleteUser(ctx context.Context, charID int32) error {
 	return executeNamed(
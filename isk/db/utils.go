@@ -36,13 +36,22 @@ func Connect(ctx context.Context) *sqlx.DB {
 	return db
 }
 
+// namedStmt returns the prepared statement, within the transaction in
+// context if there is one
+func namedStmt(ctx context.Context, stmt cx.Key) *sqlx.NamedStmt {
+	statements := ctx.Value(cx.Statements).(map[cx.Key]*sqlx.NamedStmt)
+	if tx, ok := ctx.Value(cx.Tx).(*sqlx.Tx); ok {
+		return tx.NamedStmt(statements[stmt])
+	}
+	return statements[stmt]
+}
+
 func queryNamedResult(
 	ctx context.Context,
 	stmt cx.Key,
 	values map[string]interface{},
 ) (*sqlx.Rows, error) {
-	statements := ctx.Value(cx.Statements).(map[cx.Key]*sqlx.NamedStmt)
-	return statements[stmt].Queryx(values)
+	return namedStmt(ctx, stmt).Queryx(values)
 }
 
 func getNamedResult(
@@ -51,8 +60,7 @@ func getNamedResult(
 	dest interface{},
 	values map[string]interface{},
 ) error {
-	statements := ctx.Value(cx.Statements).(map[cx.Key]*sqlx.NamedStmt)
-	return statements[stmt].Get(dest, values)
+	return namedStmt(ctx, stmt).Get(dest, values)
 }
 
 func executeNamed(
@@ -60,11 +68,23 @@ func executeNamed(
 	stmt cx.Key,
 	values map[string]interface{},
 ) error {
-	statements := ctx.Value(cx.Statements).(map[cx.Key]*sqlx.NamedStmt)
-	_, err := statements[stmt].Exec(values)
+	_, err := namedStmt(ctx, stmt).Exec(values)
 	return err
 }
 
+// executeNamedCount returns the number of rows affected by the statement
+func executeNamedCount(
+	ctx context.Context,
+	stmt cx.Key,
+	values map[string]interface{},
+) (int64, error) {
+	res, err := namedStmt(ctx, stmt).Exec(values)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
 func inInt32(i int32, l []int32) bool {
 	for _, j := range l {
 		if i == j {
@@ -74,6 +94,15 @@ func inInt32(i int32, l []int32) bool {
 	return false
 }
 
+func inString(s string, l []string) bool {
+	for _, j := range l {
+		if s == j {
+			return true
+		}
+	}
+	return false
+}
+
 func scan(rows *sqlx.Rows, newItem func() interface{}) ([]interface{}, error) {
 	items := []interface{}{}
 
@@ -0,0 +1,368 @@
+// Package migrations versions the database schema. Migrations are embedded
+// from sql/, named <version>_<name>.up.sql with a matching .down.sql
+package migrations
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// lockID is the advisory lock ID held while migrating
+const lockID int64 = 0x6d6967
+
+const createTable = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version INTEGER   NOT NULL,
+    name    TEXT      NOT NULL,
+    applied TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (version)
+)`
+
+// Migration is a single versioned change to the schema
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Status describes a migration, and when it was applied if it has been
+type Status struct {
+	Version int        `db:"version"`
+	Name    string     `db:"name"`
+	Applied *time.Time `db:"applied"`
+}
+
+// All returns every known migration, in order
+func All() ([]*Migration, error) {
+	entries, err := files.ReadDir("sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		version, name, direction, err := parseName(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := files.ReadFile(path.Join("sql", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: name}
+			byVersion[version] = migration
+		} else if migration.Name != name {
+			return nil, fmt.Errorf(
+				"migration %d is named both %s and %s",
+				version,
+				migration.Name,
+				name,
+			)
+		}
+
+		if direction == "up" {
+			migration.Up = string(content)
+		} else {
+			migration.Down = string(content)
+		}
+	}
+
+	migrations := []*Migration{}
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf(
+				"migration %d needs both up and down files",
+				migration.Version,
+			)
+		}
+		migrations = append(migrations, migration)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// parseName splits "0001_baseline.up.sql" into 1, "baseline" and "up"
+func parseName(filename string) (int, string, string, error) {
+	base := strings.TrimSuffix(filename, ".sql")
+	direction := path.Ext(base)
+	base = strings.TrimSuffix(base, direction)
+	direction = strings.TrimPrefix(direction, ".")
+
+	parts := strings.SplitN(base, "_", 2)
+	if len(parts) != 2 || (direction != "up" && direction != "down") {
+		return 0, "", "", fmt.Errorf("invalid migration file name: %s", filename)
+	}
+
+	version, err := strconv.Atoi(parts[0])
+	if err != nil || version < 1 {
+		return 0, "", "", fmt.Errorf("invalid migration version: %s", filename)
+	}
+
+	return version, parts[1], direction, nil
+}
+
+// GetStatus returns every known migration and any unknown applied ones, in
+// order, with when each was applied
+func GetStatus(ctx context.Context) ([]*Status, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	applied, err := getApplied(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeStatus(migrations, applied), nil
+}
+
+// mergeStatus lists the known migrations alongside the applied ones
+func mergeStatus(migrations []*Migration, applied []*Status) []*Status {
+	byVersion := map[int]*Status{}
+	for _, status := range applied {
+		byVersion[status.Version] = status
+	}
+
+	statuses := []*Status{}
+	for _, migration := range migrations {
+		status, ok := byVersion[migration.Version]
+		if !ok {
+			status = &Status{Version: migration.Version, Name: migration.Name}
+		}
+		delete(byVersion, migration.Version)
+		statuses = append(statuses, status)
+	}
+
+	// applied by a newer build
+	for _, status := range byVersion {
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Version < statuses[j].Version
+	})
+	return statuses
+}
+
+// Check returns an error unless every known migration, and only those, has
+// been applied. Nothing should run against a schema it doesn't understand
+func Check(ctx context.Context) error {
+	migrations, err := All()
+	if err != nil {
+		return err
+	}
+
+	applied, err := getApplied(ctx)
+	if err != nil {
+		return err
+	}
+
+	return checkStatus(migrations, mergeStatus(migrations, applied))
+}
+
+func checkStatus(migrations []*Migration, statuses []*Status) error {
+	known := map[int]bool{}
+	for _, migration := range migrations {
+		known[migration.Version] = true
+	}
+
+	for _, status := range statuses {
+		if !known[status.Version] {
+			return fmt.Errorf(
+				"schema has unknown migration %d (%s), this build is too old",
+				status.Version,
+				status.Name,
+			)
+		}
+		if status.Applied == nil {
+			return fmt.Errorf(
+				"schema is missing migration %d (%s), run admin migrate up",
+				status.Version,
+				status.Name,
+			)
+		}
+	}
+
+	return nil
+}
+
+// Up applies every pending migration, returning those applied
+func Up(ctx context.Context) ([]*Migration, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	applied := []*Migration{}
+	for _, migration := range migrations {
+		ran, err := migrate(ctx, migration, true)
+		if err != nil {
+			return applied, fmt.Errorf(
+				"failed to apply migration %d (%s): %v",
+				migration.Version,
+				migration.Name,
+				err,
+			)
+		}
+		if ran {
+			applied = append(applied, migration)
+		}
+	}
+
+	return applied, nil
+}
+
+// Down rolls back the latest steps applied migrations, returning those
+// rolled back
+func Down(ctx context.Context, steps int) ([]*Migration, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses, err := GetStatus(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, migration := range migrations {
+		byVersion[migration.Version] = migration
+	}
+
+	rolledBack := []*Migration{}
+	for i := len(statuses) - 1; i >= 0 && len(rolledBack) < steps; i-- {
+		if statuses[i].Applied == nil {
+			continue
+		}
+
+		migration, ok := byVersion[statuses[i].Version]
+		if !ok {
+			return rolledBack, fmt.Errorf(
+				"can't roll back unknown migration %d",
+				statuses[i].Version,
+			)
+		}
+
+		if _, err := migrate(ctx, migration, false); err != nil {
+			return rolledBack, fmt.Errorf(
+				"failed to roll back migration %d (%s): %v",
+				migration.Version,
+				migration.Name,
+				err,
+			)
+		}
+		rolledBack = append(rolledBack, migration)
+	}
+
+	return rolledBack, nil
+}
+
+// migrate applies or rolls back the migration in a transaction, returning
+// false if there was nothing to do
+func migrate(ctx context.Context, migration *Migration, up bool) (bool, error) {
+	tx, err := ctx.Value(cx.DB).(*sqlx.DB).Beginx()
+	if err != nil {
+		return false, err
+	}
+
+	ran, err := migrateTx(tx, migration, up)
+	if err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return false, rollbackErr
+		}
+		return false, err
+	}
+
+	return ran, tx.Commit()
+}
+
+func migrateTx(tx *sqlx.Tx, migration *Migration, up bool) (bool, error) {
+	// only one migration runs at a time
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", lockID); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.Exec(createTable); err != nil {
+		return false, err
+	}
+
+	applied := 0
+	if err := tx.Get(
+		&applied,
+		"SELECT COUNT(*) FROM schema_migrations WHERE version = $1",
+		migration.Version,
+	); err != nil {
+		return false, err
+	}
+
+	if up == (applied > 0) {
+		return false, nil
+	}
+
+	if up {
+		if _, err := tx.Exec(migration.Up); err != nil {
+			return false, err
+		}
+		_, err := tx.Exec(
+			"INSERT INTO schema_migrations (version, name) VALUES ($1, $2)",
+			migration.Version,
+			migration.Name,
+		)
+		return err == nil, err
+	}
+
+	if _, err := tx.Exec(migration.Down); err != nil {
+		return false, err
+	}
+	_, err := tx.Exec(
+		"DELETE FROM schema_migrations WHERE version = $1",
+		migration.Version,
+	)
+	return err == nil, err
+}
+
+// getApplied returns the migrations applied to the schema
+func getApplied(ctx context.Context) ([]*Status, error) {
+	db := ctx.Value(cx.DB).(*sqlx.DB)
+
+	exists := false
+	if err := db.Get(
+		&exists,
+		"SELECT to_regclass('schema_migrations') IS NOT NULL",
+	); err != nil {
+		return nil, err
+	}
+	if !exists {
+		return []*Status{}, nil
+	}
+
+	applied := []*Status{}
+	err := db.Select(
+		&applied,
+		"SELECT * FROM schema_migrations ORDER BY version",
+	)
+	return applied, err
+}
@@ -0,0 +1,105 @@
+package migrations
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAll(t *testing.T) {
+	migrations, err := All()
+	if err != nil {
+		t.Fatalf("failed to load migrations: %v", err)
+	}
+
+	if len(migrations) < 1 || migrations[0].Name != "baseline" {
+		t.Fatalf("expected the baseline migration first, got %+v", migrations)
+	}
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("expected migration %d, got %d", i+1, migration.Version)
+		}
+		if strings.TrimSpace(migration.Up) == "" {
+			t.Errorf("migration %d has an empty up", migration.Version)
+		}
+		if strings.TrimSpace(migration.Down) == "" {
+			t.Errorf("migration %d has an empty down", migration.Version)
+		}
+	}
+}
+
+func TestParseName(t *testing.T) {
+	version, name, direction, err := parseName("0012_name_history.down.sql")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 12 || name != "name_history" || direction != "down" {
+		t.Errorf("unexpected parse: %d %s %s", version, name, direction)
+	}
+
+	for _, invalid := range []string{
+		"baseline.up.sql",
+		"0001_baseline.sql",
+		"0000_baseline.up.sql",
+		"x001_baseline.up.sql",
+		"0001_baseline.sideways.sql",
+	} {
+		if _, _, _, err := parseName(invalid); err == nil {
+			t.Errorf("expected %s to be invalid", invalid)
+		}
+	}
+}
+
+func TestCheckStatus(t *testing.T) {
+	now := time.Now()
+	migrations := []*Migration{
+		{Version: 1, Name: "baseline"},
+		{Version: 2, Name: "second"},
+	}
+
+	cases := []struct {
+		name    string
+		applied []*Status
+		err     string
+	}{
+		{
+			name: "current",
+			applied: []*Status{
+				{Version: 1, Name: "baseline", Applied: &now},
+				{Version: 2, Name: "second", Applied: &now},
+			},
+		},
+		{
+			name:    "empty",
+			applied: []*Status{},
+			err:     "missing migration 1",
+		},
+		{
+			name: "pending",
+			applied: []*Status{
+				{Version: 1, Name: "baseline", Applied: &now},
+			},
+			err: "missing migration 2",
+		},
+		{
+			name: "newer",
+			applied: []*Status{
+				{Version: 1, Name: "baseline", Applied: &now},
+				{Version: 2, Name: "second", Applied: &now},
+				{Version: 3, Name: "third", Applied: &now},
+			},
+			err: "unknown migration 3",
+		},
+	}
+
+	for _, c := range cases {
+		err := checkStatus(migrations, mergeStatus(migrations, c.applied))
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", c.name, err)
+		case c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)):
+			t.Errorf("%s: expected %q, got %v", c.name, c.err, err)
+		}
+	}
+}
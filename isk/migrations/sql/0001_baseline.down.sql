@@ -0,0 +1,13 @@
+DROP TABLE IF EXISTS
+    characters,
+    contractItems,
+    contracts,
+    corporationDivisions,
+    donations,
+    httpcache,
+    locations,
+    maintenance,
+    names,
+    preferences,
+    types,
+    users;
@@ -0,0 +1,224 @@
+-- the schema as it was before versioned migrations, every statement is
+-- idempotent so existing databases can be brought under version control
+
+-- 0_characters.sql
+CREATE TABLE IF NOT EXISTS characters (
+    character_id     INTEGER          NOT NULL,
+    corporation_id   INTEGER          NOT NULL,
+    alliance_id      INTEGER          NOT NULL,
+    received         BIGINT           NOT NULL,
+    received_isk     DOUBLE PRECISION NOT NULL,
+    received_30      BIGINT           NOT NULL,
+    received_isk_30  DOUBLE PRECISION NOT NULL,
+    donated          BIGINT           NOT NULL,
+    donated_isk      DOUBLE PRECISION NOT NULL,
+    donated_30       BIGINT           NOT NULL,
+    donated_isk_30   DOUBLE PRECISION NOT NULL,
+    last_donated     TIMESTAMP,
+    last_received    TIMESTAMP,
+    good_standing    BOOLEAN          NOT NULL DEFAULT false,
+
+    PRIMARY KEY (character_id)
+);
+
+-- 0_contractItems.sql
+CREATE TABLE IF NOT EXISTS contractItems (
+    id          BIGINT  NOT NULL,  -- record_id
+    contract_id INTEGER NOT NULL,
+    type_id     INTEGER NOT NULL,
+    item_id     BIGINT  NOT NULL,
+    quantity    INTEGER NOT NULL,
+    PRIMARY KEY (id)
+);
+
+-- 0_contracts.sql
+CREATE TABLE IF NOT EXISTS contracts (
+    contract_id INTEGER          NOT NULL,
+    donator     INTEGER          NOT NULL,
+    receiver    INTEGER          NOT NULL,
+    location    BIGINT           NOT NULL,
+    issued      TIMESTAMP        NOT NULL,
+    expires     TIMESTAMP        NOT NULL,
+    accepted    BOOLEAN          NOT NULL,
+    value       DOUBLE PRECISION NOT NULL,
+    note        TEXT             NOT NULL,
+    PRIMARY KEY (contract_id)
+);
+
+-- 0_donations.sql
+CREATE TABLE IF NOT EXISTS donations (
+    transaction_id BIGINT           NOT NULL,
+    donator        INTEGER          NOT NULL,
+    receiver       INTEGER          NOT NULL,
+    "timestamp"    TIMESTAMP        NOT NULL,
+    note           TEXT             NOT NULL,
+    amount         DOUBLE PRECISION NOT NULL,
+    PRIMARY KEY (transaction_id)
+);
+
+-- 0_httpcache.sql
+CREATE TABLE IF NOT EXISTS httpcache (
+    cache_key TEXT      NOT NULL,
+    value     BYTEA     NOT NULL,
+    size      INTEGER   NOT NULL,
+    created   TIMESTAMP NOT NULL DEFAULT NOW(),
+    accessed  TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (cache_key)
+);
+
+-- 0_locations.sql
+CREATE TABLE IF NOT EXISTS locations (
+    id          BIGINT    NOT NULL,  -- station or structure ID
+    name        TEXT      NOT NULL,  -- empty if the structure is inaccessible
+    system_id   INTEGER   NOT NULL,
+    system_name TEXT      NOT NULL,
+    updated     TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (id)
+);
+
+-- 0_maintenance.sql
+CREATE TABLE IF NOT EXISTS maintenance (
+    name     TEXT      NOT NULL,  -- the maintenance task
+    last_run TIMESTAMP NOT NULL,  -- when a worker last claimed it
+    PRIMARY KEY (name)
+);
+
+-- 0_names.sql
+CREATE TABLE IF NOT EXISTS names (
+    id     INTEGER NOT NULL,
+    name   TEXT    NOT NULL,
+
+    PRIMARY KEY (id)
+);
+
+-- 0_preferences.sql
+CREATE TABLE IF NOT EXISTS preferences (
+    character_id               INTEGER  NOT NULL,
+    donation_rows              INTEGER  NOT NULL DEFAULT 5,
+    contract_rows              INTEGER  NOT NULL DEFAULT 5,
+    combined_rows              INTEGER  NOT NULL DEFAULT 5,
+    donation_max_age           INTEGER  NOT NULL DEFAULT 0,
+    contract_max_age           INTEGER  NOT NULL DEFAULT 0,
+    combined_max_age           INTEGER  NOT NULL DEFAULT 0,
+    donation_min               FLOAT    NOT NULL DEFAULT 0.1,
+    contract_min               FLOAT    NOT NULL DEFAULT 0.1,
+    combined_min_donation      FLOAT    NOT NULL DEFAULT 0.1,
+    combined_min_contract      FLOAT    NOT NULL DEFAULT 0.1,
+    donation_header            TEXT,
+    donation_footer            TEXT,
+    donation_pattern           TEXT,
+    donation_passphrase        TEXT,
+    contract_header            TEXT,
+    contract_footer            TEXT,
+    contract_pattern           TEXT,
+    contract_passphrase        TEXT,
+    combined_header            TEXT,
+    combined_footer            TEXT,
+    combined_donation_pattern  TEXT,
+    combined_contract_pattern  TEXT,
+    combined_passphrase        TEXT,
+    PRIMARY KEY (character_id)
+);
+
+-- 0_types.sql
+CREATE TABLE IF NOT EXISTS types (
+    id    INTEGER NOT NULL,  -- type_id
+    name  TEXT    NOT NULL,
+    PRIMARY KEY (id)
+);
+
+-- 0_users.sql
+CREATE TABLE IF NOT EXISTS users (
+    refresh_token    TEXT      NOT NULL,
+    access_token     TEXT      NOT NULL,
+    access_expires   TIMESTAMP NOT NULL,
+    character_id     INTEGER   NOT NULL,
+    owner_hash       TEXT      NOT NULL,
+    last_processed   TIMESTAMP,
+    last_journal_id  BIGINT,
+    last_contract_id BIGINT,
+
+    PRIMARY KEY (refresh_token)
+);
+
+-- 1_claims.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    claimed_by TEXT;  -- the worker polling the user
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    claimed_until TIMESTAMP;  -- when the worker's claim lapses
+
+-- 1_corporations.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    corporation_mode BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    corporation_id   INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE IF NOT EXISTS corporationDivisions (
+    character_id    INTEGER NOT NULL,  -- director tracking the corp wallet
+    division        INTEGER NOT NULL,
+    last_journal_id BIGINT,
+    PRIMARY KEY (character_id, division)
+);
+
+-- 1_encryption.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    token_hash TEXT;  -- HMAC of the refresh token, set by the worker
+
+-- refresh_token is encrypted now, so can't be the primary key
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_pkey;
+ALTER TABLE users ADD PRIMARY KEY (character_id);
+
+CREATE UNIQUE INDEX IF NOT EXISTS users_token_hash ON users (token_hash);
+
+-- 1_polling.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    next_poll_at TIMESTAMP;  -- NULL is due now
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    idle_polls INTEGER NOT NULL DEFAULT 0;
+
+CREATE INDEX IF NOT EXISTS users_next_poll_at ON users (next_poll_at);
+
+-- 1_prices.sql
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS
+    price_source TEXT NOT NULL DEFAULT 'adjusted';
+
+ALTER TABLE contracts ADD COLUMN IF NOT EXISTS
+    price_source TEXT NOT NULL DEFAULT 'adjusted';
+
+ALTER TABLE contractItems ADD COLUMN IF NOT EXISTS
+    price DOUBLE PRECISION NOT NULL DEFAULT 0;  -- unit price when valued
+
+-- 1_refTypes.sql
+ALTER TABLE preferences ADD COLUMN IF NOT EXISTS
+    ref_types TEXT[] NOT NULL DEFAULT '{player_donation}';
+
+ALTER TABLE donations ADD COLUMN IF NOT EXISTS
+    ref_type TEXT NOT NULL DEFAULT 'player_donation';
+
+-- 1_retention.sql
+-- history is kept past 30 days, 30 day totals are summed from these
+CREATE INDEX IF NOT EXISTS donations_timestamp ON donations ("timestamp");
+CREATE INDEX IF NOT EXISTS donations_receiver ON donations (receiver);
+CREATE INDEX IF NOT EXISTS donations_donator ON donations (donator);
+CREATE INDEX IF NOT EXISTS contracts_issued ON contracts (issued);
+CREATE INDEX IF NOT EXISTS contracts_receiver ON contracts (receiver);
+CREATE INDEX IF NOT EXISTS contracts_donator ON contracts (donator);
+
+-- 1_scopes.sql
+-- users from before scopes were chosen at signup granted the defaults
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    scopes TEXT[] NOT NULL DEFAULT '{esi-wallet.read_character_wallet.v1,esi-contracts.read_character_contracts.v1}';
+
+UPDATE users SET
+    scopes = array_append(scopes, 'esi-wallet.read_corporation_wallets.v1')
+WHERE corporation_mode
+AND NOT 'esi-wallet.read_corporation_wallets.v1' = ANY(scopes);
+
+-- 1_tokens.sql
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    refresh_failures INTEGER NOT NULL DEFAULT 0;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS
+    token_state TEXT NOT NULL DEFAULT 'valid';  -- valid/failing/revoked/parked
@@ -0,0 +1,5 @@
+DROP TABLE name_history;
+
+DROP INDEX names_updated;
+
+ALTER TABLE names DROP COLUMN updated;
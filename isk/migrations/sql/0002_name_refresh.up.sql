@@ -0,0 +1,13 @@
+-- names are re-resolved once they're older than the worker's -name-age
+ALTER TABLE names ADD COLUMN updated TIMESTAMP NOT NULL DEFAULT NOW();
+
+CREATE INDEX names_updated ON names (updated);
+
+-- previous names, replaced is when the name stopped being used
+CREATE TABLE name_history (
+    id       INTEGER   NOT NULL,
+    name     TEXT      NOT NULL,
+    replaced TIMESTAMP NOT NULL DEFAULT NOW(),
+
+    PRIMARY KEY (id, replaced)
+);
@@ -0,0 +1,8 @@
+ALTER TABLE preferences
+    DROP COLUMN top_rows,
+    DROP COLUMN top_window,
+    DROP COLUMN top_min,
+    DROP COLUMN top_header,
+    DROP COLUMN top_footer,
+    DROP COLUMN top_pattern,
+    DROP COLUMN top_passphrase;
@@ -0,0 +1,10 @@
+-- preferences for the top donors custom view, top_window is in days and 0
+-- covers all time
+ALTER TABLE preferences
+    ADD COLUMN top_rows       INTEGER NOT NULL DEFAULT 5,
+    ADD COLUMN top_window     INTEGER NOT NULL DEFAULT 30,
+    ADD COLUMN top_min        FLOAT   NOT NULL DEFAULT 0.1,
+    ADD COLUMN top_header     TEXT,
+    ADD COLUMN top_footer     TEXT,
+    ADD COLUMN top_pattern    TEXT,
+    ADD COLUMN top_passphrase TEXT;
@@ -0,0 +1,16 @@
+ALTER TABLE corporationDivisions RENAME TO corporationDivisionsByCorporation;
+
+CREATE TABLE corporationDivisions (
+    character_id    INTEGER NOT NULL,  -- director tracking the corp wallet
+    division        INTEGER NOT NULL,
+    last_journal_id BIGINT,
+    PRIMARY KEY (character_id, division)
+);
+
+INSERT INTO corporationDivisions (character_id, division, last_journal_id)
+SELECT users.character_id, new.division, new.last_journal_id
+FROM corporationDivisionsByCorporation new
+JOIN users ON users.corporation_id = new.corporation_id
+WHERE users.corporation_mode;
+
+DROP TABLE corporationDivisionsByCorporation;
@@ -0,0 +1,21 @@
+-- wallet divisions belong to the corporation, so directors of the same
+-- corporation share them and their journal cursors. Directors whose
+-- corporation isn't known yet get the default division on their next pull
+ALTER TABLE corporationDivisions RENAME TO corporationDivisionsByCharacter;
+
+CREATE TABLE corporationDivisions (
+    corporation_id  INTEGER NOT NULL,
+    division        INTEGER NOT NULL,
+    last_journal_id BIGINT,
+    PRIMARY KEY (corporation_id, division)
+);
+
+-- the furthest cursor has already been pulled by one of the directors
+INSERT INTO corporationDivisions (corporation_id, division, last_journal_id)
+SELECT users.corporation_id, old.division, MAX(old.last_journal_id)
+FROM corporationDivisionsByCharacter old
+JOIN users ON users.character_id = old.character_id
+WHERE users.corporation_id > 0
+GROUP BY users.corporation_id, old.division;
+
+DROP TABLE corporationDivisionsByCharacter;
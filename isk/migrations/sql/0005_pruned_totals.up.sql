@@ -0,0 +1,63 @@
+-- totals of the donations and accepted contracts pruned from history, so
+-- reconciling can compare character totals with the rows remaining plus
+-- the rows already gone
+CREATE TABLE prunedTotals (
+    character_id  INTEGER          NOT NULL,
+    received      BIGINT           NOT NULL,
+    received_isk  DOUBLE PRECISION NOT NULL,
+    donated       BIGINT           NOT NULL,
+    donated_isk   DOUBLE PRECISION NOT NULL,
+    last_received TIMESTAMP,
+    last_donated  TIMESTAMP,
+    PRIMARY KEY (character_id)
+);
+
+-- rows deleted before now, by the retention option or by earlier versions
+-- after 30 days, are whatever the stored totals hold above the rows
+-- remaining. Totals below the rows remaining are drift, not pruning, and
+-- the last_* times only stand in for characters with no rows left
+WITH events AS (
+    SELECT donator, receiver, amount AS value, "timestamp" AS at
+    FROM donations
+    UNION ALL
+    SELECT donator, receiver, value, issued AS at
+    FROM contracts WHERE accepted
+), received AS (
+    SELECT receiver AS character_id, COUNT(*) AS total, SUM(value) AS isk,
+    MAX(at) AS last
+    FROM events GROUP BY receiver
+), donated AS (
+    SELECT donator AS character_id, COUNT(*) AS total, SUM(value) AS isk,
+    MAX(at) AS last
+    FROM events GROUP BY donator
+), pruned AS (
+    SELECT
+    characters.character_id,
+    GREATEST(characters.received - COALESCE(received.total, 0), 0)
+        AS received,
+    GREATEST(characters.received_isk - COALESCE(received.isk, 0), 0)
+        AS received_isk,
+    GREATEST(characters.donated - COALESCE(donated.total, 0), 0)
+        AS donated,
+    GREATEST(characters.donated_isk - COALESCE(donated.isk, 0), 0)
+        AS donated_isk,
+    CASE WHEN received.last IS NULL THEN characters.last_received END
+        AS last_received,
+    CASE WHEN donated.last IS NULL THEN characters.last_donated END
+        AS last_donated
+    FROM characters
+    LEFT JOIN received ON received.character_id = characters.character_id
+    LEFT JOIN donated ON donated.character_id = characters.character_id
+)
+INSERT INTO prunedTotals (
+    character_id,
+    received,
+    received_isk,
+    donated,
+    donated_isk,
+    last_received,
+    last_donated
+)
+SELECT * FROM pruned
+WHERE received > 0 OR received_isk > 0 OR donated > 0 OR donated_isk > 0
+OR last_received IS NOT NULL OR last_donated IS NOT NULL;
@@ -20,6 +20,7 @@ import (
 	"github.com/a-tal/esi-isk/isk/api"
 	"github.com/a-tal/esi-isk/isk/cx"
 	"github.com/a-tal/esi-isk/isk/db"
+	"github.com/a-tal/esi-isk/isk/migrations"
 	"github.com/a-tal/esi-isk/isk/worker"
 )
 
@@ -62,9 +63,17 @@ func RunServer(ctx context.Context) {
 
 	opts := ctx.Value(cx.Opts).(*cx.Options)
 
+	if err := db.CheckTokenKeys(ctx); err != nil {
+		log.Fatalf("refusing to start: %v", err)
+	}
+
 	ctx = context.WithValue(ctx, cx.DB, db.Connect(ctx))
+	if err := migrations.Check(ctx); err != nil {
+		log.Fatalf("unexpected schema: %v", err)
+	}
 	ctx = context.WithValue(ctx, cx.Statements, db.GetStatements(ctx))
 	ctx = context.WithValue(ctx, cx.StateStore, api.NewStateStore())
+	ctx = context.WithValue(ctx, cx.Verifier, api.NewVerifier(ctx))
 
 	if err := InitialSetup(ctx); err != nil {
 		log.Fatalf("failed to initialize db: %+v", err)
@@ -77,9 +86,16 @@ func RunServer(ctx context.Context) {
 
 	mux.HandleFunc("/api/ping", api.Ping)
 	mux.Handle("/api/prefs", api.Preferences(ctx))
+	mux.Handle("/api/prefs/tracking", api.Tracking(ctx))
+	mux.Handle("/api/export", api.Export(ctx))
 	mux.Handle("/api/top", respCache.Middleware(api.TopRecipients(ctx)))
 	mux.Handle("/api/char", respCache.Middleware(api.CharacterDetails(ctx)))
+	mux.Handle(
+		"/api/char/top-donors",
+		respCache.Middleware(api.TopDonors(ctx)),
+	)
 	mux.Handle("/api/custom", respCache.Middleware(api.Custom(ctx)))
+	mux.Handle("/api/history", respCache.Middleware(api.History(ctx)))
 
 	mux.HandleFunc("/signup", api.NewLogin(ctx))
 	mux.HandleFunc("/callback", api.Callback(ctx))
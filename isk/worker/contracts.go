@@ -6,111 +6,21 @@ import (
 	"log"
 	"net/http"
 	"sort"
-	"strconv"
 	"sync"
-	"time"
 
 	"github.com/antihax/goesi"
 	"github.com/antihax/goesi/esi"
 	"github.com/antihax/goesi/optional"
 
-	"github.com/a-tal/esi-isk/isk/api"
 	"github.com/a-tal/esi-isk/isk/cx"
 	"github.com/a-tal/esi-isk/isk/db"
 )
 
-// marketPrices stores market prices from ESI in memory
-type marketPrices struct {
-	lock    *sync.Mutex
-	prices  map[int32]float64
-	expires time.Time
-}
-
-func newPrices(ctx context.Context) (*marketPrices, error) {
-	prices, expires, err := getPrices(ctx)
-	if err != nil {
-		return nil, err
-	}
-
-	m := &marketPrices{
-		lock:    &sync.Mutex{},
-		prices:  prices,
-		expires: expires,
-	}
-	go m.updater(ctx)
-	return m, nil
-}
-
-func (m *marketPrices) value(items map[int32]int32) float64 {
-	m.lock.Lock()
-	defer m.lock.Unlock()
-	sum := float64(0)
-	for typeID, quantity := range items {
-		sum += (m.prices[typeID] * float64(quantity))
-	}
-	return sum
-}
-
-func (m *marketPrices) updater(ctx context.Context) {
-	minDt := time.Duration(60 * time.Second)
-
-	for {
-		dt := m.expires.Sub(time.Now().UTC())
-		if dt < minDt {
-			dt = minDt
-		}
-
-		log.Printf("next market update in: %+v", dt)
-		time.Sleep(dt)
-		log.Println("updating market prices")
-
-		prices, expires, err := getPrices(ctx)
-		if err != nil {
-			log.Printf("failed to update market prices: %+v", err)
-		} else {
-			m.lock.Lock()
-			m.prices = prices
-			m.expires = expires
-			m.lock.Unlock()
-		}
-	}
-}
-
-func getPrices(ctx context.Context) (
-	prices map[int32]float64,
-	expires time.Time,
-	err error,
-) {
-	client := ctx.Value(cx.Client).(*goesi.APIClient)
-	esiPrices, r, err := client.ESI.MarketApi.GetMarketsPrices(ctx, nil)
-	if err != nil {
-		return
-	}
-
-	expires, err = getExpires(r)
-	if err != nil {
-		return
-	}
-
-	prices = map[int32]float64{}
-	for _, i := range esiPrices {
-		prices[i.TypeId] = i.AdjustedPrice
-	}
-
-	return prices, expires, nil
-}
-
-// pull the next update time from the response headers
-func getExpires(r *http.Response) (expires time.Time, err error) {
-	expires, err = time.Parse(api.RFC1123, r.Header.Get("Expires"))
-	if err != nil {
-		return
-	}
-
-	return expires.Add(1 * time.Second), nil
-}
-
-func characterContracts(ctx context.Context, user *db.User) ([]int32, error) {
+func characterContracts(
+	ctx context.Context,
+	user *db.User,
+	run *pullRun,
+) ([]int32, error) {
 	charIDs := []int32{}
 
 	contracts, err := getContracts(ctx, user)
@@ -129,8 +39,15 @@ func characterContracts(ctx context.Context, user *db.User) ([]int32, error) {
 		return charIDs, err
 	}
 
+	source, err := getPriceSource(ctx, user.CharacterID)
+	if err != nil {
+		return charIDs, err
+	}
+
 	new, updated := parseForZeroISK(contracts, user, prevID, outstanding)
-	donations, updates := asDbContracts(ctx, new, updated)
+	donations, updates := asDbContracts(ctx, user, source, new, updated)
+	resolveLocations(ctx, user, donations)
+	resolveTypes(ctx, donations)
 
 	if len(donations) > 0 {
 		charIDs = append(charIDs, user.CharacterID)
@@ -140,49 +57,16 @@ func characterContracts(ctx context.Context, user *db.User) ([]int32, error) {
 		charIDs = append(charIDs, donation.Donator)
 	}
 
-	return charIDs, saveContractRun(
-		ctx,
-		donations,
-		updates,
-		getContractNames(ctx, donations),
-	)
-}
-
-func saveContractRun(
-	ctx context.Context,
-	contracts []*db.Contract,
-	updates []*db.Contract,
-	affiliations []*db.Affiliation,
-) error {
-	for _, contract := range contracts {
-		if err := db.SaveContract(ctx, contract); err != nil {
-			return err
-		}
-	}
+	run.addContracts(donations, updates)
 
-	if err := db.UpdateContracts(ctx, updates, affiliations); err != nil {
-		return err
-	}
-
-	if err := db.SaveNames(ctx, affiliations); err != nil {
-		return err
-	}
-
-	return db.SaveCharacterContracts(ctx, contracts, affiliations, true)
-}
-
-func getContractValue(ctx context.Context, items []*db.Item) float64 {
-	itemQuantities := map[int32]int32{}
-	for _, item := range items {
-		itemQuantities[item.TypeID] += item.Quantity
-	}
-
-	m := ctx.Value(cx.Prices).(*marketPrices)
-	return m.value(itemQuantities)
+	return charIDs, nil
 }
 
+// getContractItems looks up the items of one of the user's contracts. Items
+// can only be read through a party to the contract, which is always the user
 func getContractItems(
 	ctx context.Context,
+	user *db.User,
 	contract esi.GetCharactersCharacterIdContracts200Ok,
 ) ([]*db.Item, error) {
 	client := ctx.Value(cx.Client).(*goesi.APIClient)
@@ -190,7 +74,7 @@ func getContractItems(
 
 	items, _, err := api.GetCharactersCharacterIdContractsContractIdItems(
 		ctx,
-		contract.AssigneeId,
+		user.CharacterID,
 		contract.ContractId,
 		nil,
 	)
@@ -225,6 +109,7 @@ func getContracts(ctx context.Context, user *db.User) (
 	if err != nil {
 		return nil, err
 	}
+	noteExpires(user, r)
 
 	if !knownContract(entries, user) {
 		additional, err := expandContracts(ctx, user, r)
@@ -306,8 +191,13 @@ type zeroISKContracts []esi.GetCharactersCharacterIdContracts200Ok
 
 func (z zeroISKContracts) Len() int      { return len(z) }
 func (z zeroISKContracts) Swap(i, j int) { z[i], z[j] = z[j], z[i] }
+
+// Less sorts the newest contracts first, as the cursor is the newest contract
 func (z zeroISKContracts) Less(i, j int) bool {
-	return z[i].DateIssued.Before(z[j].DateIssued)
+	if z[i].DateIssued.Equal(z[j].DateIssued) {
+		return z[i].ContractId > z[j].ContractId
+	}
+	return z[i].DateIssued.After(z[j].DateIssued)
 }
 
 func expandContracts(
@@ -315,50 +205,21 @@ func expandContracts(
 	user *db.User,
 	res *http.Response,
 ) (zeroISKContracts, error) {
+	lock := &sync.Mutex{}
 	additional := zeroISKContracts{}
-	xPagesRaw := res.Header.Get("X-Pages")
-	if xPagesRaw == "" {
-		return additional, nil
-	}
 
-	xPages64, err := strconv.ParseInt(xPagesRaw, 10, 32)
-	if err != nil {
-		return additional, err
-	}
-	xPages := int(xPages64)
-
-	more := make(chan zeroISKContracts)
-	errs := make(chan error)
-
-	defer close(more)
-	defer close(errs)
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	started := 0
-	for i := 2; i <= xPages; i++ {
-		started++
-		go func(i int) {
-			entries, additionalErr := additionalContractPage(ctx, user, int32(i))
-			if additionalErr != nil {
-				errs <- additionalErr
-				return
-			}
-			more <- entries
-		}(i)
-	}
-
-	for i := 0; i < started; i++ {
-		select {
-		case entries := <-more:
-			additional = append(additional, entries...)
-		case err = <-errs:
-			cancel()
-			return nil, err
-		case <-ctx.Done():
-			return nil, ctx.Err()
+	err := fetchPages(ctx, res, func(ctx context.Context, page int32) error {
+		entries, err := additionalContractPage(ctx, user, page)
+		if err != nil {
+			return err
 		}
+		lock.Lock()
+		defer lock.Unlock()
+		additional = append(additional, entries...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return additional, nil
@@ -393,16 +254,20 @@ func toDbContract(c esi.GetCharactersCharacterIdContracts200Ok) *db.Contract {
 	}
 }
 
-// asDbContracts fills in Items and Value and converts into *db.Contract
+// asDbContracts fills in Items and Value and converts into *db.Contract.
+// Contracts which can't be looked up or valued are logged and skipped, so
+// they don't hold up the rest of the pull
 func asDbContracts(
 	ctx context.Context,
+	user *db.User,
+	source PriceSource,
 	contracts zeroISKContracts,
 	updates zeroISKContracts,
 ) ([]*db.Contract, []*db.Contract) {
 	zeroISK := []*db.Contract{}
 
 	for _, contract := range contracts {
-		items, err := getContractItems(ctx, contract)
+		items, err := getContractItems(ctx, user, contract)
 		if err != nil {
 			log.Printf(
 				"failed to lookup contract items for %d: %+v",
@@ -412,8 +277,19 @@ func asDbContracts(
 			continue
 		}
 
+		value, sourceName, err := valueContract(ctx, source, items)
+		if err != nil {
+			log.Printf(
+				"failed to value contract items for %d: %+v",
+				contract.ContractId,
+				err,
+			)
+			continue
+		}
+
 		c := toDbContract(contract)
-		c.Value = getContractValue(ctx, items)
+		c.Value = value
+		c.PriceSource = sourceName
 		c.Items = items
 
 		zeroISK = append(zeroISK, c)
@@ -0,0 +1,229 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/antihax/goesi"
+	"github.com/antihax/goesi/esi"
+	"github.com/antihax/goesi/optional"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+// corporationRefTypes are counted as corp donations, until changed by the user
+var corporationRefTypes = []string{
+	"player_donation",
+	"corporation_account_withdrawal",
+}
+
+// corporationWallet pulls donations to the user's corporation
+func corporationWallet(
+	ctx context.Context,
+	user *db.User,
+	run *pullRun,
+) ([]int32, error) {
+	charIDs := []int32{}
+
+	if err := setCorporation(ctx, user); err != nil {
+		return charIDs, err
+	}
+
+	divisions, err := db.GetDivisions(ctx, user.CorporationID)
+	if err != nil {
+		return charIDs, err
+	}
+
+	for _, division := range divisions {
+		divisionCharIDs, err := corporationDivision(ctx, user, division, run)
+		if err != nil {
+			return charIDs, err
+		}
+		charIDs = append(charIDs, divisionCharIDs...)
+	}
+
+	return charIDs, nil
+}
+
+// setCorporation ensures the user's corporation is current
+func setCorporation(ctx context.Context, user *db.User) error {
+	corpID, _ := ResolveCharacter(ctx, user.CharacterID)
+	if corpID < 1 {
+		return errors.New("failed to resolve the user's corporation")
+	}
+
+	if corpID == user.CorporationID {
+		return nil
+	}
+
+	if user.CorporationID > 0 {
+		log.Printf(
+			"character %d moved from corporation %d to %d",
+			user.CharacterID,
+			user.CorporationID,
+			corpID,
+		)
+	}
+
+	user.CorporationID = corpID
+
+	// divisions and their cursors are shared by the corporation's directors
+	if err := db.DefaultDivisions(ctx, corpID); err != nil {
+		return err
+	}
+
+	// the corporation is a recipient now, it needs its own preferences. The
+	// ref types are only defaults, another director may have chosen already
+	return db.CreateRefTypePreferences(ctx, corpID, corporationRefTypes)
+}
+
+// corporationDivision pulls donations from a single wallet division
+func corporationDivision(
+	ctx context.Context,
+	user *db.User,
+	division *db.Division,
+	run *pullRun,
+) ([]int32, error) {
+	charIDs := []int32{}
+
+	refTypes, err := db.GetRefTypes(ctx, user.CorporationID)
+	if err != nil {
+		return charIDs, err
+	}
+
+	entries, err := getCorporationJournal(ctx, user, division)
+	if err != nil {
+		return charIDs, err
+	}
+
+	sort.Sort(entries)
+
+	donations := parseForDonations(
+		entries,
+		user.CorporationID,
+		division.LastJournalID,
+		refTypes,
+	)
+
+	if len(donations) > 0 {
+		charIDs = append(charIDs, user.CorporationID)
+	}
+
+	for _, donation := range donations {
+		charIDs = append(charIDs, donation.Donator)
+	}
+
+	setLastJournalID(entries, &division.LastJournalID)
+	run.addDonations(donations)
+	run.divisions = append(run.divisions, division)
+
+	return charIDs, nil
+}
+
+func getCorporationJournal(
+	ctx context.Context,
+	user *db.User,
+	division *db.Division,
+) (walletDonationEntries, error) {
+	client := ctx.Value(cx.Client).(*goesi.APIClient)
+	api := client.ESI.WalletApi
+
+	entries, r, err := api.GetCorporationsCorporationIdWalletsDivisionJournal(
+		ctx,
+		user.CorporationID,
+		division.Division,
+		nil,
+	)
+	if err != nil {
+		return nil, err
+	}
+	noteExpires(user, r)
+
+	journal := asWalletEntries(entries)
+
+	if !knownEntry(journal, division.LastJournalID) {
+		additional, err := expandCorporationJournal(ctx, user, division, r)
+		if err != nil {
+			return nil, err
+		}
+		journal = append(journal, additional...)
+	}
+
+	return journal, nil
+}
+
+// asWalletEntries converts corporation journal entries to character ones
+func asWalletEntries(
+	entries []esi.GetCorporationsCorporationIdWalletsDivisionJournal200Ok,
+) walletDonationEntries {
+	journal := walletDonationEntries{}
+	for _, entry := range entries {
+		journal = append(journal, esi.GetCharactersCharacterIdWalletJournal200Ok{
+			Amount:        entry.Amount,
+			Balance:       entry.Balance,
+			ContextId:     entry.ContextId,
+			ContextIdType: entry.ContextIdType,
+			Date:          entry.Date,
+			Description:   entry.Description,
+			FirstPartyId:  entry.FirstPartyId,
+			Id:            entry.Id,
+			Reason:        entry.Reason,
+			RefType:       entry.RefType,
+			SecondPartyId: entry.SecondPartyId,
+			Tax:           entry.Tax,
+			TaxReceiverId: entry.TaxReceiverId,
+		})
+	}
+	return journal
+}
+
+func expandCorporationJournal(
+	ctx context.Context,
+	user *db.User,
+	division *db.Division,
+	res *http.Response,
+) (walletDonationEntries, error) {
+	lock := &sync.Mutex{}
+	additional := walletDonationEntries{}
+
+	err := fetchPages(ctx, res, func(ctx context.Context, page int32) error {
+		entries, err := additionalCorporationPage(ctx, user, division, page)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		additional = append(additional, entries...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return additional, nil
+}
+
+func additionalCorporationPage(
+	ctx context.Context,
+	user *db.User,
+	division *db.Division,
+	page int32,
+) (walletDonationEntries, error) {
+	client := ctx.Value(cx.Client).(*goesi.APIClient)
+	api := client.ESI.WalletApi
+
+	entries, _, err := api.GetCorporationsCorporationIdWalletsDivisionJournal(
+		ctx,
+		user.CorporationID,
+		division.Division,
+		&esi.GetCorporationsCorporationIdWalletsDivisionJournalOpts{
+			Page: optional.NewInt32(page),
+		},
+	)
+	return asWalletEntries(entries), err
+}
@@ -2,9 +2,9 @@ package worker
 
 import (
 	"context"
-	"errors"
 	"log"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/antihax/goesi"
@@ -14,6 +14,7 @@ import (
 	"github.com/a-tal/esi-isk/isk/api"
 	"github.com/a-tal/esi-isk/isk/cx"
 	"github.com/a-tal/esi-isk/isk/db"
+	"github.com/a-tal/esi-isk/isk/migrations"
 )
 
 // addClient adds an http client and goesi client to context
@@ -22,6 +23,10 @@ func addClient(ctx context.Context) context.Context {
 	opts := ctx.Value(cx.Opts).(*cx.Options)
 
 	transport := httpcache.NewTransport(cache)
+	transport.Transport = newESITransport(
+		http.DefaultTransport,
+		opts.Transport,
+	)
 
 	httpClient := &http.Client{Transport: transport}
 
@@ -39,11 +44,17 @@ func addClient(ctx context.Context) context.Context {
 
 // Context adds the goesi client and auth to context
 func Context(ctx context.Context) context.Context {
+	if err := db.CheckTokenKeys(ctx); err != nil {
+		log.Fatalf("refusing to start: %v", err)
+	}
+
 	ctx = context.WithValue(ctx, cx.DB, db.Connect(ctx))
+	if err := migrations.Check(ctx); err != nil {
+		log.Fatalf("unexpected schema: %v", err)
+	}
 	ctx = context.WithValue(ctx, cx.Statements, db.GetStatements(ctx))
 
-	cache := httpcache.NewMemoryCache()
-	ctx = context.WithValue(ctx, cx.Cache, cache)
+	ctx = context.WithValue(ctx, cx.Cache, db.NewHTTPCache(ctx))
 
 	ctx = addClient(ctx)
 
@@ -52,12 +63,20 @@ func Context(ctx context.Context) context.Context {
 		log.Fatalf("failed to fetch initial market prices: %+v", err)
 	}
 	ctx = context.WithValue(ctx, cx.Prices, prices)
+	ctx = context.WithValue(ctx, cx.PriceSources, newPriceSources(prices))
+	ctx = context.WithValue(ctx, cx.Names, newNameCache(nameTTL))
+	ctx = context.WithValue(ctx, cx.SaveLock, db.NewSaveLock())
+	ctx = context.WithValue(ctx, cx.WorkerID, workerID())
 
-	client := ctx.Value(cx.HTTPClient).(*http.Client)
 	opts := ctx.Value(cx.Opts).(*cx.Options)
 
+	// SSO gets its own client, so ESI errors or a tripped circuit breaker
+	// can't fail token refreshes
+	ssoClient := &http.Client{Timeout: 30 * time.Second}
+
+	ctx = context.WithValue(ctx, cx.Verifier, api.NewVerifier(ctx))
 	ctx = context.WithValue(ctx, cx.Authenticator, goesi.NewSSOAuthenticatorV2(
-		client,
+		ssoClient,
 		opts.Auth.ClientID,
 		opts.Auth.ClientSecret,
 		opts.Auth.RedirectURL,
@@ -71,15 +90,24 @@ func Context(ctx context.Context) context.Context {
 func Run(ctx context.Context) {
 	ctx = Context(ctx)
 
-	loop := 0
+	reencrypted, err := db.ReencryptUsers(ctx)
+	if err != nil {
+		log.Fatalf("failed to re-encrypt user tokens: %+v", err)
+	}
+	log.Printf("re-encrypted tokens of %d users", reencrypted)
+
 	for {
 		updateStandings(ctx, processUsers(ctx))
-		time.Sleep(1 * time.Minute)
-		loop++
-		if loop%60 == 0 {
-			pruneContracts(ctx)
-			pruneDonations(ctx)
-			loop = 0
+		time.Sleep(untilNextPoll(ctx))
+		if claimMaintenance(ctx, "prune", time.Hour) {
+			refreshWindows(ctx)
+			pruneHistory(ctx)
+		}
+		if claimMaintenance(ctx, "names", time.Hour) {
+			refreshStaleNames(ctx)
+		}
+		if claimMaintenance(ctx, "reconcile", 24*time.Hour) {
+			reportDrift(ctx)
 		}
 	}
 }
@@ -91,61 +119,130 @@ func updateStandings(ctx context.Context, charIDs []int32) {
 			continue
 		}
 
-		char, err := db.GetCharacter(ctx, charID)
-		if err != nil {
-			continue
-		}
-
-		standingISK, err := db.GetCharStandingISK(ctx, charID)
-		if err != nil {
-			continue
-		}
-
-		char.GoodStanding = standingISK > (char.ReceivedISK30 * float64(0.01))
-
-		if err := db.SaveCharacter(ctx, char); err != nil {
-			log.Printf("failed to save character %d: %+v", charID, err)
+		if err := db.UpdateStanding(ctx, charID); err != nil {
+			log.Printf("failed to update standing of %d: %+v", charID, err)
 		}
 	}
 }
 
+// processUsers pulls all users needing an update using a pool of workers
 func processUsers(ctx context.Context) []int32 {
 	processed := []int32{}
-	users, err := db.GetUsersToProcess(ctx)
+
+	opts := ctx.Value(cx.Opts).(*cx.Options)
+	workers := opts.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	workerID := ctx.Value(cx.WorkerID).(string)
+	users, err := db.ClaimUsers(
+		ctx,
+		workerID,
+		claimLease,
+		workers*claimsPerWorker,
+	)
 	if err != nil {
-		log.Printf("could not pull users to process: %+v", err)
+		log.Printf("could not claim users to process: %+v", err)
 		return processed
 	}
 
-	for _, user := range users {
-		// TODO: make this parallel
+	queue := make(chan *db.User)
+	results := make(chan []int32)
 
-		ctx, err = addCharacterAuth(ctx, user)
-		if err != nil {
-			log.Printf("failed to get character auth: %+v", err)
-			// delete the character? or track failures then delete
-			continue
+	wg := &sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for user := range queue {
+				results <- processUser(ctx, user)
+			}
+		}()
+	}
+
+	go func() {
+		for _, user := range users {
+			queue <- user
 		}
+		close(queue)
+		wg.Wait()
+		close(results)
+	}()
+
+	// results are only ever merged here, in the calling goroutine
+	for charIDs := range results {
+		processed = mergeCharIDs(processed, charIDs)
+	}
 
-		charIDs, err := pullCharacter(ctx, user)
-		if err != nil {
-			log.Printf("error pulling character %d: %+v", user.CharacterID, err)
+	return processed
+}
+
+// processUser pulls a single user, returning the character IDs involved
+func processUser(ctx context.Context, user *db.User) []int32 {
+	defer releaseUser(ctx, user)
+
+	// the user may have waited in the queue, make sure the lease has time
+	if !renewClaim(ctx, user) {
+		log.Printf("lost claim on %d before pulling", user.CharacterID)
+		return nil
+	}
+
+	authCtx, err := addCharacterAuth(ctx, user)
+	if err == db.ErrTokenReplaced {
+		log.Printf("character %d signed in again during the pull", user.CharacterID)
+		return nil
+	}
+	if err != nil {
+		log.Printf(
+			"failed to get character auth for %d: %+v",
+			user.CharacterID,
+			err,
+		)
+		if isTokenFailure(err) {
+			tokenFailed(ctx, user, err)
 		} else {
-			for _, charID := range charIDs {
-				isKnown := false
-				for _, known := range processed {
-					if known == charID {
-						isKnown = true
-					}
-				}
-				if !isKnown {
-					processed = append(processed, charID)
-				}
-			}
+			deferUser(ctx, user)
 		}
+		return nil
 	}
 
-	return processed
+	charIDs, err := pullCharacter(authCtx, user)
+	if err == errClaimLost {
+		log.Printf("lost claim on %d, the pull was not saved", user.CharacterID)
+		return nil
+	}
+	if err == db.ErrTokenReplaced {
+		log.Printf(
+			"character %d signed in again, the pull was not saved",
+			user.CharacterID,
+		)
+		return nil
+	}
+	if err != nil {
+		log.Printf("error pulling character %d: %+v", user.CharacterID, err)
+		deferUser(ctx, user)
+		return nil
+	}
+
+	return charIDs
+}
+
+// mergeCharIDs appends any character IDs not already known
+func mergeCharIDs(known []int32, charIDs []int32) []int32 {
+	for _, charID := range charIDs {
+		isKnown := false
+		for _, k := range known {
+			if k == charID {
+				isKnown = true
+				break
+			}
+		}
+		if !isKnown {
+			known = append(known, charID)
+		}
+	}
+	return known
 }
 
 func getCharacterToken(
@@ -167,16 +264,22 @@ func getCharacterToken(
 		return nil, err
 	}
 
-	charID, owner, err := api.VerifyTokenHack(ctx, tok.AccessToken)
+	if err := saveRotatedToken(ctx, user, tok); err != nil {
+		return nil, err
+	}
+
+	claims, err := api.VerifyToken(ctx, tok.AccessToken)
 	if err != nil {
 		return nil, err
 	}
 
-	if charID != user.CharacterID || owner != user.OwnerHash {
-		// TODO: delete these characters
-		return nil, errors.New("characterID or owner hash mismatch")
+	if claims.CharacterID != user.CharacterID || claims.Owner != user.OwnerHash {
+		return nil, errTokenMismatch
 	}
 
+	// scopes can only be removed by SSO, so the token is always current
+	user.Scopes = claims.Scopes
+
 	return tokSrc, nil
 }
 
@@ -191,21 +294,150 @@ func addCharacterAuth(
 	return context.WithValue(ctx, goesi.ContextOAuth2, token), nil
 }
 
+// pullRun is everything found in a pull, saved together in one transaction
+type pullRun struct {
+	donations    []*db.Donation
+	contracts    []*db.Contract
+	updates      []*db.Contract
+	affiliations []*db.Affiliation
+	divisions    []*db.Division
+}
+
+func (r *pullRun) addDonations(donations []*db.Donation) {
+	r.donations = append(r.donations, donations...)
+}
+
+func (r *pullRun) addContracts(contracts, updates []*db.Contract) {
+	r.contracts = append(r.contracts, contracts...)
+	r.updates = append(r.updates, updates...)
+}
+
+// characterIDs returns everyone involved in the run, accepted contracts are
+// totalled too so need affiliations as well
+func (r *pullRun) characterIDs() []int32 {
+	ids := []int32{}
+	for _, donation := range r.donations {
+		ids = append(ids, donation.Donator, donation.Recipient)
+	}
+	for _, contracts := range [][]*db.Contract{r.contracts, r.updates} {
+		for _, contract := range contracts {
+			ids = append(ids, contract.Donator, contract.Receiver)
+		}
+	}
+	return ids
+}
+
+// save stores the run with the user's cursors. Rows already saved are
+// skipped, and only new rows are added to the totals
+func (r *pullRun) save(ctx context.Context, user *db.User) error {
+	affiliations, err := resolveAffiliations(ctx, r.characterIDs())
+	if err != nil {
+		return err
+	}
+	r.affiliations = affiliations
+
+	return db.Transaction(ctx, func(ctx context.Context) error {
+		// renewing locks the user until the run is saved, so it can't be
+		// claimed by another worker in the meantime
+		if !renewClaim(ctx, user) {
+			return errClaimLost
+		}
+
+		if err := db.SaveNames(ctx, r.affiliations); err != nil {
+			return err
+		}
+
+		donations := []*db.Donation{}
+		for _, donation := range r.donations {
+			added, err := db.SaveDonation(ctx, donation)
+			if err != nil {
+				return err
+			}
+			if added {
+				donations = append(donations, donation)
+			}
+		}
+
+		contracts := []*db.Contract{}
+		for _, contract := range r.contracts {
+			added, err := db.SaveContract(ctx, contract)
+			if err != nil {
+				return err
+			}
+			if added {
+				contracts = append(contracts, contract)
+			}
+		}
+
+		if err := db.UpdateContracts(ctx, r.updates, r.affiliations); err != nil {
+			return err
+		}
+
+		err := db.SaveCharacterDonations(ctx, donations, r.affiliations)
+		if err != nil {
+			return err
+		}
+
+		err = db.SaveCharacterContracts(ctx, contracts, r.affiliations)
+		if err != nil {
+			return err
+		}
+
+		for _, division := range r.divisions {
+			if err := db.SaveDivision(ctx, division); err != nil {
+				return err
+			}
+		}
+
+		return db.SaveProgress(ctx, user)
+	})
+}
+
 // pullCharacter is the top level function to pull a character's details
 func pullCharacter(ctx context.Context, user *db.User) ([]int32, error) {
 	log.Printf("pulling character: %d", user.CharacterID)
 
-	charIDs, err := characterWallet(ctx, user)
-	if err != nil {
-		return charIDs, err
+	charIDs := []int32{}
+	run := &pullRun{}
+
+	if user.HasScope(api.WalletScope) {
+		walletCharIDs, err := characterWallet(ctx, user, run)
+		if err != nil {
+			return charIDs, err
+		}
+		log.Printf("pulled character wallet: %d", user.CharacterID)
+		charIDs = append(charIDs, walletCharIDs...)
 	}
-	log.Printf("pulled character wallet: %d", user.CharacterID)
 
-	contractCharIDs, err := characterContracts(ctx, user)
-	if err != nil {
-		return charIDs, err
+	if user.HasScope(api.ContractsScope) {
+		contractCharIDs, err := characterContracts(ctx, user, run)
+		if err != nil {
+			return charIDs, err
+		}
+		log.Printf("pulled character contracts: %d", user.CharacterID)
+		charIDs = append(charIDs, contractCharIDs...)
 	}
-	log.Printf("pulled character contracts: %d", user.CharacterID)
 
-	return append(charIDs, contractCharIDs...), db.SaveUser(ctx, user)
+	if user.CorporationMode && user.HasScope(api.CorporationWalletScope) {
+		// the director may have lost their roles, which shouldn't hold up
+		// their own wallet and contracts
+		corpRun := &pullRun{}
+		corpCharIDs, err := corporationWallet(ctx, user, corpRun)
+		if err != nil {
+			log.Printf(
+				"failed to pull corporation wallet of %d: %+v",
+				user.CharacterID,
+				err,
+			)
+		} else {
+			log.Printf("pulled corporation wallet: %d", user.CorporationID)
+			run.addDonations(corpRun.donations)
+			run.divisions = corpRun.divisions
+			charIDs = append(charIDs, corpCharIDs...)
+		}
+	}
+
+	schedulePoll(ctx, user, len(charIDs) > 0)
+
+	return charIDs, run.save(ctx, user)
 }
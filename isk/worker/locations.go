@@ -0,0 +1,101 @@
+package worker
+
+import (
+	"context"
+	"database/sql"
+	"log"
+
+	"github.com/antihax/goesi"
+
+	"github.com/a-tal/esi-isk/isk/api"
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+// isStation returns true if the location ID is an NPC station
+func isStation(id int64) bool {
+	return id >= 60000000 && id < 64000000
+}
+
+// resolveLocations ensures the contract locations are known. Structures are
+// resolved with the user's token, so ctx must have the character auth
+func resolveLocations(
+	ctx context.Context,
+	user *db.User,
+	contracts []*db.Contract,
+) {
+	seen := map[int64]bool{}
+	for _, contract := range contracts {
+		if seen[contract.Location] {
+			continue
+		}
+		seen[contract.Location] = true
+
+		_, err := db.GetLocation(ctx, contract.Location)
+		if err == nil {
+			continue
+		}
+		if err != sql.ErrNoRows {
+			log.Printf("failed to get location %d: %+v", contract.Location, err)
+			continue
+		}
+
+		location, err := resolveLocation(
+			ctx,
+			contract.Location,
+			user.HasScope(api.StructuresScope),
+		)
+		if err != nil {
+			log.Printf("failed to resolve location %d: %+v", contract.Location, err)
+			continue
+		}
+
+		if err := db.SaveLocation(ctx, location); err != nil {
+			log.Printf("failed to save location %d: %+v", contract.Location, err)
+		}
+	}
+}
+
+// resolveLocation looks up the name and solar system of the location
+func resolveLocation(
+	ctx context.Context,
+	id int64,
+	structures bool,
+) (*db.Location, error) {
+	client := ctx.Value(cx.Client).(*goesi.APIClient)
+	api := client.ESI.UniverseApi
+	location := &db.Location{ID: id}
+
+	switch {
+	case isStation(id):
+		station, _, err := api.GetUniverseStationsStationId(ctx, int32(id), nil)
+		if err != nil {
+			return nil, err
+		}
+		location.Name = station.Name
+		location.SystemID = station.SystemId
+	case !structures:
+		// asking without the scope would only cost an ESI error
+		return location, nil
+	default:
+		structure, _, err := api.GetUniverseStructuresStructureId(ctx, id, nil)
+		if err != nil {
+			// without docking access the structure stays unnamed, and is
+			// shown by its solar system when one is known
+			log.Printf("failed to resolve structure %d: %+v", id, err)
+			return location, nil
+		}
+		location.Name = structure.Name
+		location.SystemID = structure.SolarSystemId
+	}
+
+	if location.SystemID > 0 {
+		system, _, err := api.GetUniverseSystemsSystemId(ctx, location.SystemID, nil)
+		if err != nil {
+			return nil, err
+		}
+		location.SystemName = system.Name
+	}
+
+	return location, nil
+}
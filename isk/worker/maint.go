@@ -2,13 +2,151 @@ package worker
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"log"
+	"os"
+	"time"
 
+	"github.com/a-tal/esi-isk/isk/cx"
 	"github.com/a-tal/esi-isk/isk/db"
 )
 
-func pruneContracts(ctx context.Context) {
-	contracts, err := db.GetStaleContracts(ctx)
+// claimLease is how long a worker has to poll the users it claims, before
+// other workers may claim them. The lease is renewed as each user starts
+const claimLease = 10 * time.Minute
+
+// claimsPerWorker is how many users are claimed for each of the pool's
+// workers, few enough to finish well within the lease
+const claimsPerWorker = 10
+
+// errClaimLost is returned when saving a user whose lease ran out, they may
+// have been pulled by another worker since
+var errClaimLost = errors.New("claim on user was lost")
+
+// workerID identifies this worker process, for the users it claims
+func workerID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "worker"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// staleNameBatches is the most batches of stale names refreshed per run
+const staleNameBatches = 10
+
+// renewClaim extends the lease on the user, returning false if it was lost
+func renewClaim(ctx context.Context, user *db.User) bool {
+	workerID := ctx.Value(cx.WorkerID).(string)
+	renewed, err := db.RenewClaim(ctx, user.CharacterID, workerID, claimLease)
+	if err != nil {
+		log.Printf("failed to renew claim on %d: %+v", user.CharacterID, err)
+		return false
+	}
+	return renewed
+}
+
+// releaseUser lets other workers claim the user again
+func releaseUser(ctx context.Context, user *db.User) {
+	workerID := ctx.Value(cx.WorkerID).(string)
+	if err := db.ReleaseUser(ctx, user.CharacterID, workerID); err != nil {
+		log.Printf("failed to release user %d: %+v", user.CharacterID, err)
+	}
+}
+
+// reportDrift logs any characters whose totals drifted from their rows
+func reportDrift(ctx context.Context) {
+	drifts, err := db.Reconcile(ctx, false)
+	if err != nil {
+		log.Printf("failed to reconcile character totals: %+v", err)
+		return
+	}
+
+	for _, drift := range drifts {
+		log.Println(drift)
+	}
+	if len(drifts) > 0 {
+		log.Printf("%d characters drifted, run admin reconcile -fix", len(drifts))
+	}
+}
+
+// claimMaintenance returns true if this worker should run the task now
+func claimMaintenance(
+	ctx context.Context,
+	name string,
+	every time.Duration,
+) bool {
+	claimed, err := db.ClaimMaintenance(ctx, name, every)
+	if err != nil {
+		log.Printf("failed to claim %s maintenance: %+v", name, err)
+		return false
+	}
+	return claimed
+}
+
+// refreshWindows moves donations and contracts out of the 30 day totals
+func refreshWindows(ctx context.Context) {
+	changed, err := db.RefreshWindows(ctx)
+	if err != nil {
+		log.Printf("failed to refresh 30 day totals: %+v", err)
+		return
+	}
+	if changed > 0 {
+		log.Printf("refreshed 30 day totals of %d characters", changed)
+	}
+}
+
+// pruneHistory removes donations and contracts past the retention period
+func pruneHistory(ctx context.Context) {
+	opts := ctx.Value(cx.Opts).(*cx.Options)
+	if opts.Retention < 1 {
+		return
+	}
+
+	pruneContracts(ctx, opts.Retention)
+	pruneDonations(ctx, opts.Retention)
+}
+
+// refreshStaleNames re-resolves names and affiliations older than the name
+// age, in batches, so renames and corporation changes are picked up
+func refreshStaleNames(ctx context.Context) {
+	opts := ctx.Value(cx.Opts).(*cx.Options)
+
+	refreshed := 0
+	for i := 0; i < staleNameBatches; i++ {
+		ids, err := db.GetStaleNames(ctx, opts.NameAge, maxNameIDs)
+		if err != nil {
+			log.Printf("failed to get stale names: %+v", err)
+			break
+		}
+
+		if len(ids) > 0 {
+			if err := refreshNames(ctx, ids); err != nil {
+				log.Printf("failed to refresh stale names: %+v", err)
+				// back off the batch until the next name age, so the
+				// same names aren't picked first again
+				if err := db.TouchNames(ctx, ids); err != nil {
+					log.Printf("failed to back off stale names: %+v", err)
+					break
+				}
+			} else {
+				refreshed += len(ids)
+			}
+		}
+
+		if len(ids) < maxNameIDs {
+			break
+		}
+	}
+
+	if refreshed > 0 {
+		log.Printf("refreshed %d names", refreshed)
+	}
+}
+
+func pruneContracts(ctx context.Context, days int) {
+	contracts, err := db.GetStaleContracts(ctx, days)
 	if err != nil {
 		log.Printf("failed to get stale contracts: %+v", err)
 		return
@@ -21,16 +159,12 @@ func pruneContracts(ctx context.Context) {
 	}
 
 	if len(contracts) > 0 {
-		aff := getContractNames(ctx, contracts)
-		if err := db.SaveCharacterContracts(ctx, contracts, aff, false); err != nil {
-			log.Printf("failed to save contracts after pruning: %+v", err)
-		}
 		log.Printf("pruned %d contracts", len(contracts))
 	}
 }
 
-func pruneDonations(ctx context.Context) {
-	donations, err := db.GetStaleDonations(ctx)
+func pruneDonations(ctx context.Context, days int) {
+	donations, err := db.GetStaleDonations(ctx, days)
 	if err != nil {
 		log.Printf("failed to get stale donations: %+v", err)
 		return
@@ -43,10 +177,6 @@ func pruneDonations(ctx context.Context) {
 	}
 
 	if len(donations) > 0 {
-		aff := getNames(ctx, donations)
-		if err := db.SaveCharacterDonations(ctx, donations, aff, false); err != nil {
-			log.Printf("failed to save donations after pruning: %+v", err)
-		}
 		log.Printf("pruned %d donations", len(donations))
 	}
 }
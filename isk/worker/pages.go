@@ -0,0 +1,52 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// fetchPages calls fetch concurrently for pages 2 up to the X-Pages of the
+// first page's response. The first error cancels the other pages and is
+// returned once every fetch has finished. fetch must be safe to call
+// concurrently
+func fetchPages(
+	ctx context.Context,
+	res *http.Response,
+	fetch func(ctx context.Context, page int32) error,
+) error {
+	xPagesRaw := res.Header.Get("X-Pages")
+	if xPagesRaw == "" {
+		return nil
+	}
+
+	xPages, err := strconv.ParseInt(xPagesRaw, 10, 32)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// buffered for every page, so no fetch is left blocked on sending
+	errs := make(chan error, xPages)
+	wg := &sync.WaitGroup{}
+
+	for page := int32(2); page <= int32(xPages); page++ {
+		wg.Add(1)
+		go func(page int32) {
+			defer wg.Done()
+			if err := fetch(ctx, page); err != nil {
+				cancel()
+				errs <- err
+			}
+		}(page)
+	}
+
+	wg.Wait()
+	close(errs)
+
+	// nil if every page was fetched
+	return <-errs
+}
@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestFetchPages(t *testing.T) {
+	res := &http.Response{Header: http.Header{"X-Pages": {"5"}}}
+
+	lock := &sync.Mutex{}
+	fetched := map[int32]bool{}
+	err := fetchPages(context.Background(), res, func(
+		ctx context.Context,
+		page int32,
+	) error {
+		lock.Lock()
+		defer lock.Unlock()
+		fetched[page] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fetched) != 4 || fetched[1] || !fetched[2] || !fetched[5] {
+		t.Errorf("expected pages 2 to 5 to be fetched, got %v", fetched)
+	}
+
+	// every page failing returns an error, without panicking on send
+	failed := errors.New("page failed")
+	err = fetchPages(context.Background(), res, func(
+		ctx context.Context,
+		page int32,
+	) error {
+		return failed
+	})
+	if err != failed {
+		t.Errorf("expected the page error, got %v", err)
+	}
+
+	noPages := &http.Response{Header: http.Header{}}
+	err = fetchPages(context.Background(), noPages, func(
+		ctx context.Context,
+		page int32,
+	) error {
+		t.Errorf("unexpected fetch of page %d", page)
+		return nil
+	})
+	if err != nil {
+		t.Errorf("expected no error without pages, got %v", err)
+	}
+}
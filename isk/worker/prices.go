@@ -0,0 +1,352 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/antihax/goesi"
+	"github.com/antihax/goesi/esi"
+	"github.com/antihax/goesi/optional"
+
+	"github.com/a-tal/esi-isk/isk/api"
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+const (
+	// theForge is the region containing Jita
+	theForge = int32(10000002)
+
+	// jita is the solar system order book prices are taken from
+	jita = int32(30000142)
+
+	// orderPercentile is the share of order volume skipped over before
+	// taking a price, so a few outlier orders can't set the value
+	orderPercentile = 0.05
+)
+
+// PriceSource values contract items
+type PriceSource interface {
+	// Name is stored with each contract valued by this source
+	Name() string
+
+	// Prices returns the unit price of each type ID
+	Prices(ctx context.Context, typeIDs []int32) (map[int32]float64, error)
+}
+
+// newPriceSources returns all known price sources by name
+func newPriceSources(m *marketPrices) map[string]PriceSource {
+	sources := map[string]PriceSource{}
+	for _, source := range []PriceSource{
+		&adjustedPrices{m},
+		&averagePrices{m},
+		&orderBookPrices{name: "jita_buy", region: theForge, system: jita, buy: true},
+		&orderBookPrices{name: "jita_sell", region: theForge, system: jita},
+	} {
+		sources[source.Name()] = source
+	}
+	return sources
+}
+
+// getPriceSource returns the price source chosen by the recipient
+func getPriceSource(ctx context.Context, charID int32) (PriceSource, error) {
+	name, err := db.GetPriceSource(ctx, charID)
+	if err != nil {
+		return nil, err
+	}
+
+	sources := ctx.Value(cx.PriceSources).(map[string]PriceSource)
+	if source, ok := sources[name]; ok {
+		return source, nil
+	}
+
+	log.Printf("unknown price source %q for %d, using adjusted", name, charID)
+	return sources[db.DefaultPriceSource], nil
+}
+
+// adjustedPrices uses the ESI adjusted price
+type adjustedPrices struct{ m *marketPrices }
+
+func (a *adjustedPrices) Name() string { return "adjusted" }
+
+func (a *adjustedPrices) Prices(
+	_ context.Context,
+	typeIDs []int32,
+) (map[int32]float64, error) {
+	return a.m.lookup(typeIDs, false), nil
+}
+
+// averagePrices uses the ESI average price
+type averagePrices struct{ m *marketPrices }
+
+func (a *averagePrices) Name() string { return "average" }
+
+func (a *averagePrices) Prices(
+	_ context.Context,
+	typeIDs []int32,
+) (map[int32]float64, error) {
+	return a.m.lookup(typeIDs, true), nil
+}
+
+// orderBookPrices uses a percentile of the orders in a solar system. Order
+// book responses are cached by the HTTP cache until ESI expires them
+type orderBookPrices struct {
+	name   string
+	region int32
+	system int32
+	buy    bool
+}
+
+func (o *orderBookPrices) Name() string { return o.name }
+
+func (o *orderBookPrices) Prices(
+	ctx context.Context,
+	typeIDs []int32,
+) (map[int32]float64, error) {
+	prices := map[int32]float64{}
+	for _, typeID := range typeIDs {
+		if _, ok := prices[typeID]; ok {
+			continue
+		}
+
+		orders, err := o.getOrders(ctx, typeID)
+		if err != nil {
+			return nil, err
+		}
+
+		prices[typeID] = percentilePrice(orders, o.buy, orderPercentile)
+	}
+	return prices, nil
+}
+
+// getOrders returns all orders for the type ID in the source's system
+func (o *orderBookPrices) getOrders(
+	ctx context.Context,
+	typeID int32,
+) ([]esi.GetMarketsRegionIdOrders200Ok, error) {
+	client := ctx.Value(cx.Client).(*goesi.APIClient)
+
+	orderType := "sell"
+	if o.buy {
+		orderType = "buy"
+	}
+
+	orders := []esi.GetMarketsRegionIdOrders200Ok{}
+	for page, pages := int32(1), int32(1); page <= pages; page++ {
+		entries, r, err := client.ESI.MarketApi.GetMarketsRegionIdOrders(
+			ctx,
+			orderType,
+			o.region,
+			&esi.GetMarketsRegionIdOrdersOpts{
+				TypeId: optional.NewInt32(typeID),
+				Page:   optional.NewInt32(page),
+			},
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, order := range entries {
+			if order.SystemId == o.system {
+				orders = append(orders, order)
+			}
+		}
+
+		if xPages, err := strconv.ParseInt(r.Header.Get("X-Pages"), 10, 32); err == nil {
+			pages = int32(xPages)
+		}
+	}
+
+	return orders, nil
+}
+
+// percentilePrice returns the price reached after skipping over the given
+// share of the order volume, best priced orders first
+func percentilePrice(
+	orders []esi.GetMarketsRegionIdOrders200Ok,
+	buy bool,
+	percentile float64,
+) float64 {
+	if len(orders) < 1 {
+		return 0
+	}
+
+	sorted := make([]esi.GetMarketsRegionIdOrders200Ok, len(orders))
+	copy(sorted, orders)
+	sort.Slice(sorted, func(i, j int) bool {
+		if buy {
+			return sorted[i].Price > sorted[j].Price
+		}
+		return sorted[i].Price < sorted[j].Price
+	})
+
+	total := int64(0)
+	for _, order := range sorted {
+		total += int64(order.VolumeRemain)
+	}
+
+	skip := int64(float64(total) * percentile)
+	seen := int64(0)
+	for _, order := range sorted {
+		seen += int64(order.VolumeRemain)
+		if seen > skip {
+			return order.Price
+		}
+	}
+
+	return sorted[len(sorted)-1].Price
+}
+
+// marketPrices stores market prices from ESI in memory
+type marketPrices struct {
+	lock     *sync.Mutex
+	adjusted map[int32]float64
+	average  map[int32]float64
+	expires  time.Time
+}
+
+func newPrices(ctx context.Context) (*marketPrices, error) {
+	m := &marketPrices{lock: &sync.Mutex{}}
+	if err := m.update(ctx); err != nil {
+		return nil, err
+	}
+	go m.updater(ctx)
+	return m, nil
+}
+
+// lookup returns the adjusted or average price of each type ID
+func (m *marketPrices) lookup(typeIDs []int32, average bool) map[int32]float64 {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	source := m.adjusted
+	if average {
+		source = m.average
+	}
+
+	prices := map[int32]float64{}
+	for _, typeID := range typeIDs {
+		prices[typeID] = source[typeID]
+	}
+	return prices
+}
+
+func (m *marketPrices) updater(ctx context.Context) {
+	minDt := time.Duration(60 * time.Second)
+
+	for {
+		m.lock.Lock()
+		dt := m.expires.Sub(time.Now().UTC())
+		m.lock.Unlock()
+		if dt < minDt {
+			dt = minDt
+		}
+
+		log.Printf("next market update in: %+v", dt)
+		time.Sleep(dt)
+		log.Println("updating market prices")
+
+		if err := m.update(ctx); err != nil {
+			log.Printf("failed to update market prices: %+v", err)
+		}
+	}
+}
+
+func (m *marketPrices) update(ctx context.Context) error {
+	client := ctx.Value(cx.Client).(*goesi.APIClient)
+	esiPrices, r, err := client.ESI.MarketApi.GetMarketsPrices(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	expires, err := getExpires(r)
+	if err != nil {
+		return err
+	}
+
+	adjusted := map[int32]float64{}
+	average := map[int32]float64{}
+	for _, i := range esiPrices {
+		adjusted[i.TypeId] = i.AdjustedPrice
+		average[i.TypeId] = i.AveragePrice
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.adjusted = adjusted
+	m.average = average
+	m.expires = expires
+	return nil
+}
+
+// pull the next update time from the response headers
+func getExpires(r *http.Response) (expires time.Time, err error) {
+	expires, err = time.Parse(api.RFC1123, r.Header.Get("Expires"))
+	if err != nil {
+		return
+	}
+
+	return expires.Add(1 * time.Second), nil
+}
+
+// valueItems prices the items with the source, returning the total value
+func valueItems(
+	ctx context.Context,
+	source PriceSource,
+	items []*db.Item,
+) (float64, error) {
+	typeIDs := []int32{}
+	for _, item := range items {
+		typeIDs = append(typeIDs, item.TypeID)
+	}
+
+	prices, err := source.Prices(ctx, typeIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := float64(0)
+	for _, item := range items {
+		item.Price = prices[item.TypeID]
+		sum += item.Price * float64(item.Quantity)
+	}
+	return sum, nil
+}
+
+// valueContract values the contract items with the source, falling back to
+// the ESI adjusted price if the source fails. Returns the value and the name
+// of the source used
+func valueContract(
+	ctx context.Context,
+	source PriceSource,
+	items []*db.Item,
+) (float64, string, error) {
+	value, err := valueItems(ctx, source, items)
+	if err == nil {
+		return value, source.Name(), nil
+	}
+
+	sources := ctx.Value(cx.PriceSources).(map[string]PriceSource)
+	fallback := sources[db.DefaultPriceSource]
+	if source.Name() == fallback.Name() {
+		return 0, "", err
+	}
+
+	log.Printf(
+		"failed to value items with %s, using %s: %+v",
+		source.Name(),
+		fallback.Name(),
+		err,
+	)
+
+	value, err = valueItems(ctx, fallback, items)
+	if err != nil {
+		return 0, "", err
+	}
+	return value, fallback.Name(), nil
+}
@@ -0,0 +1,83 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/antihax/goesi/esi"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+func TestPercentilePrice(t *testing.T) {
+	orders := []esi.GetMarketsRegionIdOrders200Ok{
+		{Price: 120, VolumeRemain: 50},
+		{Price: 1, VolumeRemain: 2},
+		{Price: 100, VolumeRemain: 48},
+	}
+
+	tests := []struct {
+		buy      bool
+		expected float64
+	}{
+		// the 2 units at 1 ISK are under 5% of the volume, so are skipped
+		{false, 100},
+		{true, 120},
+	}
+
+	for _, test := range tests {
+		price := percentilePrice(orders, test.buy, 0.05)
+		if price != test.expected {
+			t.Errorf(
+				"invalid price (buy: %t). received %f, expected %f",
+				test.buy,
+				price,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestPercentilePriceNoOrders(t *testing.T) {
+	if price := percentilePrice(nil, false, 0.05); price != 0 {
+		t.Errorf("invalid price. received %f, expected %f", price, 0.0)
+	}
+}
+
+// failingPrices is a price source which is always unavailable
+type failingPrices struct{}
+
+func (f *failingPrices) Name() string { return "jita_sell" }
+
+func (f *failingPrices) Prices(
+	_ context.Context,
+	_ []int32,
+) (map[int32]float64, error) {
+	return nil, errors.New("order book unavailable")
+}
+
+func TestValueContractFallback(t *testing.T) {
+	m := &marketPrices{
+		lock:     &sync.Mutex{},
+		adjusted: map[int32]float64{34: 5.5},
+		average:  map[int32]float64{},
+	}
+	ctx := context.WithValue(
+		context.Background(),
+		cx.PriceSources,
+		newPriceSources(m),
+	)
+
+	items := []*db.Item{{TypeID: 34, Quantity: 10}}
+	value, source, err := valueContract(ctx, &failingPrices{}, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value != 55 || source != "adjusted" || items[0].Price != 5.5 {
+		t.Errorf("unexpected value: %f from %s", value, source)
+	}
+}
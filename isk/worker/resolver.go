@@ -0,0 +1,580 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/antihax/goesi"
+	"github.com/antihax/goesi/esi"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+// nameTTL is how long resolved names and affiliations are trusted for
+const nameTTL = time.Hour
+
+// nameCache is our in-memory cache of resolved names and affiliations
+type nameCache struct {
+	lock         *sync.Mutex
+	ttl          time.Duration
+	names        map[int32]cachedName
+	affiliations map[int32]cachedAffiliation
+}
+
+type cachedName struct {
+	name    string
+	expires time.Time
+}
+
+type cachedAffiliation struct {
+	affiliation *db.Affiliation
+	expires     time.Time
+}
+
+func newNameCache(ttl time.Duration) *nameCache {
+	return &nameCache{
+		lock:         &sync.Mutex{},
+		ttl:          ttl,
+		names:        map[int32]cachedName{},
+		affiliations: map[int32]cachedAffiliation{},
+	}
+}
+
+// getAffiliations returns the cached affiliations, and the IDs not cached
+func (c *nameCache) getAffiliations(ids []int32, now time.Time) (
+	[]*db.Affiliation,
+	[]int32,
+) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	affiliations := []*db.Affiliation{}
+	unknown := []int32{}
+	for _, id := range ids {
+		cached, ok := c.affiliations[id]
+		if ok && now.Before(cached.expires) {
+			affiliations = append(affiliations, cached.affiliation)
+		} else {
+			unknown = append(unknown, id)
+		}
+	}
+	return affiliations, unknown
+}
+
+// getNames returns the cached names, and the IDs not cached
+func (c *nameCache) getNames(ids []int32, now time.Time) (
+	map[int32]string,
+	[]int32,
+) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	names := map[int32]string{}
+	unknown := []int32{}
+	for _, id := range ids {
+		cached, ok := c.names[id]
+		if ok && now.Before(cached.expires) {
+			names[id] = cached.name
+		} else {
+			unknown = append(unknown, id)
+		}
+	}
+	return names, unknown
+}
+
+// add caches the affiliations and every name in them
+func (c *nameCache) add(affiliations []*db.Affiliation, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.prune(now)
+
+	expires := now.Add(c.ttl)
+	for _, aff := range affiliations {
+		for _, name := range []*db.Name{aff.Character, aff.Corporation, aff.Alliance} {
+			if name != nil {
+				c.names[name.ID] = cachedName{name: name.Name, expires: expires}
+			}
+		}
+		c.affiliations[aff.ID()] = cachedAffiliation{
+			affiliation: aff,
+			expires:     expires,
+		}
+	}
+}
+
+// addNames caches names which aren't part of an affiliation
+func (c *nameCache) addNames(names map[int32]string, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expires := now.Add(c.ttl)
+	for id, name := range names {
+		c.names[id] = cachedName{name: name, expires: expires}
+	}
+}
+
+// prune removes expired entries, the lock must be held
+func (c *nameCache) prune(now time.Time) {
+	for id, cached := range c.names {
+		if !now.Before(cached.expires) {
+			delete(c.names, id)
+		}
+	}
+	for id, cached := range c.affiliations {
+		if !now.Before(cached.expires) {
+			delete(c.affiliations, id)
+		}
+	}
+}
+
+// chunkIDs splits the IDs into chunks ESI will accept in one request
+func chunkIDs(ids []int32) [][]int32 {
+	chunks := [][]int32{}
+	for len(ids) > 0 {
+		chunk := ids
+		if len(chunk) > maxNameIDs {
+			chunk = chunk[:maxNameIDs]
+		}
+		ids = ids[len(chunk):]
+		chunks = append(chunks, chunk)
+	}
+	return chunks
+}
+
+// resolveAffiliations returns the affiliation of every character or
+// corporation ID. Cached affiliations are used first, then those stored in
+// the characters table, the rest are looked up in bulk, with ESI requests of
+// up to maxNameIDs each. IDs which can't be resolved are logged and left out
+func resolveAffiliations(ctx context.Context, ids []int32) (
+	[]*db.Affiliation,
+	error,
+) {
+	cache := ctx.Value(cx.Names).(*nameCache)
+	now := time.Now()
+
+	affiliations, unknown := cache.getAffiliations(uniqueIDs(ids), now)
+	if len(unknown) < 1 {
+		return affiliations, nil
+	}
+
+	stored, err := db.GetAffiliations(ctx, unknown...)
+	if err != nil {
+		return nil, err
+	}
+	cache.add(stored, now)
+	affiliations = append(affiliations, stored...)
+
+	unknown = unaffiliated(unknown, stored)
+	if len(unknown) < 1 {
+		return affiliations, nil
+	}
+
+	resolved, err := resolveUnknown(ctx, unknown)
+	if err != nil {
+		return nil, err
+	}
+
+	cache.add(resolved, now)
+	return append(affiliations, resolved...), nil
+}
+
+// unaffiliated returns the IDs without an affiliation
+func unaffiliated(ids []int32, affiliations []*db.Affiliation) []int32 {
+	unknown := []int32{}
+	for _, id := range ids {
+		found := false
+		for _, aff := range affiliations {
+			if aff.Is(id) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			unknown = append(unknown, id)
+		}
+	}
+	return unknown
+}
+
+func resolveUnknown(ctx context.Context, ids []int32) (
+	[]*db.Affiliation,
+	error,
+) {
+	categories, err := postNames(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+	return affiliate(ctx, ids, categories)
+}
+
+// affiliate looks up the corporations and alliances of the character and
+// corporation IDs, whose names and categories are already resolved. IDs
+// which aren't characters or corporations, or whose affiliation can't be
+// resolved, are logged and left out
+func affiliate(
+	ctx context.Context,
+	ids []int32,
+	categories map[int32]esi.PostUniverseNames200Ok,
+) ([]*db.Affiliation, error) {
+	charIDs := []int32{}
+	corpIDs := []int32{}
+	for _, id := range ids {
+		res, ok := categories[id]
+		if !ok {
+			log.Printf("could not resolve the name of %d", id)
+			continue
+		}
+		switch res.Category {
+		case "character":
+			charIDs = append(charIDs, id)
+		case "corporation":
+			corpIDs = append(corpIDs, id)
+		default:
+			log.Printf("%d is a %s, not a character", id, res.Category)
+		}
+	}
+
+	charAffiliations, err := postAffiliations(ctx, charIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	corpAlliances, err := getCorporationAlliances(ctx, corpIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	// names of the corporations and alliances not already resolved
+	orgIDs := []int32{}
+	for _, aff := range charAffiliations {
+		orgIDs = append(orgIDs, aff.CorporationId, aff.AllianceId)
+	}
+	for _, allianceID := range corpAlliances {
+		orgIDs = append(orgIDs, allianceID)
+	}
+	unresolved := []int32{}
+	for _, id := range orgIDs {
+		if _, ok := categories[id]; !ok {
+			unresolved = append(unresolved, id)
+		}
+	}
+
+	orgNames, err := lookupNames(ctx, unresolved)
+	if err != nil {
+		return nil, err
+	}
+	for id, res := range categories {
+		orgNames[id] = res.Name
+	}
+
+	affiliations := []*db.Affiliation{}
+	for _, charID := range charIDs {
+		aff, ok := charAffiliations[charID]
+		if !ok {
+			log.Printf("could not resolve the affiliation of %d", charID)
+			continue
+		}
+		affiliations = appendNamed(affiliations, &db.Affiliation{
+			Character:   &db.Name{ID: charID, Name: orgNames[charID]},
+			Corporation: optionalName(aff.CorporationId, orgNames),
+			Alliance:    optionalName(aff.AllianceId, orgNames),
+		})
+	}
+
+	for _, corpID := range corpIDs {
+		alliance, ok := corpAlliances[corpID]
+		if !ok {
+			continue
+		}
+		affiliations = appendNamed(affiliations, &db.Affiliation{
+			Corporation: &db.Name{ID: corpID, Name: orgNames[corpID]},
+			Alliance:    optionalName(alliance, orgNames),
+		})
+	}
+
+	return affiliations, nil
+}
+
+// appendNamed appends the affiliation if every name in it is known
+func appendNamed(
+	affiliations []*db.Affiliation,
+	aff *db.Affiliation,
+) []*db.Affiliation {
+	if aff.Corporation == nil {
+		log.Printf("could not resolve the corporation of %d", aff.ID())
+		return affiliations
+	}
+	for _, name := range []*db.Name{aff.Character, aff.Corporation, aff.Alliance} {
+		if name != nil && name.Name == "" {
+			log.Printf("could not resolve the names of %d", aff.ID())
+			return affiliations
+		}
+	}
+	return append(affiliations, aff)
+}
+
+// refreshNames re-resolves the names of the IDs from ESI, along with the
+// affiliations of any characters or corporations among them. IDs which
+// can't be refreshed are still marked as resolved, so they don't hold up
+// the rest of the stale names
+func refreshNames(ctx context.Context, ids []int32) error {
+	categories, err := postNames(ctx, ids)
+	if err != nil {
+		return err
+	}
+
+	names := map[int32]string{}
+	unrefreshed := []int32{}
+	affiliated := []int32{}
+	for _, id := range ids {
+		res, ok := categories[id]
+		if !ok {
+			log.Printf("could not refresh the name of %d", id)
+			unrefreshed = append(unrefreshed, id)
+			continue
+		}
+		names[id] = res.Name
+		if res.Category == "character" || res.Category == "corporation" {
+			affiliated = append(affiliated, id)
+		}
+	}
+
+	affiliations, err := affiliate(ctx, affiliated, categories)
+	if err != nil {
+		// the names are still worth refreshing
+		log.Printf("failed to refresh affiliations: %+v", err)
+		affiliations = nil
+	}
+
+	moved := 0
+	err = db.Transaction(ctx, func(ctx context.Context) error {
+		if err := db.RefreshNames(ctx, names); err != nil {
+			return err
+		}
+		if err := db.TouchNames(ctx, unrefreshed); err != nil {
+			return err
+		}
+		for _, aff := range affiliations {
+			changed, err := db.UpdateAffiliation(ctx, aff)
+			if err != nil {
+				return err
+			}
+			if changed {
+				moved++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx.Value(cx.Names).(*nameCache).add(affiliations, time.Now())
+
+	if moved > 0 {
+		log.Printf("updated the affiliations of %d characters", moved)
+	}
+	return nil
+}
+
+func optionalName(id int32, names map[int32]string) *db.Name {
+	if id < 1 {
+		return nil
+	}
+	return &db.Name{ID: id, Name: names[id]}
+}
+
+func uniqueIDs(ids []int32) []int32 {
+	seen := map[int32]bool{}
+	unique := []int32{}
+	for _, id := range ids {
+		if id < 1 || seen[id] {
+			continue
+		}
+		seen[id] = true
+		unique = append(unique, id)
+	}
+	return unique
+}
+
+// lookupNames returns the names of the IDs from our cache, then the names
+// table, then ESI. IDs whose names can't be resolved are logged and left out
+func lookupNames(ctx context.Context, ids []int32) (map[int32]string, error) {
+	cache := ctx.Value(cx.Names).(*nameCache)
+	now := time.Now()
+
+	names, unknown := cache.getNames(uniqueIDs(ids), now)
+
+	known, err := db.GetNames(ctx, unknown...)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []int32{}
+	for _, id := range unknown {
+		if _, ok := known[id]; !ok {
+			missing = append(missing, id)
+		}
+	}
+
+	resolved, err := postNames(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for id, res := range resolved {
+		known[id] = res.Name
+	}
+
+	for _, id := range missing {
+		if _, ok := known[id]; !ok {
+			log.Printf("could not resolve the name of %d", id)
+		}
+	}
+
+	cache.addNames(known, now)
+	for id, name := range known {
+		names[id] = name
+	}
+	return names, nil
+}
+
+// postNames resolves the names and categories of the IDs from ESI
+func postNames(ctx context.Context, ids []int32) (
+	map[int32]esi.PostUniverseNames200Ok,
+	error,
+) {
+	client := ctx.Value(cx.Client).(*goesi.APIClient)
+	names := map[int32]esi.PostUniverseNames200Ok{}
+	for _, chunk := range chunkIDs(ids) {
+		skipped, err := bisectIDs(chunk, func(ids []int32) (int, error) {
+			ret, res, err := client.ESI.UniverseApi.PostUniverseNames(
+				ctx,
+				ids,
+				nil,
+			)
+			if err != nil {
+				return statusCode(res), err
+			}
+			for _, name := range ret {
+				names[name.Id] = name
+			}
+			return 0, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range skipped {
+			log.Printf("ESI could not find the name of %d", id)
+		}
+	}
+	return names, nil
+}
+
+// postAffiliations resolves the corporations and alliances of the
+// characters from ESI
+func postAffiliations(ctx context.Context, charIDs []int32) (
+	map[int32]esi.PostCharactersAffiliation200Ok,
+	error,
+) {
+	client := ctx.Value(cx.Client).(*goesi.APIClient)
+	affiliations := map[int32]esi.PostCharactersAffiliation200Ok{}
+	for _, chunk := range chunkIDs(charIDs) {
+		skipped, err := bisectIDs(chunk, func(ids []int32) (int, error) {
+			ret, res, err := client.ESI.CharacterApi.PostCharactersAffiliation(
+				ctx,
+				ids,
+				nil,
+			)
+			if err != nil {
+				return statusCode(res), err
+			}
+			for _, aff := range ret {
+				affiliations[aff.CharacterId] = aff
+			}
+			return 0, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range skipped {
+			log.Printf("ESI could not find the affiliation of %d", id)
+		}
+	}
+	return affiliations, nil
+}
+
+// bisectIDs calls post with the IDs. ESI fails the whole request with a 404
+// if any one ID is invalid, so the IDs are then split in half and each half
+// retried, until the invalid IDs are found. Those are returned, any other
+// error is returned as is
+func bisectIDs(
+	ids []int32,
+	post func(ids []int32) (int, error),
+) ([]int32, error) {
+	if len(ids) < 1 {
+		return nil, nil
+	}
+
+	status, err := post(ids)
+	if err == nil {
+		return nil, nil
+	}
+	if status != http.StatusNotFound {
+		return nil, err
+	}
+	if len(ids) == 1 {
+		return ids, nil
+	}
+
+	half := len(ids) / 2
+	skipped, err := bisectIDs(ids[:half], post)
+	if err != nil {
+		return nil, err
+	}
+	more, err := bisectIDs(ids[half:], post)
+	if err != nil {
+		return nil, err
+	}
+	return append(skipped, more...), nil
+}
+
+// statusCode returns the status of the ESI response, or 0 without one
+func statusCode(res *http.Response) int {
+	if res == nil {
+		return 0
+	}
+	return res.StatusCode
+}
+
+// getCorporationAlliances returns the alliance of each corporation. ESI
+// has no bulk lookup for these, but corporations rarely donate. Corporations
+// ESI can't find are logged and left out
+func getCorporationAlliances(ctx context.Context, corpIDs []int32) (
+	map[int32]int32,
+	error,
+) {
+	client := ctx.Value(cx.Client).(*goesi.APIClient)
+	alliances := map[int32]int32{}
+	for _, corpID := range corpIDs {
+		ret, res, err := client.ESI.CorporationApi.GetCorporationsCorporationId(
+			ctx,
+			corpID,
+			nil,
+		)
+		if err != nil {
+			if statusCode(res) == http.StatusNotFound {
+				log.Printf("ESI could not find corporation %d", corpID)
+				continue
+			}
+			return nil, fmt.Errorf("failed to get corporation %d: %v", corpID, err)
+		}
+		alliances[corpID] = ret.AllianceId
+	}
+	return alliances, nil
+}
@@ -0,0 +1,114 @@
+package worker
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+func TestNameCache(t *testing.T) {
+	now := time.Date(2018, 12, 25, 22, 34, 0, 0, time.UTC)
+	cache := newNameCache(time.Hour)
+
+	cache.add([]*db.Affiliation{
+		{
+			Character:   &db.Name{ID: 2114454465, Name: "Character"},
+			Corporation: &db.Name{ID: 98000001, Name: "Corporation"},
+			Alliance:    &db.Name{ID: 99000001, Name: "Alliance"},
+		},
+		{Corporation: &db.Name{ID: 98000002, Name: "Donating Corporation"}},
+	}, now)
+
+	affiliations, unknown := cache.getAffiliations(
+		[]int32{2114454465, 98000002, 90000001},
+		now.Add(time.Minute),
+	)
+	if len(affiliations) != 2 {
+		t.Errorf("expected 2 cached affiliations, got %d", len(affiliations))
+	}
+	if len(unknown) != 1 || unknown[0] != 90000001 {
+		t.Errorf("expected 90000001 to be unknown, got %v", unknown)
+	}
+
+	names, unknown := cache.getNames([]int32{98000001, 99000001}, now)
+	if len(unknown) != 0 || names[99000001] != "Alliance" {
+		t.Errorf("expected cached names, got %v and unknown %v", names, unknown)
+	}
+
+	// everything expires after the TTL
+	_, unknown = cache.getAffiliations([]int32{2114454465}, now.Add(time.Hour))
+	if len(unknown) != 1 {
+		t.Errorf("expected the affiliation to expire, got unknown %v", unknown)
+	}
+
+	cache.add([]*db.Affiliation{}, now.Add(time.Hour))
+	if len(cache.names) != 0 || len(cache.affiliations) != 0 {
+		t.Errorf("expected expired entries to be pruned")
+	}
+}
+
+func TestChunkIDs(t *testing.T) {
+	ids := make([]int32, maxNameIDs*2+1)
+	chunks := chunkIDs(ids)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks, got %d", len(chunks))
+	}
+	if len(chunks[0]) != maxNameIDs || len(chunks[2]) != 1 {
+		t.Errorf("unexpected chunk sizes: %d, %d", len(chunks[0]), len(chunks[2]))
+	}
+
+	if len(chunkIDs(nil)) != 0 {
+		t.Errorf("expected no chunks without IDs")
+	}
+}
+
+func TestUniqueIDs(t *testing.T) {
+	unique := uniqueIDs([]int32{3, 1, 3, 0, 2, 1})
+	expected := []int32{3, 1, 2}
+	if len(unique) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, unique)
+	}
+	for i := range expected {
+		if unique[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected, unique)
+		}
+	}
+}
+
+func TestBisectIDs(t *testing.T) {
+	invalid := map[int32]bool{3: true, 6: true}
+	resolved := map[int32]bool{}
+	post := func(ids []int32) (int, error) {
+		for _, id := range ids {
+			if invalid[id] {
+				return http.StatusNotFound, fmt.Errorf("404 Not Found")
+			}
+		}
+		for _, id := range ids {
+			resolved[id] = true
+		}
+		return 0, nil
+	}
+
+	skipped, err := bisectIDs([]int32{1, 2, 3, 4, 5, 6, 7}, post)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(skipped) != 2 || skipped[0] != 3 || skipped[1] != 6 {
+		t.Errorf("expected 3 and 6 to be skipped, got %v", skipped)
+	}
+	if len(resolved) != 5 || resolved[3] || resolved[6] {
+		t.Errorf("expected the other IDs to resolve, got %v", resolved)
+	}
+
+	// other errors aren't retried
+	_, err = bisectIDs([]int32{1, 2}, func(ids []int32) (int, error) {
+		return http.StatusBadGateway, fmt.Errorf("502 Bad Gateway")
+	})
+	if err == nil {
+		t.Errorf("expected a 502 to fail the request")
+	}
+}
@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+const (
+	// minPoll is the soonest a user is polled again, whatever ESI says
+	minPoll = 1 * time.Minute
+
+	// idleBackoff is the first delay for a user with no new activity, it
+	// doubles for every idle poll after that (up to the max-idle option)
+	idleBackoff = 5 * time.Minute
+
+	// retryPoll is when a user is retried after a failed pull
+	retryPoll = 5 * time.Minute
+
+	// maxSleep bounds the worker's sleep, so new signups are picked up
+	maxSleep = 1 * time.Minute
+)
+
+// noteExpires records the ESI cache expiry of the response on the user,
+// keeping the earliest seen. Nothing new can be pulled before then
+func noteExpires(user *db.User, r *http.Response) {
+	if r == nil {
+		return
+	}
+
+	expires, err := getExpires(r)
+	if err != nil {
+		return
+	}
+
+	if user.ESIExpires.IsZero() || expires.Before(user.ESIExpires) {
+		user.ESIExpires = expires
+	}
+}
+
+// schedulePoll sets when the user is next polled. Active users are polled as
+// soon as ESI's cache expires, idle users back off
+func schedulePoll(ctx context.Context, user *db.User, active bool) {
+	opts := ctx.Value(cx.Opts).(*cx.Options)
+
+	if active {
+		user.IdlePolls = 0
+	} else {
+		user.IdlePolls++
+	}
+
+	next := nextPoll(
+		time.Now().UTC(),
+		user.ESIExpires,
+		user.IdlePolls,
+		time.Duration(opts.MaxIdle)*time.Minute,
+	)
+	user.NextPollAt = &next
+}
+
+// nextPoll returns when to poll next, no sooner than ESI's cache expiry
+func nextPoll(
+	now time.Time,
+	expires time.Time,
+	idlePolls int,
+	maxIdle time.Duration,
+) time.Time {
+	next := now.Add(minPoll)
+
+	if idlePolls > 0 {
+		delay := idleBackoff
+		for i := 1; i < idlePolls && delay < maxIdle; i++ {
+			delay *= 2
+		}
+		if maxIdle > 0 && delay > maxIdle {
+			delay = maxIdle
+		}
+		if delay > minPoll {
+			next = now.Add(delay)
+		}
+	}
+
+	if expires.After(next) {
+		return expires
+	}
+	return next
+}
+
+// deferUser retries the user later, after a failed pull
+func deferUser(ctx context.Context, user *db.User) {
+	next := time.Now().UTC().Add(retryPoll)
+	if err := db.DeferUser(ctx, user.CharacterID, next); err != nil {
+		log.Printf("failed to defer user %d: %+v", user.CharacterID, err)
+	}
+}
+
+// untilNextPoll returns how long to wait before polling again
+func untilNextPoll(ctx context.Context) time.Duration {
+	next, err := db.GetNextPoll(ctx)
+	if err != nil {
+		log.Printf("failed to get the next poll time: %+v", err)
+		return maxSleep
+	}
+
+	if next == nil {
+		return maxSleep
+	}
+
+	wait := time.Until(*next)
+	if wait < time.Second {
+		return time.Second
+	}
+	if wait > maxSleep {
+		return maxSleep
+	}
+	return wait
+}
@@ -0,0 +1,33 @@
+package worker
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextPoll(t *testing.T) {
+	now := time.Date(2018, 12, 25, 22, 34, 0, 0, time.UTC)
+	maxIdle := 6 * time.Hour
+
+	tests := []struct {
+		name      string
+		expires   time.Time
+		idlePolls int
+		expected  time.Time
+	}{
+		{"active, cache expires", now.Add(5 * time.Minute), 0, now.Add(5 * time.Minute)},
+		{"active, no expiry", time.Time{}, 0, now.Add(minPoll)},
+		{"active, expired", now.Add(-time.Hour), 0, now.Add(minPoll)},
+		{"idle once", now.Add(time.Minute), 1, now.Add(idleBackoff)},
+		{"idle twice", now.Add(time.Minute), 2, now.Add(2 * idleBackoff)},
+		{"idle before expiry", now.Add(time.Hour), 2, now.Add(time.Hour)},
+		{"idle for ages", now, 1000, now.Add(maxIdle)},
+	}
+
+	for _, test := range tests {
+		next := nextPoll(now, test.expires, test.idlePolls, maxIdle)
+		if !next.Equal(test.expected) {
+			t.Errorf("%s: received %s, expected %s", test.name, next, test.expected)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package worker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"golang.org/x/oauth2"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+// errTokenMismatch is returned when the token is for another character or
+// owner, which means the character was transferred
+var errTokenMismatch = errors.New("characterID or owner hash mismatch")
+
+// saveRotatedToken stores the token if it was refreshed, SSO may also have
+// rotated the refresh token, in which case the stored one is no longer valid
+func saveRotatedToken(
+	ctx context.Context,
+	user *db.User,
+	tok *oauth2.Token,
+) error {
+	if tok.AccessToken == user.AccessToken &&
+		tok.RefreshToken == user.RefreshToken {
+		return nil
+	}
+
+	user.AccessToken = tok.AccessToken
+	user.AccessExpires = tok.Expiry
+	if tok.RefreshToken != "" {
+		user.RefreshToken = tok.RefreshToken
+	}
+
+	return db.SaveTokens(ctx, user)
+}
+
+// tokenFailed records a failure to refresh the user's token. Revoked tokens,
+// or those failing too many times in a row, are parked or deleted
+func tokenFailed(ctx context.Context, user *db.User, err error) {
+	opts := ctx.Value(cx.Opts).(*cx.Options)
+
+	user.RefreshFailures++
+	user.TokenState = db.TokenFailing
+
+	if isRevoked(err) {
+		user.TokenState = db.TokenRevoked
+	} else if user.RefreshFailures >= opts.TokenFailures {
+		user.TokenState = db.TokenParked
+	}
+
+	if user.TokenState != db.TokenFailing && opts.TokenAction == "delete" {
+		log.Printf("deleting %s user %d", user.TokenState, user.CharacterID)
+		if err := db.DeleteUserToken(ctx, user); err != nil {
+			log.Printf("failed to delete user %d: %+v", user.CharacterID, err)
+		}
+		return
+	}
+
+	if err := db.SetTokenState(ctx, user); err != nil {
+		log.Printf("failed to save token state for %d: %+v", user.CharacterID, err)
+	}
+}
+
+// isTokenFailure returns true if the error is down to the token itself, as
+// opposed to an SSO or ESI outage, or a problem on our side. Only those
+// count towards parking the user
+func isTokenFailure(err error) bool {
+	if isRevoked(err) {
+		return true
+	}
+
+	retrieveErr, ok := err.(*oauth2.RetrieveError)
+	if !ok {
+		return false
+	}
+
+	// SSO rejected the refresh itself, rather than failing to answer
+	return retrieveErr.Response != nil &&
+		retrieveErr.Response.StatusCode == http.StatusBadRequest
+}
+
+// isRevoked returns true if SSO says the refresh token is no longer valid
+func isRevoked(err error) bool {
+	if err == errTokenMismatch {
+		return true
+	}
+
+	retrieveErr, ok := err.(*oauth2.RetrieveError)
+	if !ok {
+		return false
+	}
+
+	body := struct {
+		Error string `json:"error"`
+	}{}
+	if jsonErr := json.Unmarshal(retrieveErr.Body, &body); jsonErr != nil {
+		return false
+	}
+
+	return body.Error == "invalid_grant"
+}
@@ -0,0 +1,68 @@
+package worker
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"golang.org/x/oauth2"
+)
+
+func TestIsRevoked(t *testing.T) {
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&oauth2.RetrieveError{Body: []byte(`{"error":"invalid_grant"}`)}, true},
+		{&oauth2.RetrieveError{Body: []byte(`{"error":"invalid_request"}`)}, false},
+		{&oauth2.RetrieveError{Body: []byte(`<html>502 Bad Gateway</html>`)}, false},
+		{errTokenMismatch, true},
+		{errors.New("connection reset by peer"), false},
+	}
+
+	for _, test := range tests {
+		if revoked := isRevoked(test.err); revoked != test.expected {
+			t.Errorf(
+				"invalid revoked for %v. received %t, expected %t",
+				test.err,
+				revoked,
+				test.expected,
+			)
+		}
+	}
+}
+
+func TestIsTokenFailure(t *testing.T) {
+	response := func(status int) *http.Response {
+		return &http.Response{StatusCode: status}
+	}
+
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&oauth2.RetrieveError{Body: []byte(`{"error":"invalid_grant"}`)}, true},
+		{&oauth2.RetrieveError{
+			Response: response(http.StatusBadRequest),
+			Body:     []byte(`{"error":"invalid_request"}`),
+		}, true},
+		{&oauth2.RetrieveError{
+			Response: response(http.StatusBadGateway),
+			Body:     []byte(`<html>502 Bad Gateway</html>`),
+		}, false},
+		{errTokenMismatch, true},
+		{errCircuitOpen, false},
+		{errors.New("connection reset by peer"), false},
+	}
+
+	for _, test := range tests {
+		if failure := isTokenFailure(test.err); failure != test.expected {
+			t.Errorf(
+				"invalid token failure for %v. received %t, expected %t",
+				test.err,
+				failure,
+				test.expected,
+			)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package worker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+var (
+	// errCircuitOpen is returned while ESI requests are being refused
+	errCircuitOpen = errors.New("esi circuit breaker is open")
+)
+
+// esiTransport is an http.RoundTripper which respects the ESI error limit.
+//
+// All requests through the transport are paused when the remaining error
+// budget drops to the configured floor, or ESI returns a 420. Idempotent
+// requests are retried with jittered backoff on 420/5xx responses, and
+// requests are refused outright after too many consecutive failures.
+type esiTransport struct {
+	next http.RoundTripper
+	lock *sync.Mutex
+
+	// floor is the error budget at which we pause all requests
+	floor int
+
+	// retries is the number of times to retry an idempotent request
+	retries int
+
+	// threshold is the number of consecutive failures to open the breaker at
+	threshold int
+
+	// backoff is the base delay between retries
+	backoff time.Duration
+
+	// cooldown is how long the breaker stays open for
+	cooldown time.Duration
+
+	// remain is the last seen X-ESI-Error-Limit-Remain value
+	remain int
+
+	// resume is when requests may continue after an error limit pause
+	resume time.Time
+
+	// failures is the number of consecutive failed responses
+	failures int
+
+	// openUntil is when the breaker will let requests through again
+	openUntil time.Time
+
+	now   func() time.Time
+	sleep func(context.Context, time.Duration) error
+}
+
+// newESITransport wraps next with the error limit aware transport
+func newESITransport(
+	next http.RoundTripper,
+	opts *cx.TransportOptions,
+) *esiTransport {
+	return &esiTransport{
+		next:      next,
+		lock:      &sync.Mutex{},
+		floor:     opts.ErrorFloor,
+		retries:   opts.Retries,
+		threshold: opts.Failures,
+		backoff:   500 * time.Millisecond,
+		cooldown:  time.Duration(opts.Cooldown) * time.Second,
+		remain:    -1,
+		now:       func() time.Time { return time.Now().UTC() },
+		sleep:     sleepContext,
+	}
+}
+
+// sleepContext sleeps for d or until the context is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *esiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if err := t.wait(req.Context()); err != nil {
+			return nil, err
+		}
+
+		res, err := t.next.RoundTrip(req)
+		t.observe(res, err)
+
+		if !t.shouldRetry(req, res, err, attempt) {
+			return res, err
+		}
+
+		if res != nil {
+			discard(res)
+		}
+
+		delay := t.jitter(attempt)
+		log.Printf(
+			"retrying %s %s in %s (attempt %d of %d)",
+			req.Method,
+			req.URL.Path,
+			delay,
+			attempt+1,
+			t.retries,
+		)
+
+		if err := t.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait blocks while requests are paused, or errors if the breaker is open
+func (t *esiTransport) wait(ctx context.Context) error {
+	t.lock.Lock()
+	now := t.now()
+
+	if now.Before(t.openUntil) {
+		t.lock.Unlock()
+		return errCircuitOpen
+	}
+
+	pause := t.resume.Sub(now)
+	t.lock.Unlock()
+
+	if pause <= 0 {
+		return nil
+	}
+
+	log.Printf("waiting %s for the ESI error limit to reset", pause)
+	return t.sleep(ctx, pause)
+}
+
+// observe updates the transport state from the response (or error)
+func (t *esiTransport) observe(res *http.Response, err error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	now := t.now()
+
+	if err != nil {
+		t.failed(now)
+		return
+	}
+
+	remain, remainErr := strconv.Atoi(res.Header.Get("X-ESI-Error-Limit-Remain"))
+	reset, resetErr := strconv.Atoi(res.Header.Get("X-ESI-Error-Limit-Reset"))
+	if resetErr != nil || reset < 1 {
+		reset = 60
+	}
+
+	if remainErr == nil {
+		t.remain = remain
+		if remain <= t.floor {
+			t.pause(now, reset, "error limit remain is %d", remain)
+		}
+	}
+
+	if res.StatusCode == 420 {
+		t.pause(now, reset, "error limited")
+	}
+
+	if res.StatusCode == 420 || res.StatusCode >= 500 {
+		t.failed(now)
+		return
+	}
+
+	if t.failures >= t.threshold && t.threshold > 0 {
+		log.Println("ESI is responding again, closing circuit breaker")
+	}
+	t.failures = 0
+}
+
+// pause all requests for the next reset seconds. caller must hold the lock
+func (t *esiTransport) pause(
+	now time.Time,
+	reset int,
+	reason string,
+	args ...interface{},
+) {
+	resume := now.Add(time.Duration(reset) * time.Second)
+	if resume.After(t.resume) {
+		log.Printf("pausing ESI requests for %ds: "+reason, append(
+			[]interface{}{reset},
+			args...,
+		)...)
+		t.resume = resume
+	}
+}
+
+// failed records a failure, maybe opening the breaker. must hold the lock
+func (t *esiTransport) failed(now time.Time) {
+	t.failures++
+	if t.threshold > 0 && t.failures >= t.threshold {
+		if !now.Before(t.openUntil) {
+			log.Printf(
+				"opening ESI circuit breaker for %s after %d failures",
+				t.cooldown,
+				t.failures,
+			)
+		}
+		t.openUntil = now.Add(t.cooldown)
+	}
+}
+
+// shouldRetry returns true if the request is idempotent and can be retried
+func (t *esiTransport) shouldRetry(
+	req *http.Request,
+	res *http.Response,
+	err error,
+	attempt int,
+) bool {
+	if attempt >= t.retries {
+		return false
+	}
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if err != nil {
+		return req.Context().Err() == nil
+	}
+
+	return res.StatusCode == 420 || res.StatusCode >= 500
+}
+
+// jitter returns the backoff for the attempt, randomized between 50 and 100%
+func (t *esiTransport) jitter(attempt int) time.Duration {
+	d := t.backoff * time.Duration(1<<uint(attempt))
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1)) // #nosec
+}
+
+// discard drains and closes the response body so the connection is reused
+func discard(res *http.Response) {
+	if _, err := io.Copy(ioutil.Discard, res.Body); err != nil {
+		log.Printf("failed to drain response body: %+v", err)
+	}
+	if err := res.Body.Close(); err != nil {
+		log.Printf("failed to close response body: %+v", err)
+	}
+}
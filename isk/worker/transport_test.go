@@ -0,0 +1,181 @@
+package worker
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/a-tal/esi-isk/isk/cx"
+)
+
+// fakeESI returns a test server responding with the statuses in order
+func fakeESI(hits *int32, headers http.Header, statuses ...int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			i := int(atomic.AddInt32(hits, 1)) - 1
+			if i >= len(statuses) {
+				i = len(statuses) - 1
+			}
+			for k, v := range headers {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(statuses[i])
+		},
+	))
+}
+
+// testTransport returns an esiTransport with a fake clock
+func testTransport(opts *cx.TransportOptions) (*esiTransport, *[]time.Duration) {
+	t := newESITransport(http.DefaultTransport, opts)
+	now := time.Date(2018, 12, 25, 22, 34, 0, 0, time.UTC)
+	slept := &[]time.Duration{}
+	t.now = func() time.Time { return now }
+	t.sleep = func(_ context.Context, d time.Duration) error {
+		*slept = append(*slept, d)
+		now = now.Add(d)
+		return nil
+	}
+	return t, slept
+}
+
+func get(t *testing.T, transport http.RoundTripper, method, url string) (
+	*http.Response,
+	error,
+) {
+	req, err := http.NewRequest(method, url, strings.NewReader(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := transport.RoundTrip(req)
+	if res != nil {
+		discard(res)
+	}
+	return res, err
+}
+
+func TestTransportRetriesGET(t *testing.T) {
+	hits := int32(0)
+	server := fakeESI(&hits, nil, 502, 503, 200)
+	defer server.Close()
+
+	transport, slept := testTransport(&cx.TransportOptions{Retries: 3})
+
+	res, err := get(t, transport, http.MethodGet, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Errorf("invalid status. received %d, expected %d", res.StatusCode, 200)
+	}
+	if hits != 3 {
+		t.Errorf("invalid requests. received %d, expected %d", hits, 3)
+	}
+	if len(*slept) != 2 {
+		t.Errorf("invalid backoffs. received %d, expected %d", len(*slept), 2)
+	}
+}
+
+func TestTransportDoesNotRetryPOST(t *testing.T) {
+	hits := int32(0)
+	server := fakeESI(&hits, nil, 502, 200)
+	defer server.Close()
+
+	transport, _ := testTransport(&cx.TransportOptions{Retries: 3})
+
+	res, err := get(t, transport, http.MethodPost, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != 502 {
+		t.Errorf("invalid status. received %d, expected %d", res.StatusCode, 502)
+	}
+	if hits != 1 {
+		t.Errorf("invalid requests. received %d, expected %d", hits, 1)
+	}
+}
+
+func TestTransportPausesAtErrorFloor(t *testing.T) {
+	hits := int32(0)
+	headers := http.Header{}
+	headers.Set("X-ESI-Error-Limit-Remain", "5")
+	headers.Set("X-ESI-Error-Limit-Reset", "42")
+	server := fakeESI(&hits, headers, 404)
+	defer server.Close()
+
+	transport, slept := testTransport(&cx.TransportOptions{ErrorFloor: 10})
+
+	for i := 0; i < 2; i++ {
+		if _, err := get(t, transport, http.MethodGet, server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(*slept) != 1 || (*slept)[0] != 42*time.Second {
+		t.Errorf("invalid pause. received %v, expected %v", *slept, "[42s]")
+	}
+}
+
+func TestTransportPausesOn420(t *testing.T) {
+	hits := int32(0)
+	headers := http.Header{}
+	headers.Set("X-ESI-Error-Limit-Reset", "17")
+	server := fakeESI(&hits, headers, 420, 200)
+	defer server.Close()
+
+	transport, slept := testTransport(&cx.TransportOptions{Retries: 1})
+
+	res, err := get(t, transport, http.MethodGet, server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != 200 {
+		t.Errorf("invalid status. received %d, expected %d", res.StatusCode, 200)
+	}
+
+	// one backoff, then waiting out the rest of the error limit window
+	total := time.Duration(0)
+	for _, d := range *slept {
+		total += d
+	}
+	if total != 17*time.Second {
+		t.Errorf("invalid pause. received %s, expected %s", total, 17*time.Second)
+	}
+}
+
+func TestTransportCircuitBreaker(t *testing.T) {
+	hits := int32(0)
+	server := fakeESI(&hits, nil, 500)
+	defer server.Close()
+
+	transport, _ := testTransport(&cx.TransportOptions{
+		Failures: 2,
+		Cooldown: 30,
+	})
+
+	for i := 0; i < 2; i++ {
+		if _, err := get(t, transport, http.MethodGet, server.URL); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := get(t, transport, http.MethodGet, server.URL); err == nil {
+		t.Error("expected the circuit breaker to be open")
+	}
+
+	if hits != 2 {
+		t.Errorf("invalid requests. received %d, expected %d", hits, 2)
+	}
+
+	// after the cooldown requests are allowed through again
+	transport.now = func() time.Time { return time.Now().UTC().Add(time.Hour) }
+	if _, err := get(t, transport, http.MethodGet, server.URL); err != nil {
+		t.Errorf("expected the circuit breaker to be closed: %+v", err)
+	}
+}
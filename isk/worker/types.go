@@ -0,0 +1,57 @@
+package worker
+
+import (
+	"context"
+	"log"
+
+	"github.com/a-tal/esi-isk/isk/db"
+)
+
+// maxNameIDs is the most IDs ESI will resolve in one request
+const maxNameIDs = 1000
+
+// resolveTypes ensures the item types in the contracts have names
+func resolveTypes(ctx context.Context, contracts []*db.Contract) {
+	typeIDs := []int32{}
+	for _, contract := range contracts {
+		for _, item := range contract.Items {
+			typeIDs = append(typeIDs, item.TypeID)
+		}
+	}
+
+	if len(typeIDs) < 1 {
+		return
+	}
+
+	unknown, err := db.GetUnknownTypes(ctx, typeIDs)
+	if err != nil {
+		log.Printf("failed to get unknown types: %+v", err)
+		return
+	}
+
+	for len(unknown) > 0 {
+		chunk := unknown
+		if len(chunk) > maxNameIDs {
+			chunk = chunk[:maxNameIDs]
+		}
+		unknown = unknown[len(chunk):]
+
+		names, err := ResolveName(ctx, chunk...)
+		if err != nil {
+			log.Printf("failed to resolve type names: %+v", err)
+			return
+		}
+
+		types := []*db.ItemType{}
+		for _, name := range names {
+			if name.Category == "inventory_type" {
+				types = append(types, &db.ItemType{ID: name.Id, Name: name.Name})
+			}
+		}
+
+		if err := db.SaveTypes(ctx, types); err != nil {
+			log.Printf("failed to save type names: %+v", err)
+			return
+		}
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"database/sql"
 	"net/http"
 	"sort"
-	"strconv"
+	"sync"
 
 	"github.com/antihax/goesi"
 	"github.com/antihax/goesi/esi"
@@ -15,9 +15,18 @@ import (
 	"github.com/a-tal/esi-isk/isk/db"
 )
 
-func characterWallet(ctx context.Context, user *db.User) ([]int32, error) {
+func characterWallet(
+	ctx context.Context,
+	user *db.User,
+	run *pullRun,
+) ([]int32, error) {
 	charIDs := []int32{}
 
+	refTypes, err := db.GetRefTypes(ctx, user.CharacterID)
+	if err != nil {
+		return charIDs, err
+	}
+
 	entries, err := getWalletJournal(ctx, user)
 	if err != nil {
 		return charIDs, err
@@ -25,7 +34,12 @@ func characterWallet(ctx context.Context, user *db.User) ([]int32, error) {
 
 	sort.Sort(entries)
 
-	donations := parseForDonations(entries, user)
+	donations := parseForDonations(
+		entries,
+		user.CharacterID,
+		user.LastJournalID,
+		refTypes,
+	)
 
 	if len(donations) > 0 {
 		charIDs = append(charIDs, user.CharacterID)
@@ -35,9 +49,10 @@ func characterWallet(ctx context.Context, user *db.User) ([]int32, error) {
 		charIDs = append(charIDs, donation.Donator)
 	}
 
-	setLastJournalID(entries, user)
+	setLastJournalID(entries, &user.LastJournalID)
+	run.addDonations(donations)
 
-	return charIDs, saveWalletRun(ctx, donations, getNames(ctx, donations))
+	return charIDs, nil
 }
 
 func getWalletJournal(
@@ -53,8 +68,9 @@ func getWalletJournal(
 	if err != nil {
 		return nil, err
 	}
+	noteExpires(user, r)
 
-	if !knownEntry(entries, user) {
+	if !knownEntry(entries, user.LastJournalID) {
 		additional, err := expandWalletJournal(ctx, user, r)
 		if err != nil {
 			return nil, err
@@ -65,68 +81,73 @@ func getWalletJournal(
 	return entries, nil
 }
 
-func getLastJournalID(user *db.User) (bool, int64) {
-	return user.LastJournalID.Valid, user.LastJournalID.Int64
+func getLastJournalID(cursor sql.NullInt64) (bool, int64) {
+	return cursor.Valid, cursor.Int64
 }
 
+// parseForDonations finds donations to the recipient since the cursor
 func parseForDonations(
 	entries walletDonationEntries,
-	user *db.User,
+	recipient int32,
+	cursor sql.NullInt64,
+	refTypes []string,
 ) []*db.Donation {
 	donations := []*db.Donation{}
-	hasLastID, lastID := getLastJournalID(user)
+	hasLastID, lastID := getLastJournalID(cursor)
 	for _, entry := range entries {
 		if hasLastID && entry.Id == lastID {
 			break
 		}
-		if entry.RefType == "player_donation" &&
-			entry.SecondPartyId == user.CharacterID {
-			donations = append(donations, &db.Donation{
-				ID:        entry.Id,
-				Donator:   entry.FirstPartyId,
-				Recipient: user.CharacterID,
-				Timestamp: entry.Date,
-				Note:      entry.Reason,
-				Amount:    entry.Amount,
-			})
+		if !isRefType(entry.RefType, refTypes) || entry.Amount <= 0 {
+			continue
 		}
-	}
-	return donations
-}
-
-func saveWalletRun(
-	ctx context.Context,
-	donations []*db.Donation,
-	affiliations []*db.Affiliation,
-) error {
-	// NB: user is saved at a higher level
-
-	for _, donation := range donations {
-		if err := db.SaveDonation(ctx, donation); err != nil {
-			return err
+		// the other party depends on the ref type, take whichever isn't us
+		donator := entry.FirstPartyId
+		if donator == recipient {
+			donator = entry.SecondPartyId
+		} else if entry.SecondPartyId != recipient {
+			continue
 		}
+		donations = append(donations, &db.Donation{
+			ID:        entry.Id,
+			Donator:   donator,
+			Recipient: recipient,
+			Timestamp: entry.Date,
+			Note:      entry.Reason,
+			Amount:    entry.Amount,
+			RefType:   entry.RefType,
+		})
 	}
-
-	if err := db.SaveNames(ctx, affiliations); err != nil {
-		return err
-	}
-
-	return db.SaveCharacterDonations(ctx, donations, affiliations, true)
+	return donations
 }
 
 type walletDonationEntries []esi.GetCharactersCharacterIdWalletJournal200Ok
 
 func (w walletDonationEntries) Len() int      { return len(w) }
 func (w walletDonationEntries) Swap(i, j int) { w[i], w[j] = w[j], w[i] }
+
+// Less sorts the newest entries first, as the cursor is the newest entry
 func (w walletDonationEntries) Less(i, j int) bool {
-	return w[i].Date.Before(w[j].Date)
+	if w[i].Date.Equal(w[j].Date) {
+		return w[i].Id > w[j].Id
+	}
+	return w[i].Date.After(w[j].Date)
+}
+
+func isRefType(refType string, refTypes []string) bool {
+	for _, r := range refTypes {
+		if r == refType {
+			return true
+		}
+	}
+	return false
 }
 
-func setLastJournalID(entries walletDonationEntries, user *db.User) {
+func setLastJournalID(entries walletDonationEntries, cursor *sql.NullInt64) {
 	if len(entries) < 1 {
 		return
 	}
-	user.LastJournalID = sql.NullInt64{
+	*cursor = sql.NullInt64{
 		Int64: entries[0].Id,
 		Valid: true,
 	}
@@ -135,9 +156,9 @@ func setLastJournalID(entries walletDonationEntries, user *db.User) {
 // return true if we've seen one or more of these entries
 func knownEntry(
 	entries walletDonationEntries,
-	user *db.User,
+	cursor sql.NullInt64,
 ) bool {
-	hasLastID, lastID := getLastJournalID(user)
+	hasLastID, lastID := getLastJournalID(cursor)
 	for _, entry := range entries {
 		if hasLastID && entry.Id == lastID {
 			return true
@@ -151,50 +172,21 @@ func expandWalletJournal(
 	user *db.User,
 	res *http.Response,
 ) (walletDonationEntries, error) {
+	lock := &sync.Mutex{}
 	additional := walletDonationEntries{}
-	xPagesRaw := res.Header.Get("X-Pages")
-	if xPagesRaw == "" {
-		return additional, nil
-	}
-
-	xPages64, err := strconv.ParseInt(xPagesRaw, 10, 32)
-	if err != nil {
-		return additional, err
-	}
-	xPages := int(xPages64)
-
-	more := make(chan walletDonationEntries)
-	errs := make(chan error)
-
-	defer close(more)
-	defer close(errs)
-
-	ctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	started := 0
-	for i := 2; i <= xPages; i++ {
-		started++
-		go func(i int) {
-			entries, additionalErr := additionalWalletPage(ctx, user, int32(i))
-			if additionalErr != nil {
-				errs <- additionalErr
-				return
-			}
-			more <- entries
-		}(i)
-	}
 
-	for i := 0; i < started; i++ {
-		select {
-		case entries := <-more:
-			additional = append(additional, entries...)
-		case err = <-errs:
-			cancel()
-			return nil, err
-		case <-ctx.Done():
-			return nil, ctx.Err()
+	err := fetchPages(ctx, res, func(ctx context.Context, page int32) error {
+		entries, err := additionalWalletPage(ctx, user, page)
+		if err != nil {
+			return err
 		}
+		lock.Lock()
+		defer lock.Unlock()
+		additional = append(additional, entries...)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return additional, nil
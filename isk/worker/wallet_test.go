@@ -0,0 +1,49 @@
+package worker
+
+import (
+	"database/sql"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/antihax/goesi/esi"
+)
+
+func TestParseNewDonations(t *testing.T) {
+	now := time.Date(2018, 12, 25, 22, 34, 0, 0, time.UTC)
+	entry := func(id int64, age time.Duration) esi.GetCharactersCharacterIdWalletJournal200Ok {
+		return esi.GetCharactersCharacterIdWalletJournal200Ok{
+			Id:            id,
+			Date:          now.Add(-age),
+			RefType:       "player_donation",
+			Amount:        1000,
+			FirstPartyId:  123,
+			SecondPartyId: 2114454465,
+		}
+	}
+
+	entries := walletDonationEntries{
+		entry(1, 3*time.Hour),
+		entry(3, time.Hour),
+		entry(2, 2*time.Hour),
+		entry(4, time.Hour),
+	}
+	sort.Sort(entries)
+
+	cursor := sql.NullInt64{Int64: 2, Valid: true}
+	donations := parseForDonations(
+		entries,
+		2114454465,
+		cursor,
+		[]string{"player_donation"},
+	)
+
+	if len(donations) != 2 || donations[0].ID != 4 || donations[1].ID != 3 {
+		t.Errorf("expected donations 4 and 3 newer than the cursor, received %+v", donations)
+	}
+
+	setLastJournalID(entries, &cursor)
+	if cursor.Int64 != 4 {
+		t.Errorf("invalid cursor. received %d, expected %d", cursor.Int64, 4)
+	}
+}
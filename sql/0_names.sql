@@ -1,6 +0,0 @@
-CREATE TABLE IF NOT EXISTS names (
-    id     INTEGER NOT NULL,
-    name   TEXT    NOT NULL,
-
-    PRIMARY KEY (id)
-);